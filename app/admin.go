@@ -0,0 +1,241 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"secure/database"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/xid"
+)
+
+// audit records an administrative action on the target user
+func audit(e *Env, c *context, action, target string, details map[string]string) error {
+	return e.db.AddAuditEvent(database.NewAuditEvent(xid.New().String(), c.id(), action, target, details))
+}
+
+// adminUsers lists the users, optionally searching them with ?q=, a page at
+// a time with ?offset= and ?limit=
+func adminUsers(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStatus {
+	if r.Method != http.MethodGet {
+		return httpStatus{http.StatusNotFound, nil, http.StatusText(http.StatusNotFound), nil}
+	}
+
+	q := r.URL.Query()
+	offset, _ := strconv.Atoi(q.Get("offset"))
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	if offset < 0 {
+		offset = 0
+	}
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+
+	users, total, err := e.db.ListUsers(q.Get("q"), offset, limit)
+
+	if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "", err}
+	}
+
+	res, err := json.Marshal(struct {
+		Status  string           `json:"status"`
+		Results []*database.User `json:"results"`
+		Total   int              `json:"total"`
+		Offset  int              `json:"offset"`
+		Limit   int              `json:"limit"`
+	}{"success", users, total, offset, limit})
+
+	if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "Error marshalling results", err}
+	}
+
+	return httpStatus{http.StatusOK, res, "", nil}
+}
+
+// adminUser views and deletes a user at /admin/users/<email>, and takes the
+// actions at /admin/users/<email>/<action>
+func adminUser(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStatus {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/users/"), "/"), "/")
+	email := parts[0]
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		return viewUser(e, email)
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		return deleteUser(e, r, c, email)
+	case len(parts) == 2 && r.Method == http.MethodPost:
+		return userAction(e, c, email, parts[1])
+	}
+	return httpStatus{http.StatusNotFound, nil, http.StatusText(http.StatusNotFound), nil}
+}
+
+// deleteUser deletes the user, who can be restored during the grace period,
+// or with ?purge=true purges them right away
+func deleteUser(e *Env, r *http.Request, c *context, email string) httpStatus {
+	if strings.EqualFold(email, c.User.Email) {
+		return httpStatus{http.StatusBadRequest, nil, "Admins can't delete themselves", nil}
+	}
+
+	if r.URL.Query().Get("purge") == "true" {
+		if err := purge(e, c.id(), email); err != nil {
+			return httpStatus{http.StatusNotFound, nil, "Unknown user", err}
+		}
+		return httpStatus{http.StatusOK, []byte(`{"status":"success"}`), "", nil}
+	}
+
+	user, err := softDelete(e, email)
+
+	if err != nil {
+		return httpStatus{http.StatusNotFound, nil, "Unknown user", err}
+	}
+
+	if err := audit(e, c, "user.delete", email, nil); err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "", err}
+	}
+
+	return deletedResult(user)
+}
+
+func viewUser(e *Env, email string) httpStatus {
+	user, err := e.db.GetUser(email)
+
+	if err != nil {
+		return httpStatus{http.StatusNotFound, nil, "Unknown user", err}
+	}
+
+	memberships, err := e.db.Memberships(email)
+
+	if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "", err}
+	}
+
+	res, err := json.Marshal(result{"success", struct {
+		*database.User
+		Memberships []*database.Membership `json:"memberships"`
+	}{user, memberships}})
+
+	if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "Error marshalling results", err}
+	}
+
+	return httpStatus{http.StatusOK, res, "", nil}
+}
+
+// userActions change a user for an admin. Disabling, forcing a password
+// reset and revoking sessions all log the user out everywhere. Users forced
+// to reset their password are emailed a token to change it with.
+var userActions = map[string]func(u *database.User){
+	"disable": func(u *database.User) {
+		u.Disabled = true
+		u.SessionVersion++
+	},
+	"enable": func(u *database.User) {
+		u.Disabled = false
+	},
+	"reset-password": func(u *database.User) {
+		u.PasswordResetRequired = true
+		u.SessionVersion++
+	},
+	"unlock": func(u *database.User) {
+		u.FailedLogins = 0
+		u.LockedUntil = time.Time{}
+	},
+	"revoke-sessions": func(u *database.User) {
+		u.SessionVersion++
+	},
+	"restore": func(u *database.User) {
+		u.DeletedAt = time.Time{}
+	},
+}
+
+func userAction(e *Env, c *context, email, action string) httpStatus {
+	update, ok := userActions[action]
+	if !ok {
+		return httpStatus{http.StatusNotFound, nil, http.StatusText(http.StatusNotFound), nil}
+	}
+
+	if action == "disable" && strings.EqualFold(email, c.User.Email) {
+		return httpStatus{http.StatusBadRequest, nil, "Admins can't disable themselves", nil}
+	}
+
+	user, err := e.db.UpdateUser(email, func(u *database.User) error {
+		update(u)
+		return nil
+	})
+
+	if err != nil {
+		return httpStatus{http.StatusNotFound, nil, "Unknown user", err}
+	}
+	e.streams.revoke(email, user)
+
+	if err := audit(e, c, "user."+action, email, nil); err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "", err}
+	}
+
+	if action == "reset-password" {
+		if status := sendPasswordReset(e, user); status.Code != http.StatusOK {
+			return status
+		}
+	}
+
+	res, err := json.Marshal(result{"success", user})
+
+	if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "Error marshalling results", err}
+	}
+
+	return httpStatus{http.StatusOK, res, "", nil}
+}
+
+// passwordResetLifetime is how long the token of a required password reset
+// works for
+const passwordResetLifetime = 24 * time.Hour
+
+// sendPasswordReset emails the user the token to change their password with,
+// as whoever knows the current one may not be them
+func sendPasswordReset(e *Env, user *database.User) httpStatus {
+	token := randomToken(32)
+	now := time.Now()
+	p := &database.PasswordReset{
+		Email:     user.Email,
+		TokenHash: hashToken(token),
+		ExpiresAt: now.Add(passwordResetLifetime),
+	}
+	p.CreatedAt, p.UpdatedAt = now, now
+
+	if err := e.db.AddPasswordReset(p); err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "", err}
+	}
+
+	body := "An administrator asked you to change your password. Log in, and change it with the reset token\n" + token + "\n\n" +
+		"It works once, for the next " + passwordResetLifetime.String() + ".\n"
+
+	if err := e.mail.Send(user.Email, "Change your password", body); err != nil {
+		return httpStatus{http.StatusBadGateway, nil, "Could not send the password reset email", err}
+	}
+	return httpStatus{http.StatusOK, nil, "", nil}
+}
+
+// auditLog lists the recorded admin actions, newest first, optionally of a
+// single user with ?target=
+func auditLog(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStatus {
+	if r.Method != http.MethodGet {
+		return httpStatus{http.StatusNotFound, nil, http.StatusText(http.StatusNotFound), nil}
+	}
+
+	events, err := e.db.AuditEvents(r.URL.Query().Get("target"))
+
+	if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "", err}
+	}
+
+	res, err := json.Marshal(results{"success", events})
+
+	if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "Error marshalling results", err}
+	}
+
+	return httpStatus{http.StatusOK, res, "", nil}
+}
@@ -0,0 +1,95 @@
+package app
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"secure/database"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dchest/uniuri"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminUsers(t *testing.T) {
+	defer forwardedUpstream()()
+
+	email := uniuri.New() + "@me.com"
+	payload := `{"email":"` + email + `","password":"secret"}`
+	signup, _ := http.NewRequest("POST", "/signup", bytes.NewBufferString(payload))
+	cookie := executeRequest(signup).Result().Cookies()[0]
+
+	os.Setenv("ADMIN_EMAILS", "admin-"+email)
+	defer os.Unsetenv("ADMIN_EMAILS")
+	signup, _ = http.NewRequest("POST", "/signup", bytes.NewBufferString(`{"email":"admin-`+email+`","password":"secret"}`))
+	admin := executeRequest(signup).Result().Cookies()[0]
+
+	as := func(cookie *http.Cookie, method, path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, strings.NewReader(""))
+		req.AddCookie(cookie)
+		return executeRequest(req)
+	}
+	login := func(password string) int {
+		req, _ := http.NewRequest("POST", "/login", bytes.NewBufferString(`{"email":"`+email+`","password":"`+password+`"}`))
+		return executeRequest(req).Code
+	}
+
+	assert.Equal(t, http.StatusForbidden, as(cookie, "GET", "/admin/users").Code, "Users can't manage users")
+
+	response := as(admin, "GET", "/admin/users?q="+email+"&limit=1")
+	assert.Equal(t, http.StatusOK, response.Code, "Response should be 200")
+	assert.Contains(t, response.Body.String(), `"total":2,"offset":0,"limit":1`)
+
+	assert.Equal(t, http.StatusOK, as(cookie, "GET", "/proxy").Code)
+	assert.Equal(t, http.StatusOK, as(admin, "POST", "/admin/users/"+email+"/revoke-sessions").Code)
+	assert.Equal(t, http.StatusUnauthorized, as(cookie, "GET", "/proxy").Code, "Revoked sessions should be refused")
+
+	assert.Equal(t, http.StatusOK, as(admin, "POST", "/admin/users/"+email+"/disable").Code)
+	assert.Equal(t, http.StatusForbidden, login("secret"), "Disabled users can't log in")
+	assert.Equal(t, http.StatusOK, as(admin, "POST", "/admin/users/"+email+"/enable").Code)
+
+	for i := 0; i < 5; i++ {
+		login("wrong")
+	}
+	assert.Equal(t, http.StatusForbidden, login("secret"), "Users should be locked out after failed logins")
+	assert.Equal(t, http.StatusOK, as(admin, "POST", "/admin/users/"+email+"/unlock").Code)
+	assert.Equal(t, http.StatusOK, login("secret"))
+
+	assert.Equal(t, http.StatusOK, as(admin, "DELETE", "/admin/users/"+email).Code)
+	assert.Equal(t, http.StatusForbidden, login("secret"), "Deleted users can't log in")
+	assert.Equal(t, http.StatusOK, as(admin, "POST", "/admin/users/"+email+"/restore").Code)
+	assert.Equal(t, http.StatusOK, login("secret"))
+
+	assert.Equal(t, http.StatusOK, as(admin, "DELETE", "/admin/users/"+email+"?purge=true").Code)
+	assert.Equal(t, http.StatusNotFound, as(admin, "GET", "/admin/users/"+email).Code)
+
+	response = as(admin, "GET", "/admin/audit?target="+email)
+	for _, action := range []string{"user.purge", "user.restore", "user.delete", "user.unlock", "user.enable", "user.disable", "user.revoke-sessions"} {
+		assert.Contains(t, response.Body.String(), `"action":"`+action+`"`)
+	}
+}
+
+func TestParallelFailedLogins(t *testing.T) {
+	email, _ := signupUser()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			failedLogin(testEnv, email)
+		}()
+	}
+	wg.Wait()
+
+	user, err := testEnv.db.GetUser(email)
+	assert.NoError(t, err)
+	assert.True(t, user.Locked(), "Failed logins made in parallel should all count")
+
+	assert.NoError(t, testEnv.db.DeleteUser(email))
+	_, err = testEnv.db.UpdateUser(email, func(u *database.User) error { return nil })
+	assert.Equal(t, database.ErrNotFound, err, "Purged users should not be updated back")
+}
@@ -0,0 +1,175 @@
+package app
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"secure/database"
+	"strings"
+	"time"
+
+	"github.com/rs/xid"
+)
+
+// apiKeyPrefix starts every API key so that they can be told apart from
+// tokens, and found by secret scanners
+const apiKeyPrefix = "sk_"
+
+// authenticateAPIKey authenticates a request made with an API key of the
+// form sk_<id>_<secret>
+func authenticateAPIKey(e *Env, key string, c *context) httpStatus {
+	unauthorized := httpStatus{http.StatusUnauthorized, nil, "Invalid API key", nil}
+
+	parts := strings.SplitN(strings.TrimPrefix(key, apiKeyPrefix), "_", 2)
+	if len(parts) != 2 {
+		return unauthorized
+	}
+
+	k, err := e.db.GetAPIKey(parts[0])
+
+	if err != nil {
+		return unauthorized
+	}
+
+	hash := sha256.Sum256([]byte(parts[1]))
+	if subtle.ConstantTimeCompare(hash[:], k.SecretHash) != 1 || !k.Active() {
+		return unauthorized
+	}
+
+	user, err := e.db.GetUser(k.Email)
+
+	if err != nil || user.Disabled || user.Deleted() {
+		return unauthorized
+	}
+
+	c.Principal = principalAPIKey
+	c.User = database.User{Email: user.Email, FirstName: user.FirstName, LastName: user.LastName, Roles: user.Roles, Permissions: user.Permissions}
+	c.APIKeyID = k.ID
+	c.Scopes = k.Scopes
+
+	// last used is only tracked to the minute to save a write per request
+	if now := time.Now(); now.Sub(k.LastUsedAt) > time.Minute {
+		go func() {
+			if err := e.db.TouchAPIKey(k.ID, now); err != nil {
+				e.l.LogError(err, k.Email)
+			}
+		}()
+	}
+
+	return httpStatus{http.StatusOK, nil, "", nil}
+}
+
+// apiKeys lists, creates and revokes the API keys of the logged in user.
+// Principals with the apikeys:manage permission can list and revoke the keys
+// of any user.
+func apiKeys(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStatus {
+	if c.Principal != principalUser {
+		return forbidden(w, forbiddenReason{
+			Code:      "user_session_required",
+			Principal: c.Principal,
+			Message:   "API keys can only be managed by a logged in user",
+		})
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/apikeys"), "/")
+
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		email := r.URL.Query().Get("email")
+		if email == "" {
+			email = c.User.Email
+		}
+		if email != c.User.Email && !c.can(permAPIKeysManage) {
+			return missingPermission(w, c, permAPIKeysManage)
+		}
+		return listAPIKeys(e, email)
+	case r.Method == http.MethodPost && id == "":
+		return createAPIKey(e, w, r, c)
+	case r.Method == http.MethodDelete && id != "":
+		return revokeAPIKey(e, c, id)
+	}
+	return httpStatus{http.StatusNotFound, nil, http.StatusText(http.StatusNotFound), nil}
+}
+
+func listAPIKeys(e *Env, email string) httpStatus {
+	keys, err := e.db.APIKeys(email)
+
+	if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "", err}
+	}
+
+	res, err := json.Marshal(results{"success", keys})
+
+	if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "Error marshalling results", err}
+	}
+
+	return httpStatus{http.StatusOK, res, "", nil}
+}
+
+func createAPIKey(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStatus {
+	var a struct {
+		Name      string
+		Scopes    []string
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		return httpStatus{http.StatusBadRequest, nil, "Could not decode request body", err}
+	}
+
+	if !a.ExpiresAt.IsZero() && a.ExpiresAt.Before(time.Now()) {
+		return httpStatus{http.StatusBadRequest, nil, "expires_at must be in the future", nil}
+	}
+
+	if a.Scopes == nil {
+		a.Scopes = []string{}
+	}
+
+	// keys can't be granted permissions of the gateway their owner lacks
+	for _, scope := range a.Scopes {
+		if containsAny([]string{scope}, gatewayPermissions) && !c.can(scope) {
+			return missingPermission(w, c, scope)
+		}
+	}
+
+	id := xid.New().String()
+	secret := randomToken(32)
+	hash := sha256.Sum256([]byte(secret))
+
+	k := database.NewAPIKey(id, c.User.Email, a.Name, hash[:], a.Scopes, a.ExpiresAt)
+
+	if err := e.db.AddAPIKey(k); err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "", err}
+	}
+
+	k.SecretHash = nil
+	res, err := json.Marshal(result{"success", struct {
+		Key string `json:"key"`
+		*database.APIKey
+	}{apiKeyPrefix + id + "_" + secret, k}})
+
+	if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "Error marshalling results", err}
+	}
+
+	return httpStatus{http.StatusOK, res, "", nil}
+}
+
+func revokeAPIKey(e *Env, c *context, id string) httpStatus {
+	k, err := e.db.GetAPIKey(id)
+
+	if err != nil || (k.Email != c.User.Email && !c.can(permAPIKeysManage)) {
+		return httpStatus{http.StatusNotFound, nil, http.StatusText(http.StatusNotFound), err}
+	}
+
+	if k.RevokedAt.IsZero() {
+		k.RevokedAt = time.Now()
+		if err := e.db.UpdateAPIKey(k); err != nil {
+			return httpStatus{http.StatusInternalServerError, nil, "", err}
+		}
+	}
+
+	return httpStatus{http.StatusOK, []byte(`{"status":"success"}`), "", nil}
+}
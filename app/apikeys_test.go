@@ -0,0 +1,86 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIKeys(t *testing.T) {
+	defer forwardedUpstream()()
+	email, cookie := signupUser()
+
+	create, _ := http.NewRequest("POST", "/apikeys", bytes.NewBufferString(`{"name":"ci","scopes":["deploy"]}`))
+	create.AddCookie(cookie)
+	response := executeRequest(create)
+	assert.Equal(t, http.StatusOK, response.Code, "Response should be 200")
+
+	var created struct {
+		Result struct {
+			Key string `json:"key"`
+			ID  string `json:"id"`
+		} `json:"result"`
+	}
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &created))
+	assert.True(t, strings.HasPrefix(created.Result.Key, "sk_"+created.Result.ID+"_"))
+	assert.NotContains(t, response.Body.String(), "secret_hash")
+
+	proxy, _ := http.NewRequest("GET", "/deploy", strings.NewReader(""))
+	proxy.Header.Set("Authorization", "Bearer "+created.Result.Key)
+	response = executeRequest(proxy)
+	assert.Contains(t, response.Body.String(), `"type":"api_key"`)
+	assert.Contains(t, response.Body.String(), `"email":"`+email+`"`)
+	assert.Contains(t, response.Body.String(), `"scopes":["deploy"]`)
+
+	revoke, _ := http.NewRequest("DELETE", "/apikeys/"+created.Result.ID, nil)
+	revoke.AddCookie(cookie)
+	assert.Equal(t, http.StatusOK, executeRequest(revoke).Code, "Response should be 200")
+
+	proxy, _ = http.NewRequest("GET", "/deploy", strings.NewReader(""))
+	proxy.Header.Set("X-API-Key", created.Result.Key)
+	assert.Equal(t, http.StatusUnauthorized, executeRequest(proxy).Code, "Revoked keys should be refused")
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	email, cookie := signupUser()
+	os.Setenv("ADMIN_EMAILS", "admin-"+email)
+	defer os.Unsetenv("ADMIN_EMAILS")
+	signup, _ := http.NewRequest("POST", "/signup", bytes.NewBufferString(`{"email":"admin-`+email+`","password":"secret"}`))
+	admin := executeRequest(signup).Result().Cookies()[0]
+
+	createKey := func(cookie *http.Cookie, scopes string) (int, string) {
+		create, _ := http.NewRequest("POST", "/apikeys", bytes.NewBufferString(`{"name":"ci","scopes":`+scopes+`}`))
+		create.AddCookie(cookie)
+		response := executeRequest(create)
+		var created struct {
+			Result struct {
+				Key string `json:"key"`
+			} `json:"result"`
+		}
+		json.Unmarshal(response.Body.Bytes(), &created)
+		return response.Code, created.Result.Key
+	}
+	listUsers := func(key string) int {
+		req, _ := http.NewRequest("GET", "/admin/users", nil)
+		req.Header.Set("X-API-Key", key)
+		return executeRequest(req).Code
+	}
+
+	code, _ := createKey(cookie, `["users:manage"]`)
+	assert.Equal(t, http.StatusForbidden, code, "Keys can't have permissions their owner lacks")
+
+	_, key := createKey(admin, `[]`)
+	assert.Equal(t, http.StatusForbidden, listUsers(key), "Keys without the scope should not get the permission of their owner")
+
+	_, key = createKey(admin, `["users:manage"]`)
+	assert.Equal(t, http.StatusOK, listUsers(key), "Response should be 200")
+
+	req, _ := http.NewRequest("POST", "/admin/roles", bytes.NewBufferString(`{"email":"`+email+`","roles":["admin"]}`))
+	req.Header.Set("X-API-Key", key)
+	assert.Equal(t, http.StatusForbidden, executeRequest(req).Code, "Keys should only get the permissions in their scopes")
+}
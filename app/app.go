@@ -1,14 +1,17 @@
 package app
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"secure/database"
 	"secure/logger"
+	"secure/mailer"
 	"secure/server"
-
-	jwtmiddleware "github.com/auth0/go-jwt-middleware"
-	"github.com/dgrijalva/jwt-go"
+	"strconv"
+	"time"
 )
 
 var (
@@ -18,22 +21,23 @@ var (
 
 // Env sets the environment variables for the application
 type Env struct {
-	db  database.Datastore
-	l   logger.Logger
-	jwt *jwtmiddleware.JWTMiddleware
+	db       database.Datastore
+	l        logger.Logger
+	keys     *keyring
+	policies *policies
+	mail     mailer.Mailer
+	// providers are the upstream identity providers users can log in with
+	providers map[string]*provider
+	streams   *streams
+	routes    *routes
+	metrics   *metrics
+	limits    *limiter
 }
 
 // Start starts the application
 func Start() {
 	l := logger.NewLogger("secure", os.Getenv("ENV"), version)
 
-	jwtMiddleware := jwtmiddleware.New(jwtmiddleware.Options{
-		ValidationKeyGetter: func(token *jwt.Token) (interface{}, error) {
-			return []byte("My Secret"), nil
-		},
-		SigningMethod: jwt.SigningMethodHS256,
-	})
-
 	db, err := database.New(os.Getenv("DB_PATH"), l)
 
 	if err != nil {
@@ -41,8 +45,99 @@ func Start() {
 	}
 	defer db.Close()
 
-	env := Env{db, l, jwtMiddleware}
+	alg := os.Getenv("JWT_ALG")
+	if alg == "" {
+		alg = "RS256"
+	}
+
+	keys, err := newKeyring(db, alg,
+		envDuration("JWT_KEY_ROTATION", 30*24*time.Hour),
+		envDuration("JWT_KEY_OVERLAP", tokenLifetime))
+
+	if err != nil {
+		panic(err)
+	}
+
+	env := Env{db: db, l: l, keys: keys, policies: &policies{}, mail: mailer.New(), providers: map[string]*provider{}, streams: &streams{}, routes: &routes{}, metrics: &metrics{}, limits: &limiter{}}
+
+	if path := os.Getenv("IDENTITY_PROVIDERS_FILE"); path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err == nil {
+			env.providers, err = parseProviders(b)
+		}
+		if err != nil {
+			panic(err)
+		}
+		// users are sent back to the issuer unless the provider says where
+		for _, p := range env.providers {
+			if issuer() == "" && (p.RedirectURL == "" || (p.Type == "saml" && p.EntityID == "")) {
+				panic("The identity provider " + p.Name + " needs ISSUER to be set")
+			}
+		}
+	}
+
+	if path := os.Getenv("POLICY_FILE"); path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err == nil {
+			err = env.policies.load(b)
+		}
+		if err != nil {
+			panic(err)
+		}
+		go watchFile(&env, path, envDuration("POLICY_RELOAD_INTERVAL", 5*time.Second), env.policies.load)
+	}
+
+	if err := env.routes.loadFallback(); err != nil {
+		panic(err)
+	}
+
+	if path := os.Getenv("ROUTES_FILE"); path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err == nil {
+			err = env.routes.load(b)
+		}
+		if err != nil {
+			panic(err)
+		}
+		go watchFile(&env, path, envDuration("ROUTES_RELOAD_INTERVAL", 5*time.Second), env.routes.load)
+		go checkUpstreams(&env, envDuration("HEALTH_CHECK_INTERVAL", 10*time.Second))
+	}
+
+	// upstreams served over https with certificates of a private CA
+	if path := os.Getenv("PROXY_CA_FILE"); path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			panic(err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			panic("No certificates in " + path)
+		}
+		proxyTransport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
 	env.setupRoutes()
 
+	go keys.rotate(&env, time.Minute)
+	go purgeDeleted(&env, envDuration("PURGE_INTERVAL", time.Hour))
+
 	server.New(l, r)
 }
+
+// envDuration reads a duration such as "720h" from the environment
+func envDuration(name string, def time.Duration) time.Duration {
+	d, err := time.ParseDuration(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return d
+}
+
+// envInt reads an integer from the environment
+func envInt(name string, def int) int {
+	i, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return i
+}
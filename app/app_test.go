@@ -7,11 +7,16 @@ import (
 	"net/http/httptest"
 	"os"
 	"secure/database"
+	"secure/jwk"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"bou.ke/monkey"
 	"github.com/dchest/uniuri"
+	"github.com/dgrijalva/jwt-go"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -26,12 +31,82 @@ func structToString(s interface{}) string {
 	return string(d)
 }
 
+// forwardedUpstream points FORWARD_URL at a local upstream that echoes the
+// X-Forwarded-User header it receives
+func forwardedUpstream() func() {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Forwarded-User")))
+	}))
+	restore := useForwardURL(strings.TrimPrefix(upstream.URL, "http://"))
+
+	return func() {
+		upstream.Close()
+		restore()
+	}
+}
+
+// useForwardURL points FORWARD_URL at the host
+func useForwardURL(host string) func() {
+	os.Setenv("FORWARD_URL", host)
+	testEnv.routes.loadFallback()
+
+	return func() {
+		os.Setenv("FORWARD_URL", "www.google.com")
+		testEnv.routes.loadFallback()
+	}
+}
+
+// signupUser signs up a new user and returns their email, in the form it
+// is stored, and jwt cookie
+func signupUser() (string, *http.Cookie) {
+	email := strings.ToLower(uniuri.New()) + "@me.com"
+	payload := []byte(`{"email":"` + email + `","password":"` + uniuri.New() + `"}`)
+	signup, _ := http.NewRequest("POST", "/signup", bytes.NewBuffer(payload))
+	return email, executeRequest(signup).Result().Cookies()[0]
+}
+
+var testEnv *Env
+
 type loggerX struct{}
 
-func (l *loggerX) LogRequest(*http.Request, string, string, int, string) {}
-func (l *loggerX) LogDBRequest(string, string, ...interface{})           {}
-func (l *loggerX) LogError(error, string)                                {}
-func (l *loggerX) LogStart(string)                                       {}
+func (l *loggerX) LogRequest(*http.Request, string, string, int, string)       {}
+func (l *loggerX) LogDBRequest(string, string, ...interface{})                 {}
+func (l *loggerX) LogPolicyDecision(*http.Request, string, string, bool, bool) {}
+func (l *loggerX) LogError(error, string)                                      {}
+func (l *loggerX) LogStart(string)                                             {}
+
+// mailX keeps the last email sent to each address, whatever its case
+type mailX struct {
+	sync.Mutex
+	sent map[string]string
+}
+
+func (m *mailX) Send(to, subject, body string) error {
+	m.Lock()
+	defer m.Unlock()
+	m.sent[strings.ToLower(to)] = body
+	return nil
+}
+
+func (m *mailX) last(to string) string {
+	m.Lock()
+	defer m.Unlock()
+	return m.sent[strings.ToLower(to)]
+}
+
+// next waits for an email to the address other than the previous one, as
+// some are sent in the background
+func (m *mailX) next(to, previous string) string {
+	for i := 0; i < 100; i++ {
+		if body := m.last(to); body != previous {
+			return body
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return previous
+}
+
+var testMail = &mailX{sent: map[string]string{}}
 
 func TestMain(m *testing.M) {
 	patch := monkey.Patch(time.Now, func() time.Time {
@@ -42,15 +117,26 @@ func TestMain(m *testing.M) {
 	os.Setenv("DARE_PASSWORD", "test")
 	os.Setenv("DARE_SALT", "test")
 	os.Setenv("FORWARD_URL", "www.google.com")
+	// time is frozen, so buckets would never refill
+	os.Setenv("RATE_LIMIT", "off")
+	os.Setenv("RATE_LIMIT_LOGIN", "off")
+	os.Setenv("RATE_LIMIT_SIGNUP", "off")
 	db, err := database.New("/tmp/badger_test_db", &loggerX{})
 	if err != nil {
 		panic(err)
 	}
-	env := Env{db, &loggerX{}, nil}
+	keys, err := newKeyring(db, "ES256", time.Hour, tokenLifetime)
+	if err != nil {
+		panic(err)
+	}
+	env := Env{db: db, l: &loggerX{}, keys: keys, policies: &policies{}, mail: testMail, providers: map[string]*provider{}, streams: &streams{}, routes: &routes{}, metrics: &metrics{}, limits: &limiter{}}
+	env.routes.loadFallback()
 	env.setupRoutes()
+	testEnv = &env
 	m.Run()
 	db.Close()
 	os.RemoveAll("/tmp/badger_test_db")
+	os.RemoveAll("/tmp/badger_test_db-keys")
 }
 
 func TestSignUp(t *testing.T) {
@@ -91,6 +177,8 @@ func TestLogin(t *testing.T) {
 }
 
 func TestCanCallAuthenticatedEndPoint(t *testing.T) {
+	defer forwardedUpstream()()
+
 	email := uniuri.New() + "@me.com"
 	pass := uniuri.New()
 
@@ -104,3 +192,94 @@ func TestCanCallAuthenticatedEndPoint(t *testing.T) {
 	response := executeRequest(proxy)
 	assert.Equal(t, response.Code, http.StatusOK, "Response should be 200")
 }
+
+func TestTokensAreVerifiableWithJWKS(t *testing.T) {
+	email := uniuri.New() + "@me.com"
+	pass := uniuri.New()
+
+	payload := []byte(`{"email":"` + email + `","password":"` + pass + `"}`)
+	signup, _ := http.NewRequest("POST", "/signup", bytes.NewBuffer(payload))
+	resp := executeRequest(signup)
+
+	req, _ := http.NewRequest("GET", "/.well-known/jwks.json", nil)
+	response := executeRequest(req)
+	assert.Equal(t, http.StatusOK, response.Code, "Response should be 200")
+	assert.Empty(t, response.Result().Cookies(), "JWKS should not issue a token")
+
+	var set jwk.Set
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &set))
+	assert.NotEmpty(t, set.Keys)
+
+	token, _, err := new(jwt.Parser).ParseUnverified(resp.Result().Cookies()[0].Value, &Claims{})
+	assert.NoError(t, err)
+	assert.Equal(t, "ES256", token.Method.Alg())
+	assert.Equal(t, set.Keys[0].Kid, token.Header["kid"], "Token should be signed with the newest key")
+	assert.Equal(t, "EC", set.Keys[0].Kty)
+	assert.Equal(t, "P-256", set.Keys[0].Crv)
+}
+
+func TestKeyRotation(t *testing.T) {
+	db, err := database.New("/tmp/badger_test_keys_db", &loggerX{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("/tmp/badger_test_keys_db")
+	defer os.RemoveAll("/tmp/badger_test_keys_db-keys")
+	defer db.Close()
+
+	// the clock is read by the goroutines of the datastore too
+	start := time.Date(2019, 1, 1, 1, 1, 1, 1, time.UTC)
+	var elapsed int64
+	monkey.Patch(time.Now, func() time.Time { return start.Add(time.Duration(atomic.LoadInt64(&elapsed))) })
+	defer monkey.Patch(time.Now, func() time.Time { return start })
+
+	keys, err := newKeyring(db, "ES256", time.Hour, 2*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func() (string, string) {
+		ss, err := keys.sign(jwt.StandardClaims{Subject: "user@me.com"})
+		assert.NoError(t, err)
+		token, err := jwt.Parse(ss, keys.verificationKey)
+		assert.NoError(t, err)
+		return ss, token.Header["kid"].(string)
+	}
+	published := func() []string {
+		set, err := keys.set()
+		assert.NoError(t, err)
+		var kids []string
+		for _, k := range set.Keys {
+			kids = append(kids, k.Kid)
+		}
+		return kids
+	}
+
+	first, firstKid := sign()
+	assert.Len(t, published(), 1)
+
+	atomic.StoreInt64(&elapsed, int64(55*time.Minute))
+	assert.NoError(t, keys.refresh())
+	kids := published()
+	assert.Len(t, kids, 2, "The next key should be published before it signs")
+	_, kid := sign()
+	assert.Equal(t, firstKid, kid, "The current key should sign until the next one is active")
+
+	atomic.StoreInt64(&elapsed, int64(time.Hour))
+	assert.NoError(t, keys.refresh())
+	_, kid = sign()
+	assert.NotEqual(t, firstKid, kid, "The next key should sign once active")
+	assert.Contains(t, kids, kid, "The key should have been published a cache lifetime before")
+	_, err = jwt.Parse(first, keys.verificationKey)
+	assert.NoError(t, err, "Tokens signed with the previous key should stay valid")
+
+	atomic.StoreInt64(&elapsed, int64(2*time.Hour+59*time.Minute))
+	assert.NoError(t, keys.refresh())
+	_, err = jwt.Parse(first, keys.verificationKey)
+	assert.NoError(t, err, "The previous key should be kept until the tokens it signed expire")
+
+	atomic.StoreInt64(&elapsed, int64(3*time.Hour+time.Minute))
+	assert.NoError(t, keys.refresh())
+	_, err = jwt.Parse(first, keys.verificationKey)
+	assert.Error(t, err, "The previous key should be removed once the tokens it signed expired")
+}
@@ -0,0 +1,87 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"secure/identity"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/rs/xid"
+)
+
+// assertionLifetime is how long identity assertions are valid for by default
+const assertionLifetime = time.Minute
+
+// assertionConfig signs the identity sent to the upstream of a route in
+// identity.Header, for its audience only. Assertions are signed with the
+// keys of the service, verifiable with its JWKS, or HS256 with the secret in
+// the SecretEnv environment variable.
+type assertionConfig struct {
+	Audience  string `json:"audience"`
+	SecretEnv string `json:"secret_env"`
+	Lifetime  string `json:"lifetime"`
+	// ForwardUser keeps sending the unsigned X-Forwarded-User too, while
+	// upstreams move to assertions
+	ForwardUser bool `json:"forward_user"`
+
+	lifetime time.Duration
+	secret   []byte
+}
+
+func (a *assertionConfig) parse(route string) error {
+	if a.Audience == "" {
+		a.Audience = route
+	}
+
+	a.lifetime = assertionLifetime
+	if a.Lifetime != "" {
+		var err error
+		if a.lifetime, err = time.ParseDuration(a.Lifetime); err != nil {
+			return fmt.Errorf("Invalid assertion lifetime %s", a.Lifetime)
+		}
+	}
+
+	if a.SecretEnv != "" {
+		secret := os.Getenv(a.SecretEnv)
+		if len(secret) < 32 {
+			return fmt.Errorf("The assertion secret in %s must be at least 32 bytes", a.SecretEnv)
+		}
+		a.secret = []byte(secret)
+	}
+	return nil
+}
+
+// sign returns the assertion of the identity of the principal
+func (a *assertionConfig) sign(e *Env, r *http.Request, c *context) (string, error) {
+	now := time.Now()
+	claims := identity.Identity{
+		Principal: c.Principal,
+		Roles:     c.roles(),
+		Session:   c.Session,
+		ClientID:  c.ClientID,
+		APIKeyID:  c.APIKeyID,
+		Scopes:    c.Scopes,
+		Org:       c.Org,
+		OrgRole:   c.OrgRole,
+		StandardClaims: jwt.StandardClaims{
+			Id:        xid.New().String(),
+			Issuer:    issuer(),
+			Subject:   c.id(),
+			Audience:  a.Audience,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(a.lifetime).Unix(),
+		},
+	}
+	if c.Principal != principalClient {
+		claims.Email, claims.FirstName, claims.LastName = c.User.Email, c.User.FirstName, c.User.LastName
+	}
+
+	if a.secret != nil {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, &claims)
+		token.Header["typ"] = identity.Type
+		return token.SignedString(a.secret)
+	}
+	return e.keys.signWithType(&claims, identity.Type)
+}
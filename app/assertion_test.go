@@ -0,0 +1,92 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"secure/identity"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdentityAssertions(t *testing.T) {
+	email, cookie := signupUser()
+
+	gateway := httptest.NewServer(r)
+	defer gateway.Close()
+
+	verifier := &identity.Verifier{Audience: "billing", JWKSURL: gateway.URL + "/.well-known/jwks.json"}
+	var got *http.Request
+	upstream := httptest.NewServer(verifier.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		id, _ := identity.FromContext(r.Context())
+		w.Write([]byte(id.Subject))
+	})))
+	defer upstream.Close()
+
+	defer useRoutes(t, `{"routes": [{"name": "billing", "path_prefix": "/billing", "upstream": "`+upstream.URL+`", "assertion": {}}]}`)()
+
+	req, _ := http.NewRequest("GET", "/billing", nil)
+	req.AddCookie(cookie)
+	response := executeRequest(req)
+	assert.Equal(t, http.StatusOK, response.Code, "Upstreams should verify the assertion")
+	assert.Equal(t, email, response.Body.String())
+	assert.Empty(t, got.Header.Get("X-Forwarded-User"), "The identity should only be sent signed")
+
+	assertion := got.Header.Get(identity.Header)
+	id, err := verifier.Verify(assertion)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{defaultRole}, id.Roles)
+	assert.Equal(t, principalUser, id.Principal)
+
+	other := &identity.Verifier{Audience: "docs", JWKSURL: verifier.JWKSURL}
+	_, err = other.Verify(assertion)
+	assert.Equal(t, identity.ErrInvalid, err, "Assertions should only be valid for their audience")
+
+	_, err = verifier.Verify(cookie.Value)
+	assert.Equal(t, identity.ErrInvalid, err, "Session tokens are not assertions")
+
+	req, _ = http.NewRequest("GET", "/me", nil)
+	req.Header.Set("Authorization", "Bearer "+assertion)
+	assert.Equal(t, http.StatusUnauthorized, executeRequest(req).Code, "Assertions are not session tokens")
+
+	req, _ = http.NewRequest("GET", "/billing", nil)
+	req.Header.Set(identity.Header, assertion)
+	assert.Equal(t, http.StatusUnauthorized, executeRequest(req).Code, "Assertions can't be replayed through the gateway")
+}
+
+func TestIdentityAssertionsWithSecret(t *testing.T) {
+	email, cookie := signupUser()
+
+	var got *http.Request
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+	}))
+	defer upstream.Close()
+
+	table := `{"routes": [{"path_prefix": "/billing", "upstream": "` + upstream.URL + `",
+		"assertion": {"audience": "billing", "secret_env": "BILLING_SECRET", "forward_user": true}}]}`
+
+	os.Setenv("BILLING_SECRET", "short")
+	assert.Error(t, testEnv.routes.load([]byte(table)), "Secrets should be long enough")
+
+	secret := "0123456789abcdef0123456789abcdef"
+	os.Setenv("BILLING_SECRET", secret)
+	defer os.Unsetenv("BILLING_SECRET")
+	defer useRoutes(t, table)()
+
+	req, _ := http.NewRequest("GET", "/billing", nil)
+	req.AddCookie(cookie)
+	assert.Equal(t, http.StatusOK, executeRequest(req).Code, "Response should be 200")
+	assert.Contains(t, got.Header.Get("X-Forwarded-User"), email, "X-Forwarded-User can be kept while upstreams move")
+
+	verifier := &identity.Verifier{Audience: "billing", Secret: []byte(secret)}
+	id, err := verifier.Verify(got.Header.Get(identity.Header))
+	assert.NoError(t, err)
+	assert.Equal(t, email, id.Email)
+
+	verifier.Secret = []byte("fedcba9876543210fedcba9876543210")
+	_, err = verifier.Verify(got.Header.Get(identity.Header))
+	assert.Equal(t, identity.ErrInvalid, err, "Assertions should only verify with their secret")
+}
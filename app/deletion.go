@@ -0,0 +1,205 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"secure/database"
+	"time"
+
+	"github.com/rs/xid"
+)
+
+// gracePeriod is how long deleted users can be restored for before they are
+// purged
+func gracePeriod() time.Duration {
+	return envDuration("DELETION_GRACE_PERIOD", 30*24*time.Hour)
+}
+
+// softDelete deletes the user, logging them out everywhere. They are purged
+// at the end of the grace period.
+func softDelete(e *Env, email string) (*database.User, error) {
+	user, err := e.db.UpdateUser(email, func(u *database.User) error {
+		if !u.Deleted() {
+			u.DeletedAt = time.Now()
+			u.SessionVersion++
+		}
+		return nil
+	})
+
+	if err == nil {
+		e.streams.revoke(email, user)
+	}
+	return user, err
+}
+
+func deletedResult(user *database.User) httpStatus {
+	res, err := json.Marshal(result{"success", struct {
+		DeletedAt time.Time `json:"deleted_at"`
+		PurgeAt   time.Time `json:"purge_at"`
+	}{user.DeletedAt, user.DeletedAt.Add(gracePeriod())}})
+
+	if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "Error marshalling results", err}
+	}
+
+	return httpStatus{http.StatusOK, res, "", nil}
+}
+
+// deleteMe deletes the logged in user, who must confirm their password
+func deleteMe(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStatus {
+	if c.Principal != principalUser {
+		return forbidden(w, forbiddenReason{
+			Code:      "user_session_required",
+			Principal: c.Principal,
+			Message:   "Accounts can only be deleted by a logged in user",
+		})
+	}
+
+	var a struct {
+		Password string
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		return httpStatus{http.StatusBadRequest, nil, "Could not decode request body", err}
+	}
+
+	if _, err := e.db.FindUser(c.User.Email, a.Password); err != nil {
+		failedLogin(e, c.User.Email)
+		return httpStatus{http.StatusForbidden, nil, "Incorrect password", err}
+	}
+
+	user, err := softDelete(e, c.User.Email)
+
+	if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "", err}
+	}
+
+	if err := audit(e, c, "user.delete", c.User.Email, nil); err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "", err}
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: "jwt", Value: "", MaxAge: -1})
+	return deletedResult(user)
+}
+
+// restore restores a deleted user during the grace period, and logs them in
+func restore(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStatus {
+	if r.Method != http.MethodPost {
+		return httpStatus{http.StatusNotFound, nil, http.StatusText(http.StatusNotFound), nil}
+	}
+
+	var a struct {
+		Email    string
+		Password string
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		return httpStatus{http.StatusBadRequest, nil, "Could not decode request body", err}
+	}
+	a.Email = database.NormalizeEmail(a.Email)
+
+	if e.ssoEnforced(a.Email) {
+		return httpStatus{http.StatusForbidden, nil, "Accounts of single sign-on domains are restored by an admin", nil}
+	}
+
+	if u, err := e.db.GetUser(a.Email); err == nil && u.Locked() {
+		return httpStatus{http.StatusForbidden, nil, "Too many failed logins, try again later", nil}
+	}
+
+	user, err := e.db.FindUser(a.Email, a.Password)
+
+	if err != nil {
+		failedLogin(e, a.Email)
+		return httpStatus{http.StatusUnauthorized, nil, err.Error(), err}
+	}
+
+	if !user.Deleted() || user.Disabled {
+		return httpStatus{http.StatusBadRequest, nil, "Account can't be restored", nil}
+	}
+
+	user, err = e.db.UpdateUser(user.Email, func(u *database.User) error {
+		u.DeletedAt = time.Time{}
+		return nil
+	})
+
+	if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "", err}
+	}
+
+	if err := startSession(e, c, user); err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "", err}
+	}
+	recordLogin(e, r, user.Email, true, c.Session)
+
+	if err := audit(e, c, "user.restore", user.Email, nil); err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "", err}
+	}
+
+	res, err := json.Marshal(result{"success", user})
+
+	if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "Error marshalling results", err}
+	}
+
+	return httpStatus{http.StatusOK, res, "", nil}
+}
+
+// cleanup removes the expired records of a feature
+type cleanup struct {
+	name string
+	run  func(e *Env) error
+}
+
+// cleanups are run every PURGE_INTERVAL
+var cleanups = []cleanup{
+	{"users", purgeDeletedUsers},
+	{"exports", deleteExpiredExports},
+	{"idempotent requests", deleteExpiredIdempotentRequests},
+	{"rate limits", sweepRateLimits},
+	{"SAML assertions", deleteExpiredAssertions},
+}
+
+// purgeDeleted runs the cleanups every interval
+func purgeDeleted(e *Env, interval time.Duration) {
+	for range time.Tick(interval) {
+		purgeExpired(e)
+	}
+}
+
+// purgeExpired runs every cleanup, logging the errors of those that fail
+// and carrying on with the others
+func purgeExpired(e *Env) {
+	for _, c := range cleanups {
+		if err := c.run(e); err != nil {
+			e.l.LogError(fmt.Errorf("Cleaning up %s: %v", c.name, err), "")
+		}
+	}
+}
+
+// purgeDeletedUsers purges the users whose grace period is over
+func purgeDeletedUsers(e *Env) error {
+	users, _, err := e.db.ListUsers("", 0, 0)
+	if err != nil {
+		return err
+	}
+
+	for _, u := range users {
+		if !u.Deleted() || time.Now().Sub(u.DeletedAt) < gracePeriod() {
+			continue
+		}
+		if err := purge(e, "system", u.Email); err != nil {
+			e.l.LogError(err, u.Email)
+		}
+	}
+	return nil
+}
+
+// purge deletes every record of the user for good
+func purge(e *Env, actor, email string) error {
+	if err := e.db.DeleteUser(email); err != nil {
+		return err
+	}
+	e.streams.revoke(email, nil)
+	return e.db.AddAuditEvent(database.NewAuditEvent(xid.New().String(), actor, "user.purge", email, nil))
+}
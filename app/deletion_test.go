@@ -0,0 +1,80 @@
+package app
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"secure/database"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccountDeletion(t *testing.T) {
+	email := uniuri.New() + "@me.com"
+	payload := `{"email":"` + email + `","password":"secret123"}`
+	signup, _ := http.NewRequest("POST", "/signup", bytes.NewBufferString(payload))
+	cookie := executeRequest(signup).Result().Cookies()[0]
+
+	me := func(cookie *http.Cookie, method, body string) int {
+		req, _ := http.NewRequest(method, "/me", strings.NewReader(body))
+		req.AddCookie(cookie)
+		return executeRequest(req).Code
+	}
+
+	assert.Equal(t, http.StatusForbidden, me(cookie, "DELETE", `{"password":"wrong"}`))
+	assert.Equal(t, http.StatusOK, me(cookie, "DELETE", `{"password":"secret123"}`))
+	assert.Equal(t, http.StatusUnauthorized, me(cookie, "GET", ""), "Deleted users should be logged out")
+
+	login, _ := http.NewRequest("POST", "/login", bytes.NewBufferString(payload))
+	assert.Equal(t, http.StatusForbidden, executeRequest(login).Code, "Deleted users can't log in")
+
+	restore, _ := http.NewRequest("POST", "/restore", bytes.NewBufferString(payload))
+	response := executeRequest(restore)
+	assert.Equal(t, http.StatusOK, response.Code, "Response should be 200")
+	assert.Equal(t, http.StatusOK, me(response.Result().Cookies()[0], "GET", ""), "Restored users should be logged in")
+
+	_, err := softDelete(testEnv, email)
+	assert.NoError(t, err)
+
+	purgeExpired(testEnv)
+	_, err = testEnv.db.GetUser(email)
+	assert.NoError(t, err, "Users should be kept during the grace period")
+
+	os.Setenv("DELETION_GRACE_PERIOD", "0s")
+	defer os.Unsetenv("DELETION_GRACE_PERIOD")
+	purgeExpired(testEnv)
+	_, err = testEnv.db.GetUser(email)
+	assert.Error(t, err, "Users should be purged after the grace period")
+}
+
+func TestRecordsOfUnknownUsers(t *testing.T) {
+	email, _ := signupUser()
+
+	login := func(email string) error {
+		return testEnv.db.AddEmailLogin(&database.EmailLogin{ID: uniuri.New(), Email: email, ExpiresAt: time.Now().Add(time.Minute)})
+	}
+
+	assert.NoError(t, login(email))
+	assert.Error(t, login(uniuri.New()+"@me.com"), "Records of unknown users should not get a key")
+}
+
+func TestDeletionOfPrefixedEmails(t *testing.T) {
+	email, _ := signupUser()
+	prefixed := email + ":" + strings.ToLower(uniuri.New())
+	signup, _ := http.NewRequest("POST", "/signup", bytes.NewBufferString(`{"email":"`+prefixed+`","password":"secret123"}`))
+	assert.Equal(t, http.StatusOK, executeRequest(signup).Code, "Response should be 200")
+
+	assert.NoError(t, testEnv.db.DeleteUser(prefixed))
+
+	logins, err := testEnv.db.LoginEvents(email)
+	assert.NoError(t, err)
+	assert.Len(t, logins, 1, "Users whose email is the prefix of another's should keep their login history")
+	_, err = testEnv.db.GetUser(email)
+	assert.NoError(t, err, "Users whose email is the prefix of another's should keep their key")
+	_, _, err = testEnv.db.ListUsers("", 0, 0)
+	assert.NoError(t, err)
+}
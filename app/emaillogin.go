@@ -0,0 +1,181 @@
+package app
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"secure/database"
+	"time"
+)
+
+// emailLoginLifetime is how long a login link or code works for
+const emailLoginLifetime = 10 * time.Minute
+
+// emailLoginAttempts is how many wrong links or codes an email login takes
+// before it is cancelled
+const emailLoginAttempts = 5
+
+// randomCode returns a random 6 digit code
+func randomCode() string {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%06d", n)
+}
+
+// emailLogin emails a single use login link and code to the user with POST
+// /login/email. The login is bound to the browser with a cookie, and the
+// answer is the same whether the user exists or not.
+func emailLogin(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStatus {
+	if r.Method != http.MethodPost {
+		return httpStatus{http.StatusNotFound, nil, http.StatusText(http.StatusNotFound), nil}
+	}
+
+	var a struct {
+		Email string
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		return httpStatus{http.StatusBadRequest, nil, "Could not decode request body", err}
+	}
+	a.Email = database.NormalizeEmail(a.Email)
+
+	if a.Email == "" {
+		return httpStatus{http.StatusBadRequest, nil, "Please supply an email", nil}
+	}
+
+	if p := e.ssoConnection(a.Email); p != nil && p.Enforce {
+		return ssoRedirect(r, p, a.Email)
+	}
+
+	secret, token, code := randomToken(32), randomToken(32), randomCode()
+
+	// the email is sent in the background, so that the answer takes as long
+	// whether the user exists or not
+	base := issuer()
+	go func() {
+		if err := sendEmailLogin(e, base, a.Email, secret, token, code); err != nil {
+			e.l.LogError(err, a.Email)
+		}
+	}()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "email_login",
+		Value:    secret,
+		Path:     "/login/email",
+		MaxAge:   int(emailLoginLifetime.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	w.WriteHeader(http.StatusAccepted)
+	return httpStatus{http.StatusAccepted, []byte(`{"status":"success"}`), "", nil}
+}
+
+// sendEmailLogin emails the login code to the user, when they can log in,
+// and a link when ISSUER is set
+func sendEmailLogin(e *Env, base, email, secret, token, code string) error {
+	user, err := e.db.GetUser(email)
+	if err != nil || user.Disabled || user.Deleted() || user.Locked() {
+		return nil
+	}
+
+	// the code is hashed with the secret of the browser, so that the few
+	// possible codes can't be tried against the stored hash
+	err = e.db.AddEmailLogin(&database.EmailLogin{
+		ID:        hashToken(secret),
+		Email:     user.Email,
+		TokenHash: hashToken(token),
+		CodeHash:  hashToken(secret + code),
+		ExpiresAt: time.Now().Add(emailLoginLifetime),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	body := "Log in by entering the code " + code + " in the browser you asked for it in\n\n"
+	if base != "" {
+		link := base + "/login/email/verify?" + url.Values{"token": {token}}.Encode()
+		body = "Log in by opening this link in the browser you asked for it in\n" + link + "\n\n" +
+			"or by entering the code " + code + "\n\n"
+	}
+	body += "It works once, for the next " + emailLoginLifetime.String() + ". If you didn't ask to log in, you can ignore this email.\n"
+
+	return e.mail.Send(user.Email, "Your login code is "+code, body)
+}
+
+// verifyEmailLogin logs the user in with the link, GET
+// /login/email/verify?token=, or the code, POST /login/email/verify, they
+// were emailed
+func verifyEmailLogin(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStatus {
+	cookie, err := r.Cookie("email_login")
+	if err != nil {
+		return httpStatus{http.StatusBadRequest, nil, "Log in in the browser you asked for the email in", nil}
+	}
+
+	// the attempt is counted before the code is checked, so that no more
+	// than emailLoginAttempts are checked even in parallel
+	l, err := e.db.AttemptEmailLogin(hashToken(cookie.Value), emailLoginAttempts)
+	if err != nil {
+		return httpStatus{http.StatusUnauthorized, nil, "Invalid or expired login", nil}
+	}
+
+	var ok bool
+	switch r.Method {
+	case http.MethodGet:
+		ok = subtle.ConstantTimeCompare([]byte(hashToken(r.URL.Query().Get("token"))), []byte(l.TokenHash)) == 1
+	case http.MethodPost:
+		var a struct {
+			Code string
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+			return httpStatus{http.StatusBadRequest, nil, "Could not decode request body", err}
+		}
+		ok = subtle.ConstantTimeCompare([]byte(hashToken(cookie.Value+a.Code)), []byte(l.CodeHash)) == 1
+	default:
+		return httpStatus{http.StatusNotFound, nil, http.StatusText(http.StatusNotFound), nil}
+	}
+
+	if !ok {
+		recordLogin(e, r, l.Email, false, 0)
+		return httpStatus{http.StatusUnauthorized, nil, "Invalid login link or code", nil}
+	}
+
+	// taking the login makes sure only one of concurrent requests uses it
+	if err := e.db.TakeEmailLogin(l.ID); err != nil {
+		return httpStatus{http.StatusUnauthorized, nil, "Invalid or expired login", nil}
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: "email_login", Value: "", Path: "/login/email", MaxAge: -1})
+
+	user, err := e.db.GetUser(l.Email)
+
+	if err != nil {
+		return httpStatus{http.StatusUnauthorized, nil, "Invalid or expired login", err}
+	}
+
+	if user.Disabled || user.Deleted() {
+		return httpStatus{http.StatusForbidden, nil, "Account disabled", nil}
+	}
+
+	if err := startSession(e, c, user); err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "", err}
+	}
+	recordLogin(e, r, user.Email, true, c.Session)
+
+	res, err := json.Marshal(result{"success", user})
+
+	if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "Error marshalling results", err}
+	}
+
+	return httpStatus{http.StatusOK, res, "", nil}
+}
@@ -0,0 +1,130 @@
+package app
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dchest/uniuri"
+	"github.com/stretchr/testify/assert"
+)
+
+var emailLoginCode = regexp.MustCompile(`code (\d{6})`)
+
+// startEmailLogin asks for a login email and returns the browser cookie, the
+// code and the link that were sent
+func startEmailLogin(t *testing.T, email string) (*http.Cookie, string, *url.URL) {
+	os.Setenv("ISSUER", "https://auth.example.com")
+	defer os.Unsetenv("ISSUER")
+
+	previous := testMail.last(email)
+	req, _ := http.NewRequest("POST", "/login/email", bytes.NewBufferString(`{"email":"`+email+`"}`))
+	response := executeRequest(req)
+	assert.Equal(t, http.StatusAccepted, response.Code, "Response should be 202")
+
+	cookies := response.Result().Cookies()
+	assert.Equal(t, "email_login", cookies[0].Name)
+
+	body := testMail.next(email, previous)
+	code := emailLoginCode.FindStringSubmatch(body)
+	assert.Len(t, code, 2, "The email should have a code")
+	link, err := url.Parse(body[strings.Index(body, "http"):strings.Index(body, "\n\nor")])
+	assert.NoError(t, err)
+
+	return cookies[0], code[1], link
+}
+
+func verifyEmailCode(cookie *http.Cookie, code string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", "/login/email/verify", bytes.NewBufferString(`{"code":"`+code+`"}`))
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	return executeRequest(req)
+}
+
+func TestEmailLoginWithCode(t *testing.T) {
+	email, _ := signupUser()
+
+	cookie, code, _ := startEmailLogin(t, email)
+
+	response := verifyEmailCode(nil, code)
+	assert.Equal(t, http.StatusBadRequest, response.Code, "Codes only work in the browser that asked for them")
+
+	response = verifyEmailCode(cookie, code)
+	assert.Equal(t, http.StatusOK, response.Code, "Response should be 200")
+	assert.Equal(t, "jwt", response.Result().Cookies()[len(response.Result().Cookies())-1].Name, "Logging in should set the jwt cookie")
+
+	response = verifyEmailCode(cookie, code)
+	assert.Equal(t, http.StatusUnauthorized, response.Code, "Codes can only be used once")
+
+	cookie, code, _ = startEmailLogin(t, email)
+	wrong := "000000"
+	if code == wrong {
+		wrong = "111111"
+	}
+	for i := 0; i < emailLoginAttempts; i++ {
+		assert.Equal(t, http.StatusUnauthorized, verifyEmailCode(cookie, wrong).Code)
+	}
+	response = verifyEmailCode(cookie, code)
+	assert.Equal(t, http.StatusUnauthorized, response.Code, "Logins are cancelled after too many wrong codes")
+}
+
+func TestEmailLoginParallelCodes(t *testing.T) {
+	email, _ := signupUser()
+
+	cookie, code, _ := startEmailLogin(t, email)
+	wrong := "000000"
+	if code == wrong {
+		wrong = "111111"
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8*emailLoginAttempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			verifyEmailCode(cookie, wrong)
+		}()
+	}
+	wg.Wait()
+
+	response := verifyEmailCode(cookie, code)
+	assert.Equal(t, http.StatusUnauthorized, response.Code, "Wrong codes sent in parallel should count against the limit")
+}
+
+func TestEmailLoginWithLink(t *testing.T) {
+	email, _ := signupUser()
+
+	cookie, _, link := startEmailLogin(t, email)
+	assert.Equal(t, "/login/email/verify", link.Path)
+
+	req, _ := http.NewRequest("GET", link.RequestURI(), nil)
+	response := executeRequest(req)
+	assert.Equal(t, http.StatusBadRequest, response.Code, "Links only work in the browser that asked for them")
+
+	req, _ = http.NewRequest("GET", "/login/email/verify?token="+uniuri.New(), nil)
+	req.AddCookie(cookie)
+	response = executeRequest(req)
+	assert.Equal(t, http.StatusUnauthorized, response.Code, "Invalid links should not log in")
+
+	req, _ = http.NewRequest("GET", link.RequestURI(), nil)
+	req.AddCookie(cookie)
+	response = executeRequest(req)
+	assert.Equal(t, http.StatusOK, response.Code, "Response should be 200")
+	assert.Contains(t, response.Body.String(), email)
+}
+
+func TestEmailLoginUnknownUser(t *testing.T) {
+	email := uniuri.New() + "@me.com"
+
+	req, _ := http.NewRequest("POST", "/login/email", bytes.NewBufferString(`{"email":"`+email+`"}`))
+	response := executeRequest(req)
+	assert.Equal(t, http.StatusAccepted, response.Code, "Unknown users should not be revealed")
+	assert.Empty(t, testMail.next(email, ""))
+}
@@ -0,0 +1,254 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"secure/database"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/rs/xid"
+)
+
+// exportLifetime is how long a built export is kept for
+const exportLifetime = 24 * time.Hour
+
+// exportLinkLifetime is how long a download link of an export works for
+const exportLinkLifetime = time.Hour
+
+// archive is everything held about a user. There are no MFA enrollments
+// until MFA is supported, but the section is kept so the format is stable.
+type archive struct {
+	GeneratedAt    time.Time              `json:"generated_at"`
+	User           *database.User         `json:"user"`
+	Memberships    []*database.Membership `json:"memberships"`
+	Identities     []*database.Identity   `json:"identities"`
+	Sessions       []*database.LoginEvent `json:"sessions"`
+	LoginHistory   []*database.LoginEvent `json:"login_history"`
+	APIKeys        []*database.APIKey     `json:"api_keys"`
+	MFAEnrollments []interface{}          `json:"mfa_enrollments"`
+	Audit          []*database.AuditEvent `json:"audit"`
+}
+
+// exportMe starts an export of the logged in user with POST /me/export,
+// lists their exports with GET /me/export, and shows one, with a download
+// link once it is ready, with GET /me/export/<id>
+func exportMe(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStatus {
+	if c.Principal != principalUser {
+		return forbidden(w, forbiddenReason{
+			Code:      "user_session_required",
+			Principal: c.Principal,
+			Message:   "Exports can only be requested by a logged in user",
+		})
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/me/export"), "/")
+
+	switch {
+	case r.Method == http.MethodPost && id == "":
+		return startExport(e, w, c)
+	case r.Method == http.MethodGet && id == "":
+		exports, err := e.db.Exports(c.User.Email)
+
+		if err != nil {
+			return httpStatus{http.StatusInternalServerError, nil, "", err}
+		}
+
+		res, err := json.Marshal(results{"success", exports})
+
+		if err != nil {
+			return httpStatus{http.StatusInternalServerError, nil, "Error marshalling results", err}
+		}
+
+		return httpStatus{http.StatusOK, res, "", nil}
+	case r.Method == http.MethodGet:
+		x, err := e.db.GetExport(id)
+
+		if err != nil || x.Email != c.User.Email {
+			return httpStatus{http.StatusNotFound, nil, http.StatusText(http.StatusNotFound), err}
+		}
+
+		return exportStatus(e, w, r, x)
+	}
+	return httpStatus{http.StatusNotFound, nil, http.StatusText(http.StatusNotFound), nil}
+}
+
+// startExport builds an export in the background. A pending export is
+// returned instead of starting another.
+func startExport(e *Env, w http.ResponseWriter, c *context) httpStatus {
+	exports, err := e.db.Exports(c.User.Email)
+
+	if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "", err}
+	}
+
+	var x *database.Export
+	for _, pending := range exports {
+		if pending.Status == database.ExportPending {
+			x = pending
+		}
+	}
+
+	if x == nil {
+		x = database.NewExport(xid.New().String(), c.User.Email, time.Now().Add(exportLifetime))
+
+		if err := e.db.AddExport(x); err != nil {
+			return httpStatus{http.StatusInternalServerError, nil, "", err}
+		}
+
+		go buildExport(e, x)
+	}
+
+	res, err := json.Marshal(result{"success", x})
+
+	if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "Error marshalling results", err}
+	}
+
+	w.Header().Set("Location", "/me/export/"+x.ID)
+	w.WriteHeader(http.StatusAccepted)
+	return httpStatus{http.StatusAccepted, res, "", nil}
+}
+
+func buildExport(e *Env, x *database.Export) {
+	a, err := collectArchive(e, x.Email)
+	if err == nil {
+		x.Archive, err = json.Marshal(a)
+	}
+
+	x.Status = database.ExportReady
+	if err != nil {
+		e.l.LogError(err, x.Email)
+		x.Status, x.Archive = database.ExportFailed, nil
+	}
+
+	if err := e.db.UpdateExport(x); err != nil {
+		e.l.LogError(err, x.Email)
+	}
+}
+
+func collectArchive(e *Env, email string) (*archive, error) {
+	a := archive{GeneratedAt: time.Now(), MFAEnrollments: []interface{}{}}
+	var err error
+
+	if a.User, err = e.db.GetUser(email); err != nil {
+		return nil, err
+	}
+
+	if a.Memberships, err = e.db.Memberships(email); err != nil {
+		return nil, err
+	}
+
+	if a.Identities, err = e.db.Identities(email); err != nil {
+		return nil, err
+	}
+
+	if a.LoginHistory, err = e.db.LoginEvents(email); err != nil {
+		return nil, err
+	}
+
+	// the sessions are the logins whose tokens are still valid
+	a.Sessions = []*database.LoginEvent{}
+	for _, l := range a.LoginHistory {
+		if l.Success && l.Session == a.User.SessionVersion && time.Now().Sub(l.CreatedAt) < tokenLifetime {
+			a.Sessions = append(a.Sessions, l)
+		}
+	}
+
+	if a.APIKeys, err = e.db.APIKeys(email); err != nil {
+		return nil, err
+	}
+	for _, k := range a.APIKeys {
+		k.SecretHash = nil
+	}
+
+	events, err := e.db.AuditEvents("")
+	if err != nil {
+		return nil, err
+	}
+	a.Audit = []*database.AuditEvent{}
+	for _, event := range events {
+		if event.Target == email || event.Actor == email {
+			a.Audit = append(a.Audit, event)
+		}
+	}
+
+	return &a, nil
+}
+
+// exportStatus shows an export, with a signed link to download it once it
+// is ready
+func exportStatus(e *Env, w http.ResponseWriter, r *http.Request, x *database.Export) httpStatus {
+	var link string
+	if x.Status == database.ExportReady {
+		ss, err := e.keys.signWithType(&jwt.StandardClaims{
+			Subject:   x.ID,
+			Audience:  "export",
+			ExpiresAt: time.Now().Add(exportLinkLifetime).Unix(),
+		}, "export+jwt")
+
+		if err != nil {
+			return httpStatus{http.StatusInternalServerError, nil, "", err}
+		}
+
+		link = issuer() + "/exports/" + x.ID + "?" + url.Values{"token": {ss}}.Encode()
+	}
+
+	x.Archive = nil
+	res, err := json.Marshal(result{"success", struct {
+		*database.Export
+		DownloadURL string `json:"download_url,omitempty"`
+	}{x, link}})
+
+	if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "Error marshalling results", err}
+	}
+
+	return httpStatus{http.StatusOK, res, "", nil}
+}
+
+// downloadExport serves the archive of an export to a signed link
+func downloadExport(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStatus {
+	if r.Method != http.MethodGet {
+		return httpStatus{http.StatusNotFound, nil, http.StatusText(http.StatusNotFound), nil}
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/exports/")
+
+	var claims jwt.StandardClaims
+	token, err := jwt.ParseWithClaims(r.URL.Query().Get("token"), &claims, e.keys.verificationKey)
+
+	if err != nil || !token.Valid || token.Header["typ"] != "export+jwt" || claims.Audience != "export" || claims.Subject != id {
+		return httpStatus{http.StatusForbidden, nil, "Invalid or expired download link", err}
+	}
+
+	x, err := e.db.GetExport(id)
+
+	if err != nil || x.Status != database.ExportReady || x.ExpiresAt.Before(time.Now()) {
+		return httpStatus{http.StatusNotFound, nil, http.StatusText(http.StatusNotFound), err}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="export-`+x.ID+`.json"`)
+	w.Header().Set("Cache-Control", "no-store")
+	return httpStatus{http.StatusOK, x.Archive, "", nil}
+}
+
+// deleteExpiredExports deletes the exports past their expiry
+func deleteExpiredExports(e *Env) error {
+	exports, err := e.db.Exports("")
+	if err != nil {
+		return err
+	}
+
+	for _, x := range exports {
+		if x.ExpiresAt.Before(time.Now()) {
+			if err := e.db.DeleteExport(x.ID); err != nil {
+				e.l.LogError(err, x.Email)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExport(t *testing.T) {
+	email := strings.ToLower(uniuri.New()) + "@me.com"
+	payload := `{"email":"` + email + `","password":"secret123"}`
+	signup, _ := http.NewRequest("POST", "/signup", bytes.NewBufferString(payload))
+	cookie := executeRequest(signup).Result().Cookies()[0]
+
+	create, _ := http.NewRequest("POST", "/apikeys", bytes.NewBufferString(`{"name":"ci"}`))
+	create.AddCookie(cookie)
+	executeRequest(create)
+
+	start, _ := http.NewRequest("POST", "/me/export", strings.NewReader(""))
+	start.AddCookie(cookie)
+	response := executeRequest(start)
+	assert.Equal(t, http.StatusAccepted, response.Code, "Response should be 202")
+
+	var export struct {
+		Result struct {
+			ID          string `json:"id"`
+			Status      string `json:"status"`
+			DownloadURL string `json:"download_url"`
+		} `json:"result"`
+	}
+	for i := 0; i < 100 && export.Result.Status != "ready"; i++ {
+		time.Sleep(10 * time.Millisecond)
+		status, _ := http.NewRequest("GET", response.Header().Get("Location"), nil)
+		status.AddCookie(cookie)
+		assert.NoError(t, json.Unmarshal(executeRequest(status).Body.Bytes(), &export))
+	}
+	assert.Equal(t, "ready", export.Result.Status)
+
+	link, _ := url.Parse(export.Result.DownloadURL)
+	download, _ := http.NewRequest("GET", link.RequestURI(), nil)
+	response = executeRequest(download)
+	assert.Equal(t, http.StatusOK, response.Code, "Response should be 200")
+
+	body := response.Body.String()
+	assert.Contains(t, body, `"email":"`+email+`"`)
+	assert.Contains(t, body, `"name":"ci"`)
+	assert.Contains(t, body, `"login_history":[{`)
+	assert.NotContains(t, body, "secret_hash")
+	assert.NotContains(t, body, "PasswordSalt")
+
+	tampered, _ := http.NewRequest("GET", "/exports/"+uniuri.New()+"?"+link.RawQuery, nil)
+	assert.Equal(t, http.StatusForbidden, executeRequest(tampered).Code, "Links only work for their export")
+}
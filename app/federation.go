@@ -0,0 +1,655 @@
+package app
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"secure/database"
+	"secure/jwk"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// loginStateLifetime is how long a user has to log in at a provider
+const loginStateLifetime = 10 * time.Minute
+
+var (
+	errEmailNotVerified = errors.New("The identity provider has not verified the email")
+	errEmailDomain      = errors.New("The identity provider can't log in users of this email domain")
+	errInvalidIDToken   = errors.New("Invalid ID token")
+)
+
+// upstreamClient makes the requests to upstream identity providers
+var upstreamClient = &http.Client{Timeout: 10 * time.Second}
+
+// provider is an upstream OpenID Connect, plain OAuth2 or SAML 2.0 identity
+// provider that users can log in with. OpenID Connect providers only need an
+// issuer, their endpoints are discovered. OAuth2 providers, such as GitHub,
+// have the user fetched from their userinfo endpoint, and optionally their
+// verified emails from an emails endpoint. SAML providers have their entity
+// ID as issuer.
+type provider struct {
+	Name                  string   `json:"name"`
+	Type                  string   `json:"type"`
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	UserinfoEndpoint      string   `json:"userinfo_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	EmailsEndpoint        string   `json:"emails_endpoint"`
+	ClientID              string   `json:"client_id"`
+	ClientSecret          string   `json:"client_secret"`
+	Scopes                []string `json:"scopes"`
+	RedirectURL           string   `json:"redirect_url"`
+	// TrustEmail treats the email of an OAuth2 provider that doesn't say if
+	// it is verified as verified
+	TrustEmail bool `json:"trust_email"`
+	// Domains make the provider the SSO connection of the email domains. It
+	// is trusted to assert emails of these domains, and only of these.
+	Domains []string `json:"domains"`
+	// Enforce disables local passwords for the domains
+	Enforce bool `json:"enforce"`
+	// Users provisioned through an SSO connection are made members of OrgID
+	// with OrgRole, member by default
+	OrgID   string `json:"org_id"`
+	OrgRole string `json:"org_role"`
+
+	// SAML providers log users in at SSOURL, and sign their assertions with
+	// one of the PEM encoded Certificates. EntityID is the entity ID of this
+	// service, by default the URL of its metadata. Attributes map the user
+	// fields email, first_name and last_name to the names of the attributes
+	// they are in.
+	SSOURL       string            `json:"sso_url"`
+	Certificates []string          `json:"certificates"`
+	EntityID     string            `json:"entity_id"`
+	Attributes   map[string]string `json:"attributes"`
+	// IdPInitiated accepts logins started at the provider, which aren't
+	// bound to the browser of the user
+	IdPInitiated bool `json:"idp_initiated"`
+
+	mu         sync.Mutex
+	discovered bool
+	keys       jwk.Set
+	certs      []*x509.Certificate
+}
+
+// parseProviders parses the IDENTITY_PROVIDERS_FILE
+func parseProviders(b []byte) (map[string]*provider, error) {
+	var config struct {
+		Providers []*provider `json:"providers"`
+	}
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, err
+	}
+
+	providers := map[string]*provider{}
+	for i, p := range config.Providers {
+		// /login/email is the passwordless login
+		if p.Name == "" || p.Name == "email" || strings.Contains(p.Name, "/") {
+			return nil, fmt.Errorf("Identity provider %d needs a valid name", i)
+		}
+		if p.ClientID == "" && p.Type != "saml" {
+			return nil, fmt.Errorf("Identity provider %s needs a client_id", p.Name)
+		}
+
+		switch p.Type {
+		case "oidc":
+			if p.Issuer == "" {
+				return nil, fmt.Errorf("Identity provider %s needs an issuer", p.Name)
+			}
+			if len(p.Scopes) == 0 {
+				p.Scopes = []string{"openid", "email", "profile"}
+			}
+		case "oauth2":
+			if p.AuthorizationEndpoint == "" || p.TokenEndpoint == "" || p.UserinfoEndpoint == "" {
+				return nil, fmt.Errorf("Identity provider %s needs its endpoints", p.Name)
+			}
+		case "saml":
+			if err := p.parseSAML(); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("Invalid type %s for identity provider %s", p.Type, p.Name)
+		}
+
+		if p.OrgRole == "" {
+			p.OrgRole = database.OrgMember
+		}
+		if !database.ValidOrgRole(p.OrgRole) {
+			return nil, fmt.Errorf("Invalid org_role %s for identity provider %s", p.OrgRole, p.Name)
+		}
+
+		providers[p.Name] = p
+	}
+
+	return providers, nil
+}
+
+// emailDomain returns the lowercased domain of the email
+func emailDomain(email string) string {
+	return strings.ToLower(email[strings.LastIndex(email, "@")+1:])
+}
+
+// ssoConnection returns the provider that is the SSO connection of the
+// domain of the email, if there is one
+func (e *Env) ssoConnection(email string) *provider {
+	if !strings.Contains(email, "@") {
+		return nil
+	}
+
+	domain := emailDomain(email)
+	for _, p := range e.providers {
+		if containsFold(p.Domains, domain) {
+			return p
+		}
+	}
+	return nil
+}
+
+// ssoEnforced checks if the user has to log in through the SSO connection of
+// their domain
+func (e *Env) ssoEnforced(email string) bool {
+	p := e.ssoConnection(email)
+	return p != nil && p.Enforce
+}
+
+// ssoRedirect is the answer of home realm discovery: the user is sent to log
+// in at the SSO connection of their domain
+func ssoRedirect(r *http.Request, p *provider, email string) httpStatus {
+	q := url.Values{"login_hint": {email}}
+	if returnTo := r.URL.Query().Get("return_to"); returnTo != "" {
+		q.Set("return_to", safeReturnTo(returnTo))
+	}
+
+	res, err := json.Marshal(struct {
+		Status string      `json:"status"`
+		Result interface{} `json:"result"`
+	}{"redirect", struct {
+		Connection  string `json:"connection"`
+		RedirectURL string `json:"redirect_url"`
+	}{p.Name, issuer() + "/login/" + p.Name + "?" + q.Encode()}})
+
+	if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "Error marshalling results", err}
+	}
+
+	return httpStatus{http.StatusOK, res, "", nil}
+}
+
+// getJSON fetches a JSON document from a provider
+func getJSON(uri, accessToken string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, uri, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+
+	res, err := upstreamClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", uri, res.Status)
+	}
+
+	return json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(v)
+}
+
+// discover fills in the endpoints of an OpenID Connect provider from its
+// discovery document, the first time it is used
+func (p *provider) discover() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovered || p.Type != "oidc" {
+		return nil
+	}
+
+	var doc struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		UserinfoEndpoint      string `json:"userinfo_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	if err := getJSON(strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", "", &doc); err != nil {
+		return err
+	}
+
+	if doc.Issuer != p.Issuer {
+		return fmt.Errorf("Identity provider %s has issuer %s", p.Name, doc.Issuer)
+	}
+
+	if p.AuthorizationEndpoint == "" {
+		p.AuthorizationEndpoint = doc.AuthorizationEndpoint
+	}
+	if p.TokenEndpoint == "" {
+		p.TokenEndpoint = doc.TokenEndpoint
+	}
+	if p.UserinfoEndpoint == "" {
+		p.UserinfoEndpoint = doc.UserinfoEndpoint
+	}
+	if p.JWKSURI == "" {
+		p.JWKSURI = doc.JWKSURI
+	}
+	p.discovered = true
+	return nil
+}
+
+// verificationKey is the jwt.Keyfunc for ID tokens of the provider. The key
+// set is fetched again when a token is signed by a key that isn't in it, as
+// the provider may have rotated its keys.
+func (p *provider) verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key, ok := p.keys.Key(kid)
+	if !ok {
+		var keys jwk.Set
+		if err := getJSON(p.JWKSURI, "", &keys); err != nil {
+			return nil, err
+		}
+		p.keys = keys
+		if key, ok = p.keys.Key(kid); !ok {
+			return nil, errUnknownKey
+		}
+	}
+
+	if key.Alg != "" && key.Alg != token.Method.Alg() {
+		return nil, errKeyAlgorithm
+	}
+
+	// the key is typed, so tokens can't switch to an HMAC algorithm
+	return key.PublicKey()
+}
+
+// redirectURL is where the provider sends users back to, the assertion
+// consumer service of SAML providers
+func (p *provider) redirectURL() string {
+	if p.RedirectURL != "" {
+		return p.RedirectURL
+	}
+	if p.Type == "saml" {
+		return issuer() + "/saml/" + p.Name + "/acs"
+	}
+	return issuer() + "/login/" + p.Name + "/callback"
+}
+
+// upstreamIdentity is who the user is at a provider
+type upstreamIdentity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	GivenName     string
+	FamilyName    string
+}
+
+// federatedLogin sends the user to log in at a provider with
+// /login/<provider>?return_to=<path>, and logs them in here when the
+// provider redirects back to /login/<provider>/callback
+func federatedLogin(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStatus {
+	if r.Method != http.MethodGet {
+		return httpStatus{http.StatusNotFound, nil, http.StatusText(http.StatusNotFound), nil}
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/login/"), "/")
+	p, ok := e.providers[parts[0]]
+
+	switch {
+	case !ok:
+		return httpStatus{http.StatusNotFound, nil, "Unknown identity provider", nil}
+	case len(parts) == 1 && p.Type == "saml":
+		return startSAMLLogin(e, w, r, p)
+	case len(parts) == 1:
+		return startFederatedLogin(e, w, r, p)
+	case len(parts) == 2 && parts[1] == "callback" && p.Type != "saml":
+		return finishFederatedLogin(e, w, r, c, p)
+	}
+	return httpStatus{http.StatusNotFound, nil, http.StatusText(http.StatusNotFound), nil}
+}
+
+// safeReturnTo only lets users be sent back to paths of this service
+func safeReturnTo(returnTo string) string {
+	if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") || strings.HasPrefix(returnTo, "/\\") {
+		return "/"
+	}
+	return returnTo
+}
+
+func startFederatedLogin(e *Env, w http.ResponseWriter, r *http.Request, p *provider) httpStatus {
+	if err := p.discover(); err != nil {
+		return httpStatus{http.StatusBadGateway, nil, "Could not reach the identity provider", err}
+	}
+
+	state, verifier, nonce := randomToken(32), randomToken(32), randomToken(16)
+	err := e.db.AddLoginState(&database.LoginState{
+		ID:        hashToken(state),
+		Provider:  p.Name,
+		Verifier:  verifier,
+		Nonce:     nonce,
+		ReturnTo:  safeReturnTo(r.URL.Query().Get("return_to")),
+		ExpiresAt: time.Now().Add(loginStateLifetime),
+	})
+
+	if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "", err}
+	}
+
+	// the state is bound to the browser that started the login
+	http.SetCookie(w, &http.Cookie{
+		Name:     "login_state",
+		Value:    state,
+		Path:     "/login/",
+		MaxAge:   int(loginStateLifetime.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	challenge := sha256.Sum256([]byte(verifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {p.redirectURL()},
+		"scope":                 {strings.Join(p.Scopes, " ")},
+		"state":                 {state},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	if p.Type == "oidc" {
+		params.Set("nonce", nonce)
+	}
+	if hint := r.URL.Query().Get("login_hint"); hint != "" {
+		params.Set("login_hint", hint)
+	}
+
+	return redirectWith(w, r, p.AuthorizationEndpoint, params)
+}
+
+func finishFederatedLogin(e *Env, w http.ResponseWriter, r *http.Request, c *context, p *provider) httpStatus {
+	q := r.URL.Query()
+	if errCode := q.Get("error"); errCode != "" {
+		return httpStatus{http.StatusUnauthorized, nil, "The identity provider returned " + errCode, nil}
+	}
+
+	invalidState := httpStatus{http.StatusBadRequest, nil, "Invalid or expired login state", nil}
+
+	cookie, err := r.Cookie("login_state")
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(q.Get("state"))) != 1 {
+		return invalidState
+	}
+
+	state, err := e.db.TakeLoginState(hashToken(cookie.Value))
+	if err != nil || state.Provider != p.Name {
+		return invalidState
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: "login_state", Value: "", Path: "/login/", MaxAge: -1})
+
+	if err := p.discover(); err != nil {
+		return httpStatus{http.StatusBadGateway, nil, "Could not reach the identity provider", err}
+	}
+
+	id, err := p.exchange(r, q.Get("code"), state)
+
+	if err == errEmailNotVerified {
+		return httpStatus{http.StatusForbidden, nil, err.Error(), nil}
+	}
+	if err != nil {
+		return httpStatus{http.StatusUnauthorized, nil, "Could not log in with the identity provider", err}
+	}
+
+	return completeFederatedLogin(e, w, r, c, p, id, state.ReturnTo)
+}
+
+// completeFederatedLogin logs in the user the provider says the identity is,
+// and sends them back to where they started
+func completeFederatedLogin(e *Env, w http.ResponseWriter, r *http.Request, c *context, p *provider, id *upstreamIdentity, returnTo string) httpStatus {
+	user, err := federatedUser(e, p, id)
+
+	if err == errEmailNotVerified || err == errEmailDomain {
+		return httpStatus{http.StatusForbidden, nil, err.Error(), nil}
+	}
+	if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "", err}
+	}
+
+	if user.Disabled || user.Deleted() {
+		return httpStatus{http.StatusForbidden, nil, "Account disabled", nil}
+	}
+
+	if err := startSession(e, c, user); err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "", err}
+	}
+	recordLogin(e, r, user.Email, true, c.Session)
+
+	// the cookie has to be set before the redirect is written
+	if err := issueToken(e, w, c); err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "", err}
+	}
+
+	http.Redirect(w, r, returnTo, http.StatusFound)
+	return httpStatus{http.StatusFound, nil, "", nil}
+}
+
+// exchange redeems the code at the token endpoint and finds out who the user
+// is, from the ID token of OpenID Connect providers or the userinfo endpoint
+// of OAuth2 ones
+func (p *provider) exchange(r *http.Request, code string, state *database.LoginState) (*upstreamIdentity, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.redirectURL()},
+		"client_id":     {p.ClientID},
+		"client_secret": {p.ClientSecret},
+		"code_verifier": {state.Verifier},
+	}
+
+	req, err := http.NewRequest(http.MethodPost, p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	res, err := upstreamClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Token endpoint of %s returned %s: %s", p.Name, res.Status, body)
+	}
+
+	var tokens struct {
+		AccessToken string `json:"access_token"`
+		IDToken     string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return nil, err
+	}
+
+	if p.Type == "oidc" {
+		return p.verifyIDToken(tokens.IDToken, state.Nonce)
+	}
+	return p.userinfo(tokens.AccessToken)
+}
+
+func (p *provider) verifyIDToken(idToken, nonce string) (*upstreamIdentity, error) {
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(idToken, claims, p.verificationKey)
+
+	if err != nil || !token.Valid {
+		return nil, errInvalidIDToken
+	}
+
+	if claims["iss"] != p.Issuer || !audienceContains(claims["aud"], p.ClientID) || claims["nonce"] != nonce {
+		return nil, errInvalidIDToken
+	}
+
+	id := upstreamIdentity{}
+	id.Subject, _ = claims["sub"].(string)
+	id.Email, _ = claims["email"].(string)
+	id.GivenName, _ = claims["given_name"].(string)
+	id.FamilyName, _ = claims["family_name"].(string)
+	id.EmailVerified = claims["email_verified"] == true || claims["email_verified"] == "true"
+
+	if id.Subject == "" {
+		return nil, errInvalidIDToken
+	}
+
+	return &id, nil
+}
+
+// audienceContains checks the aud claim, a string or an array, contains the
+// client
+func audienceContains(aud interface{}, clientID string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == clientID
+	case []interface{}:
+		for _, v := range a {
+			if v == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p *provider) userinfo(accessToken string) (*upstreamIdentity, error) {
+	var info map[string]interface{}
+	if err := getJSON(p.UserinfoEndpoint, accessToken, &info); err != nil {
+		return nil, err
+	}
+
+	id := upstreamIdentity{}
+	for _, k := range []string{"sub", "id"} {
+		if v, ok := info[k]; ok && v != nil {
+			id.Subject = fmt.Sprint(v)
+			break
+		}
+	}
+	id.Email, _ = info["email"].(string)
+	id.GivenName, _ = info["given_name"].(string)
+	id.FamilyName, _ = info["family_name"].(string)
+	id.EmailVerified = info["email_verified"] == true || (p.TrustEmail && id.Email != "")
+
+	if p.EmailsEndpoint != "" {
+		var emails []struct {
+			Email    string `json:"email"`
+			Primary  bool   `json:"primary"`
+			Verified bool   `json:"verified"`
+		}
+		if err := getJSON(p.EmailsEndpoint, accessToken, &emails); err != nil {
+			return nil, err
+		}
+		for _, email := range emails {
+			if email.Primary {
+				id.Email, id.EmailVerified = email.Email, email.Verified
+			}
+		}
+	}
+
+	if id.Subject == "" {
+		return nil, errors.New("The identity provider returned no subject")
+	}
+
+	return &id, nil
+}
+
+// federatedUser returns the user linked to the identity. An identity seen for
+// the first time is linked to the user with its email, who is provisioned if
+// they don't exist, as long as the provider has verified the email. SSO
+// connections vouch for the emails of their domains.
+func federatedUser(e *Env, p *provider, id *upstreamIdentity) (*database.User, error) {
+	// users of enforced SSO domains can only log in through their connection
+	otherConnection := func(email string) bool {
+		conn := e.ssoConnection(email)
+		return conn != nil && conn.Enforce && conn != p
+	}
+
+	if linked, err := e.db.GetIdentity(p.Name, id.Subject); err == nil {
+		if otherConnection(linked.Email) {
+			return nil, errEmailDomain
+		}
+		return e.db.GetUser(linked.Email)
+	}
+
+	// providers may give the email in any case, users are stored under one
+	id.Email = database.NormalizeEmail(id.Email)
+
+	if len(p.Domains) > 0 {
+		if !strings.Contains(id.Email, "@") || !containsFold(p.Domains, emailDomain(id.Email)) {
+			return nil, errEmailDomain
+		}
+		id.EmailVerified = true
+	}
+
+	if !id.EmailVerified || id.Email == "" {
+		return nil, errEmailNotVerified
+	}
+
+	if otherConnection(id.Email) {
+		return nil, errEmailDomain
+	}
+
+	user, err := e.db.GetUser(id.Email)
+
+	if err == database.ErrNotFound {
+		// the password is never shown, the user logs in with the provider
+		user, err = database.NewUser(id.Email, randomToken(32))
+		if err != nil {
+			return nil, err
+		}
+
+		if isAdminEmail(user.Email) {
+			user.Roles = []string{"admin"}
+		}
+		user.FirstName, user.LastName = id.GivenName, id.FamilyName
+
+		user, err = e.db.AddUser(user)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := e.db.AddIdentity(database.NewIdentity(p.Name, id.Subject, user.Email)); err != nil {
+		return nil, err
+	}
+
+	if p.OrgID != "" {
+		if _, err := e.db.GetMembership(p.OrgID, user.Email); err != nil {
+			if err := e.db.AddMembership(database.NewMembership(p.OrgID, user.Email, p.OrgRole)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return user, nil
+}
@@ -0,0 +1,151 @@
+package app
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"secure/jwk"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// standInIdP is a minimal OpenID Connect provider that logs in whoever it is
+// told to
+type standInIdP struct {
+	*httptest.Server
+	key   *rsa.PrivateKey
+	codes map[string]url.Values
+	// the user the next authorization is for
+	subject, email string
+	verified       bool
+}
+
+func newStandInIdP(t *testing.T) *standInIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	idp := &standInIdP{key: key, codes: map[string]url.Values{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.URL,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"jwks_uri":               idp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		k, _ := jwk.New("k1", "RS256", &key.PublicKey)
+		json.NewEncoder(w).Encode(jwk.Set{Keys: []jwk.Key{k}})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		q.Set("sub", idp.subject)
+		q.Set("email", idp.email)
+		code := uniuri.New()
+		idp.codes[code] = q
+		http.Redirect(w, r, q.Get("redirect_uri")+"?"+url.Values{"code": {code}, "state": {q.Get("state")}}.Encode(), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		authz, ok := idp.codes[r.PostForm.Get("code")]
+		delete(idp.codes, r.PostForm.Get("code"))
+		challenge := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if !ok || r.PostForm.Get("client_secret") != "secret" || base64.RawURLEncoding.EncodeToString(challenge[:]) != authz.Get("code_challenge") {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"iss":            idp.URL,
+			"aud":            authz.Get("client_id"),
+			"sub":            authz.Get("sub"),
+			"email":          authz.Get("email"),
+			"email_verified": idp.verified,
+			"nonce":          authz.Get("nonce"),
+			"exp":            time.Now().Add(time.Hour).Unix(),
+		})
+		token.Header["kid"] = "k1"
+		ss, _ := token.SignedString(key)
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "at", "id_token": ss})
+	})
+	idp.Server = httptest.NewServer(mux)
+	return idp
+}
+
+// loginThrough starts a login at uri and follows it through the stand-in
+// IdP, returning the response of the callback
+func loginThrough(t *testing.T, uri string) *httptest.ResponseRecorder {
+	start, _ := http.NewRequest("GET", uri, nil)
+	response := executeRequest(start)
+	assert.Equal(t, http.StatusFound, response.Code, "Response should be 302")
+	state := response.Result().Cookies()[0]
+
+	noRedirects := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	res, err := noRedirects.Get(response.Header().Get("Location"))
+	assert.NoError(t, err)
+	callback, _ := url.Parse(res.Header.Get("Location"))
+
+	finish, _ := http.NewRequest("GET", callback.RequestURI(), nil)
+	finish.AddCookie(state)
+	return executeRequest(finish)
+}
+
+func TestFederatedLogin(t *testing.T) {
+	idp := newStandInIdP(t)
+	defer idp.Close()
+
+	providers, err := parseProviders([]byte(`{"providers":[{"name":"idp","type":"oidc","issuer":"` + idp.URL + `","client_id":"app","client_secret":"secret"}]}`))
+	assert.NoError(t, err)
+	testEnv.providers = providers
+	defer func() { testEnv.providers = map[string]*provider{} }()
+
+	loginAs := func(subject, email string, verified bool) *httptest.ResponseRecorder {
+		idp.subject, idp.email, idp.verified = subject, email, verified
+		return loginThrough(t, "/login/idp?return_to=/dashboard")
+	}
+
+	email, _ := signupUser()
+	subject := uniuri.New()
+
+	assert.Equal(t, http.StatusForbidden, loginAs(subject, email, false).Code, "Unverified emails should not be linked")
+
+	// providers may give the email in another case than it was signed up in
+	response := loginAs(subject, strings.ToUpper(email), true)
+	assert.Equal(t, http.StatusFound, response.Code, "Response should be 302")
+	assert.Equal(t, "/dashboard", response.Header().Get("Location"))
+
+	var jwtCookie *http.Cookie
+	for _, c := range response.Result().Cookies() {
+		if c.Name == "jwt" {
+			jwtCookie = c
+		}
+	}
+	assert.NotNil(t, jwtCookie)
+
+	me, _ := http.NewRequest("GET", "/me", strings.NewReader(""))
+	me.AddCookie(jwtCookie)
+	assert.Contains(t, executeRequest(me).Body.String(), `"email":"`+email+`"`, "The identity should be linked to the user")
+
+	assert.Equal(t, http.StatusFound, loginAs(subject, "changed@example.com", false).Code, "Linked identities log in to their user")
+
+	newEmail := uniuri.New() + "@me.com"
+	assert.Equal(t, http.StatusFound, loginAs(uniuri.New(), newEmail, true).Code)
+	_, err = testEnv.db.GetUser(newEmail)
+	assert.NoError(t, err, "Users should be created on their first login")
+
+	replay, _ := http.NewRequest("GET", "/login/idp/callback?code=x&state=y", nil)
+	assert.Equal(t, http.StatusBadRequest, executeRequest(replay).Code, "Callbacks need the state of the browser")
+}
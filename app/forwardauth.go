@@ -0,0 +1,97 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// verifyAuth makes the auth decisions of ingresses that do the proxying
+// themselves, as nginx auth_request and the forward auth of Traefik and
+// Envoy do. The token of the request, and the original method and URI the
+// ingress sends, are checked as the gateway would. Allowed requests get a 200
+// with the identity in X-Forwarded-User and X-Auth-Request-* headers, and
+// the others a 401 or 403. With ?redirect=1 browsers that aren't logged in
+// are sent to LOGIN_URL instead, which Traefik passes on to them.
+func verifyAuth(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStatus {
+	orig := originalRequest(r)
+
+	allow := func(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStatus {
+		fwd, err := json.Marshal(c.forwarded())
+
+		if err != nil {
+			return httpStatus{http.StatusInternalServerError, nil, "Error marshalling results", err}
+		}
+
+		w.Header().Set("X-Forwarded-User", string(fwd))
+		w.Header().Set("X-Auth-Request-User", c.id())
+		if c.User.Email != "" {
+			w.Header().Set("X-Auth-Request-Email", c.User.Email)
+		}
+		if c.Org != "" {
+			w.Header().Set("X-Forwarded-Org", c.Org)
+			w.Header().Set("X-Forwarded-Org-Role", c.OrgRole)
+		}
+		return httpStatus{http.StatusOK, []byte(`{"status":"success"}`), "", nil}
+	}
+
+	status := checkToken(requirePermission(permProxy, Handler{e, enforcePolicy(allow)})).H(e, w, orig, c)
+
+	if status.Code == http.StatusUnauthorized && r.URL.Query().Get("redirect") != "" && strings.Contains(orig.Header.Get("Accept"), "text/html") {
+		if login := os.Getenv("LOGIN_URL"); login != "" {
+			return redirectWith(w, r, login, url.Values{"return_to": {originalURL(orig)}})
+		}
+	}
+	return status
+}
+
+// originalRequest is the request the ingress asks about, from the
+// X-Original-* headers of nginx, the X-Forwarded-* ones of Traefik, or the
+// path under /auth/verify/ and method of Envoy
+func originalRequest(r *http.Request) *http.Request {
+	orig := r.WithContext(r.Context())
+	orig.URL = &url.URL{Path: "/"}
+
+	if method := firstHeader(r, "X-Original-Method", "X-Forwarded-Method"); method != "" {
+		orig.Method = strings.ToUpper(method)
+	}
+
+	uri := firstHeader(r, "X-Original-URI", "X-Forwarded-Uri")
+	if full, err := url.Parse(r.Header.Get("X-Original-URL")); err == nil && full.Host != "" {
+		orig.Host, uri = full.Host, full.RequestURI()
+	}
+	if uri == "" && strings.HasPrefix(r.URL.Path, "/auth/verify/") {
+		uri = strings.TrimPrefix(r.URL.RequestURI(), "/auth/verify")
+	}
+	if u, err := url.ParseRequestURI(uri); err == nil {
+		orig.URL = u
+	}
+
+	if host := r.Header.Get("X-Forwarded-Host"); host != "" {
+		orig.Host = host
+	}
+	return orig
+}
+
+// originalURL is the URL the browser asked the ingress for
+func originalURL(orig *http.Request) string {
+	scheme := orig.Header.Get("X-Forwarded-Proto")
+	if scheme != "http" && scheme != "https" {
+		scheme = "http"
+		if orig.TLS != nil {
+			scheme = "https"
+		}
+	}
+	return scheme + "://" + orig.Host + orig.URL.RequestURI()
+}
+
+func firstHeader(r *http.Request, names ...string) string {
+	for _, name := range names {
+		if v := r.Header.Get(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,65 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForwardAuth(t *testing.T) {
+	defer func() { testEnv.policies.current = nil }()
+	assert.NoError(t, testEnv.policies.load([]byte(`{
+		"default": "allow",
+		"rules": [{"name": "no-deletes", "effect": "deny", "methods": ["DELETE"], "path": "/reports/**"}]
+	}`)))
+
+	email, cookie := signupUser()
+	verify := func(path string, headers map[string]string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		return executeRequest(req)
+	}
+
+	response := verify("/auth/verify", map[string]string{"X-Original-URI": "/reports/2019", "X-Original-Method": "GET"})
+	assert.Equal(t, http.StatusOK, response.Code, "Response should be 200")
+	assert.Contains(t, response.Header().Get("X-Forwarded-User"), email)
+	assert.Equal(t, email, response.Header().Get("X-Auth-Request-Email"))
+
+	response = verify("/auth/verify", map[string]string{"X-Original-URI": "/reports/2019", "X-Original-Method": "DELETE"})
+	assert.Equal(t, http.StatusForbidden, response.Code, "The policy should apply to the original request")
+	assert.Contains(t, response.Body.String(), `"rule":"no-deletes"`)
+	assert.Empty(t, response.Header().Get("X-Forwarded-User"))
+
+	response = verify("/auth/verify", map[string]string{"X-Forwarded-Uri": "/reports/2019", "X-Forwarded-Method": "DELETE"})
+	assert.Equal(t, http.StatusForbidden, response.Code, "Traefik headers should be honored")
+
+	req, _ := http.NewRequest("DELETE", "/auth/verify/reports/2019?x=1", nil)
+	req.AddCookie(cookie)
+	assert.Equal(t, http.StatusForbidden, executeRequest(req).Code, "Envoy paths should be honored")
+
+	cookie = nil
+	browser := map[string]string{
+		"Accept":            "text/html,application/xhtml+xml",
+		"X-Forwarded-Proto": "https",
+		"X-Forwarded-Host":  "app.example.com",
+		"X-Forwarded-Uri":   "/dash?tab=1",
+	}
+	assert.Equal(t, http.StatusUnauthorized, verify("/auth/verify", browser).Code, "Logged out requests should get a 401")
+
+	os.Setenv("LOGIN_URL", "https://auth.example.com/login")
+	defer os.Unsetenv("LOGIN_URL")
+	response = verify("/auth/verify?redirect=1", browser)
+	assert.Equal(t, http.StatusFound, response.Code, "Browsers should be sent to log in")
+	assert.Equal(t, "https://auth.example.com/login?return_to=https%3A%2F%2Fapp.example.com%2Fdash%3Ftab%3D1", response.Header().Get("Location"))
+
+	delete(browser, "Accept")
+	assert.Equal(t, http.StatusUnauthorized, verify("/auth/verify?redirect=1", browser).Code, "Only browsers should be redirected")
+}
@@ -0,0 +1,399 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Route auth requirements
+const (
+	authRequired = "required"
+	authOptional = "optional"
+	authPublic   = "public"
+)
+
+// headerRules change the headers of requests sent to, or responses received
+// from, an upstream. Headers are removed, then set, then added to.
+type headerRules struct {
+	Remove []string          `json:"remove"`
+	Set    map[string]string `json:"set"`
+	Add    map[string]string `json:"add"`
+}
+
+func (rules headerRules) apply(h http.Header) {
+	for _, name := range rules.Remove {
+		h.Del(name)
+	}
+	for name, v := range rules.Set {
+		h.Set(name, v)
+	}
+	for name, v := range rules.Add {
+		h.Add(name, v)
+	}
+}
+
+// upstreamRoute sends the requests to a host, matched with a glob, and under
+// a path prefix to an upstream, or a pool of them. The prefix can be
+// stripped, or rewritten to another one, before the path is joined to the
+// path of the upstream.
+type upstreamRoute struct {
+	Name            string           `json:"name"`
+	Host            string           `json:"host"`
+	PathPrefix      string           `json:"path_prefix"`
+	Upstream        string           `json:"upstream"`
+	Upstreams       []string         `json:"upstreams"`
+	Balance         string           `json:"balance"`
+	HealthCheck     *healthCheck     `json:"health_check"`
+	Outlier         outlierDetection `json:"outlier_detection"`
+	StripPrefix     bool             `json:"strip_prefix"`
+	RewritePrefix   string           `json:"rewrite_prefix"`
+	PreserveHost    bool             `json:"preserve_host"`
+	RequestHeaders  headerRules      `json:"request_headers"`
+	ResponseHeaders headerRules      `json:"response_headers"`
+	// Auth is required by default. Optional routes forward the identity when
+	// there is a valid one, and public routes never do.
+	Auth   string   `json:"auth"`
+	Roles  []string `json:"roles"`
+	Scopes []string `json:"scopes"`
+	// Timeout is the total timeout of requests, which have none by default.
+	// The upstream has ResponseHeaderTimeout, PROXY_TIMEOUT by default, to
+	// start answering, and bodies PROXY_IDLE_TIMEOUT between bytes.
+	Timeout               string        `json:"timeout"`
+	ConnectTimeout        string        `json:"connect_timeout"`
+	ResponseHeaderTimeout string        `json:"response_header_timeout"`
+	Retries               retryPolicy   `json:"retries"`
+	CircuitBreaker        breakerConfig `json:"circuit_breaker"`
+	// Assertion sends the identity signed, instead of in X-Forwarded-User
+	Assertion *assertionConfig `json:"assertion"`
+	Quota     *quota           `json:"quota"`
+	// RateLimit is the limit of the route, RATE_LIMIT per principal by default
+	RateLimit *limitPolicy `json:"rate_limit"`
+
+	host    *regexp.Regexp
+	urls    []*url.URL
+	targets []*target
+	ring    []ringPoint
+	next    uint32
+	breaker *breaker
+
+	timeout               time.Duration
+	connectTimeout        time.Duration
+	responseHeaderTimeout time.Duration
+}
+
+// routeTable is the routes of the gateway, loaded from the ROUTES_FILE
+type routeTable struct {
+	Routes []upstreamRoute `json:"routes"`
+}
+
+// routes holds the current route table, which is swapped when its file
+// changes, and the targets of its upstreams
+type routes struct {
+	sync.RWMutex
+	current *routeTable
+	targets map[string]*target
+	// breakers are keyed by the upstreams of their routes
+	breakers map[string]*breaker
+	// fallback is the route to FORWARD_URL
+	fallback *upstreamRoute
+}
+
+func (rt *routes) get() *routeTable {
+	rt.RLock()
+	defer rt.RUnlock()
+	return rt.current
+}
+
+func (rt *routes) load(b []byte) error {
+	table, err := parseRoutes(b)
+	if err != nil {
+		return err
+	}
+
+	rt.Lock()
+	rt.bind(table)
+	rt.current = table
+	rt.Unlock()
+	return nil
+}
+
+func parseRoutes(b []byte) (*routeTable, error) {
+	var table routeTable
+	if err := json.Unmarshal(b, &table); err != nil {
+		return nil, err
+	}
+
+	for i := range table.Routes {
+		route := &table.Routes[i]
+		if route.Name == "" {
+			route.Name = fmt.Sprintf("route %d", i)
+		}
+
+		if route.Upstream != "" {
+			route.Upstreams = append([]string{route.Upstream}, route.Upstreams...)
+		}
+		if len(route.Upstreams) == 0 {
+			return nil, fmt.Errorf("No upstream for %s", route.Name)
+		}
+		for _, upstream := range route.Upstreams {
+			target, err := url.Parse(upstream)
+			if err != nil || target.Host == "" || (target.Scheme != "http" && target.Scheme != "https") {
+				return nil, fmt.Errorf("Invalid upstream %s for %s", upstream, route.Name)
+			}
+			route.urls = append(route.urls, target)
+		}
+
+		switch route.Balance {
+		case "":
+			route.Balance = balanceRoundRobin
+		case balanceRoundRobin, balanceLeastConn, balanceHash:
+		default:
+			return nil, fmt.Errorf("Invalid balance %s for %s", route.Balance, route.Name)
+		}
+
+		if route.HealthCheck != nil {
+			if err := route.HealthCheck.parse(); err != nil {
+				return nil, fmt.Errorf("%v for %s", err, route.Name)
+			}
+		}
+
+		if route.PathPrefix == "" {
+			route.PathPrefix = "/"
+		}
+		if !strings.HasPrefix(route.PathPrefix, "/") || (route.RewritePrefix != "" && !strings.HasPrefix(route.RewritePrefix, "/")) {
+			return nil, fmt.Errorf("Prefixes of %s must start with /", route.Name)
+		}
+
+		if route.Host != "" {
+			route.host = glob(strings.ToLower(route.Host), ".")
+		}
+
+		switch route.Auth {
+		case "":
+			route.Auth = authRequired
+		case authRequired, authOptional, authPublic:
+		default:
+			return nil, fmt.Errorf("Invalid auth %s for %s", route.Auth, route.Name)
+		}
+
+		if route.RateLimit != nil {
+			route.RateLimit.name = "route:" + route.Name
+			if err := route.RateLimit.parse(); err != nil {
+				return nil, fmt.Errorf("%v for %s", err, route.Name)
+			}
+		}
+
+		if route.Assertion != nil {
+			if err := route.Assertion.parse(route.Name); err != nil {
+				return nil, fmt.Errorf("%v for %s", err, route.Name)
+			}
+		}
+
+		if err := route.parseResilience(); err != nil {
+			return nil, fmt.Errorf("%v for %s", err, route.Name)
+		}
+	}
+
+	return &table, nil
+}
+
+// parseResilience parses the timeouts, retries and circuit breaker of the
+// route
+func (route *upstreamRoute) parseResilience() error {
+	for _, d := range []struct {
+		s *string
+		d *time.Duration
+	}{
+		{&route.Timeout, &route.timeout},
+		{&route.ConnectTimeout, &route.connectTimeout},
+		{&route.ResponseHeaderTimeout, &route.responseHeaderTimeout},
+	} {
+		if *d.s == "" {
+			continue
+		}
+		var err error
+		if *d.d, err = time.ParseDuration(*d.s); err != nil {
+			return fmt.Errorf("Invalid timeout %s", *d.s)
+		}
+	}
+
+	if err := route.Outlier.parse(); err != nil {
+		return err
+	}
+	if err := route.Retries.parse(); err != nil {
+		return err
+	}
+	return route.CircuitBreaker.parse()
+}
+
+// match returns the route of the request with the longest prefix, the
+// first one listed when several are as long
+func (table *routeTable) match(r *http.Request) *upstreamRoute {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	host = strings.ToLower(host)
+
+	var best *upstreamRoute
+	for i := range table.Routes {
+		route := &table.Routes[i]
+		if route.host != nil && !route.host.MatchString(host) {
+			continue
+		}
+		if !hasPathPrefix(r.URL.Path, route.PathPrefix) {
+			continue
+		}
+		if best == nil || len(route.PathPrefix) > len(best.PathPrefix) {
+			best = route
+		}
+	}
+	return best
+}
+
+// hasPathPrefix checks the prefix ends at a segment, so that /api doesn't
+// match /apis
+func hasPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// route returns the route of the request. Requests that no route matches go
+// to FORWARD_URL over http, when it is set.
+func (e *Env) route(r *http.Request) *upstreamRoute {
+	if table := e.routes.get(); table != nil {
+		if route := table.match(r); route != nil {
+			return route
+		}
+	}
+
+	e.routes.RLock()
+	defer e.routes.RUnlock()
+	return e.routes.fallback
+}
+
+// loadFallback builds the route to FORWARD_URL, when it is set, as the
+// gateway starts
+func (rt *routes) loadFallback() error {
+	var route *upstreamRoute
+	if forward := os.Getenv("FORWARD_URL"); forward != "" {
+		route = &upstreamRoute{Name: "default", PathPrefix: "/", Balance: balanceRoundRobin, Auth: authRequired}
+		route.targets = []*target{newTarget(&url.URL{Scheme: "http", Host: forward})}
+		if err := route.parseResilience(); err != nil {
+			return fmt.Errorf("%v for FORWARD_URL", err)
+		}
+		route.breaker = &breaker{config: route.CircuitBreaker}
+		route.Quota = quotaFromEnv()
+		if aud := os.Getenv("FORWARD_AUDIENCE"); aud != "" {
+			route.Assertion = &assertionConfig{Audience: aud, lifetime: assertionLifetime}
+			if secret := os.Getenv("FORWARD_ASSERTION_SECRET"); secret != "" {
+				route.Assertion.secret = []byte(secret)
+			}
+		}
+	}
+
+	rt.Lock()
+	rt.fallback = route
+	rt.Unlock()
+	return nil
+}
+
+// path is the path of the request at the target
+func (route *upstreamRoute) path(t *target, p string) string {
+	if route.StripPrefix || route.RewritePrefix != "" {
+		p = strings.TrimSuffix(route.RewritePrefix, "/") + strings.TrimPrefix(p, strings.TrimSuffix(route.PathPrefix, "/"))
+	}
+
+	base := strings.TrimSuffix(t.url.Path, "/")
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	return base + p
+}
+
+// direct points the outgoing request, with the path p, at the target
+func (route *upstreamRoute) direct(out *http.Request, t *target, p string) {
+	u := *out.URL
+	out.URL = &u
+	out.URL.Scheme, out.URL.Host = t.url.Scheme, t.url.Host
+	out.URL.Path, out.URL.RawPath = route.path(t, p), ""
+	if !route.PreserveHost {
+		out.Host = t.url.Host
+	}
+}
+
+// headerTimeout is the response header timeout of the route, or
+// PROXY_TIMEOUT
+func (route *upstreamRoute) headerTimeout() time.Duration {
+	if route.responseHeaderTimeout > 0 {
+		return route.responseHeaderTimeout
+	}
+	return proxyTimeout()
+}
+
+// allows checks the principal has one of the roles and scopes the route
+// requires
+func (route *upstreamRoute) allows(c *context) bool {
+	if len(route.Roles) > 0 && !containsAny(route.Roles, c.roles()) {
+		return false
+	}
+	return len(route.Scopes) == 0 || containsAny(route.Scopes, c.Scopes)
+}
+
+// gateway sends requests to the upstream of their route, after checking
+// they meet its auth requirements and the policy
+func gateway(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStatus {
+	route := e.route(r)
+	if route == nil {
+		return httpStatus{http.StatusNotFound, nil, http.StatusText(http.StatusNotFound), nil}
+	}
+
+	h := func(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStatus {
+		p := route.RateLimit
+		if p == nil {
+			p = defaultLimit()
+		}
+		if status, ok := limit(e, w, r, c, p); !ok {
+			return status
+		}
+		return meter(e, w, r, c, route)
+	}
+
+	switch route.Auth {
+	case authPublic:
+		return h(e, w, r, c)
+	case authOptional:
+		if status := authenticate(e, r, c); status.Code != http.StatusOK || c.PasswordResetRequired {
+			*c = context{}
+			return h(e, w, r, c)
+		}
+	}
+
+	authorized := func(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStatus {
+		if !route.allows(c) {
+			return forbidden(w, forbiddenReason{
+				Code:      "route_forbidden",
+				Rule:      route.Name,
+				Principal: c.Principal,
+				Message:   "The " + c.Principal + " does not have a role or scope the route requires",
+			})
+		}
+		return enforcePolicy(h)(e, w, r, c)
+	}
+
+	handler := requirePermission(permProxy, Handler{e, authorized})
+	if route.Auth == authRequired {
+		handler = checkToken(handler)
+	}
+	return handler.H(e, w, r, c)
+}
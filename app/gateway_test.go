@@ -0,0 +1,131 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// useRoutes loads the route table until the returned function is called
+func useRoutes(t *testing.T, table string) func() {
+	assert.NoError(t, testEnv.routes.load([]byte(table)))
+	return func() { testEnv.routes.current = nil }
+}
+
+// recordingUpstream answers with its name, and keeps the last request
+func recordingUpstream(name string, got **http.Request, tls bool) *httptest.Server {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*got = r
+		w.Header().Set("X-Internal", "1")
+		w.Write([]byte(name))
+	})
+	if tls {
+		return httptest.NewTLSServer(h)
+	}
+	return httptest.NewServer(h)
+}
+
+func TestGatewayRoutes(t *testing.T) {
+	_, cookie := signupUser()
+
+	var billingGot, docsGot *http.Request
+	billing := recordingUpstream("billing", &billingGot, true)
+	defer billing.Close()
+	docs := recordingUpstream("docs", &docsGot, false)
+	defer docs.Close()
+	defer useUpstream(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("default"))
+	})()
+
+	proxyTransport.TLSClientConfig = billing.Client().Transport.(*http.Transport).TLSClientConfig
+	defer func() { proxyTransport.TLSClientConfig = nil }()
+
+	defer useRoutes(t, `{"routes": [
+		{"name": "billing", "host": "*.example.com", "path_prefix": "/billing", "upstream": "`+billing.URL+`/v2",
+		 "strip_prefix": true,
+		 "request_headers": {"set": {"X-Team": "billing"}, "remove": ["X-Debug"]},
+		 "response_headers": {"remove": ["X-Internal"], "set": {"Cache-Control": "no-store"}}},
+		{"name": "docs", "path_prefix": "/docs/", "upstream": "`+docs.URL+`", "rewrite_prefix": "/public/", "auth": "public"},
+		{"name": "admin", "path_prefix": "/billing/admin", "upstream": "`+billing.URL+`", "roles": ["admin"]}
+	]}`)()
+
+	req, _ := http.NewRequest("GET", "/billing/invoices/1?all=1", nil)
+	req.Host = "api.example.com"
+	req.Header.Set("X-Debug", "1")
+	req.AddCookie(cookie)
+	response := executeRequest(req)
+	assert.Equal(t, http.StatusOK, response.Code, "Response should be 200")
+	assert.Equal(t, "billing", response.Body.String(), "Routes should match on host and prefix")
+	assert.Equal(t, "/v2/invoices/1", billingGot.URL.Path, "The prefix should be stripped and joined to the upstream path")
+	assert.Equal(t, "all=1", billingGot.URL.RawQuery)
+	assert.Equal(t, "billing", billingGot.Header.Get("X-Team"))
+	assert.Empty(t, billingGot.Header.Get("X-Debug"))
+	assert.NotEmpty(t, billingGot.Header.Get("X-Forwarded-User"))
+	assert.Empty(t, response.Header().Get("X-Internal"))
+	assert.Equal(t, "no-store", response.Header().Get("Cache-Control"))
+
+	req, _ = http.NewRequest("GET", "/billing/invoices", nil)
+	req.Host = "api.other.com"
+	req.AddCookie(cookie)
+	response = executeRequest(req)
+	assert.Equal(t, "default", response.Body.String(), "Unmatched requests should go to FORWARD_URL")
+
+	req, _ = http.NewRequest("GET", "/billing", nil)
+	req.Host = "api.example.com"
+	response = executeRequest(req)
+	assert.Equal(t, http.StatusUnauthorized, response.Code, "Routes require auth by default")
+
+	req, _ = http.NewRequest("GET", "/billing/admin/users", nil)
+	req.Host = "api.example.com"
+	req.AddCookie(cookie)
+	response = executeRequest(req)
+	assert.Equal(t, http.StatusForbidden, response.Code, "The longest prefix should win, with its requirements")
+	assert.Contains(t, response.Body.String(), "route_forbidden")
+
+	req, _ = http.NewRequest("GET", "/docs/guide", nil)
+	req.Header.Set("X-Forwarded-User", `{"type":"user","email":"forged@me.com"}`)
+	response = executeRequest(req)
+	assert.Equal(t, http.StatusOK, response.Code, "Public routes don't need a token")
+	assert.Equal(t, "docs", response.Body.String())
+	assert.Equal(t, "/public/guide", docsGot.URL.Path, "The prefix should be rewritten")
+	assert.Empty(t, docsGot.Header.Get("X-Forwarded-User"), "Identities should not be forged")
+
+	req, _ = http.NewRequest("GET", "/docsearch", nil)
+	req.AddCookie(cookie)
+	response = executeRequest(req)
+	assert.Equal(t, "default", response.Body.String(), "Prefixes should end at a segment")
+}
+
+func TestGatewayOptionalAuth(t *testing.T) {
+	email, cookie := signupUser()
+
+	var got *http.Request
+	upstream := recordingUpstream("shop", &got, false)
+	defer upstream.Close()
+	defer useRoutes(t, `{"routes": [{"path_prefix": "/shop", "upstream": "`+upstream.URL+`", "auth": "optional"}]}`)()
+
+	req, _ := http.NewRequest("GET", "/shop", nil)
+	response := executeRequest(req)
+	assert.Equal(t, http.StatusOK, response.Code, "Optional routes don't need a token")
+	assert.Empty(t, got.Header.Get("X-Forwarded-User"))
+
+	req, _ = http.NewRequest("GET", "/shop", nil)
+	req.AddCookie(cookie)
+	response = executeRequest(req)
+	assert.Equal(t, http.StatusOK, response.Code, "Response should be 200")
+	assert.Contains(t, got.Header.Get("X-Forwarded-User"), email, "The identity should be forwarded when there is one")
+}
+
+func TestGatewayRoutesConfig(t *testing.T) {
+	for _, table := range []string{
+		`{"routes": [{"upstream": "ftp://files.internal"}]}`,
+		`{"routes": [{"upstream": "http://a.internal", "path_prefix": "api"}]}`,
+		`{"routes": [{"upstream": "http://a.internal", "auth": "sometimes"}]}`,
+		`{"routes": [{"upstream": "http://a.internal", "timeout": "soon"}]}`,
+	} {
+		assert.Error(t, testEnv.routes.load([]byte(table)), table)
+	}
+	assert.Nil(t, testEnv.routes.get(), "Invalid tables should not be loaded")
+}
@@ -0,0 +1,169 @@
+package app
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"secure/database"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// idempotencyTTL is how long the responses of requests with an
+// Idempotency-Key are replayed for, IDEMPOTENCY_TTL or a day
+func idempotencyTTL() time.Duration {
+	return envDuration("IDEMPOTENCY_TTL", 24*time.Hour)
+}
+
+// idempotencyMaxBody is the largest request or response body of a request
+// with an Idempotency-Key, IDEMPOTENCY_MAX_BODY or 1MB. Larger responses are
+// not stored, so retries go through again.
+func idempotencyMaxBody() int {
+	return envInt("IDEMPOTENCY_MAX_BODY", 1<<20)
+}
+
+// idempotentMethod checks the method has side effects that retries would
+// repeat
+func idempotentMethod(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// idempotent proxies requests sent with an Idempotency-Key once per key and
+// principal. Retries get the stored response of the upstream, with an
+// Idempotent-Replayed header, while one is in flight they get a 409, and a
+// key reused for a different request gets a 422. Responses from the gateway
+// itself, and 5xx ones, are not stored so that they can be retried.
+func idempotent(e *Env, w http.ResponseWriter, r *http.Request, c *context, route *upstreamRoute) httpStatus {
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" || c.Principal == "" || !idempotentMethod(r.Method) {
+		return proxy(e, w, r, c, route)
+	}
+	if len(key) > 255 {
+		return httpStatus{http.StatusBadRequest, nil, "The Idempotency-Key can't be longer than 255 characters", nil}
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(idempotencyMaxBody())+1))
+	if err != nil {
+		return httpStatus{http.StatusBadRequest, nil, "Could not read request body", err}
+	}
+	if len(body) > idempotencyMaxBody() {
+		return httpStatus{http.StatusRequestEntityTooLarge, nil, "The request is too large for an Idempotency-Key", nil}
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	id := sha256.Sum256([]byte(c.id() + "\x00" + key))
+	fingerprint := sha256.Sum256([]byte(r.Method + " " + r.URL.RequestURI() + "\x00" + string(body)))
+
+	// a request still in flight after the timeouts was lost
+	lost := route.headerTimeout() + proxyIdleTimeout()
+	if route.timeout > lost {
+		lost = route.timeout
+	}
+
+	now := time.Now()
+	req := &database.IdempotentRequest{
+		ID:          hex.EncodeToString(id[:]),
+		Owner:       c.id(),
+		Fingerprint: hex.EncodeToString(fingerprint[:]),
+		ExpiresAt:   now.Add(lost + time.Minute),
+	}
+	req.CreatedAt, req.UpdatedAt = now, now
+
+	existing, err := e.db.StartIdempotentRequest(req)
+	if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "", err}
+	}
+	if existing != nil {
+		switch {
+		case existing.Fingerprint != req.Fingerprint:
+			return httpStatus{http.StatusUnprocessableEntity, nil, "The Idempotency-Key was used for a different request", nil}
+		case !existing.Done:
+			return httpStatus{http.StatusConflict, nil, "A request with this Idempotency-Key is in flight", nil}
+		}
+		for k, v := range existing.Header {
+			w.Header()[k] = v
+		}
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(existing.Status)
+		return httpStatus{existing.Status, existing.Body, "", nil}
+	}
+
+	iw := &idempotentWriter{ResponseWriter: w, max: idempotencyMaxBody()}
+	status := proxy(e, iw, r, c, route)
+
+	if !iw.wrote || iw.truncated || status.Code >= 500 {
+		if err := e.db.DeleteIdempotentRequest(req.ID); err != nil {
+			e.l.LogError(err, c.id())
+		}
+		return status
+	}
+
+	req.Done, req.Status, req.Header, req.Body = true, iw.status, iw.header, iw.body.Bytes()
+	req.ExpiresAt = time.Now().Add(idempotencyTTL())
+	if err := e.db.UpdateIdempotentRequest(req); err != nil {
+		e.l.LogError(err, c.id())
+	}
+	return status
+}
+
+// idempotentWriter keeps a copy of the response of the upstream, unless it
+// is larger than max or a stream
+type idempotentWriter struct {
+	http.ResponseWriter
+	max       int
+	wrote     bool
+	status    int
+	header    http.Header
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (w *idempotentWriter) WriteHeader(code int) {
+	if !w.wrote {
+		w.wrote, w.status = true, code
+		w.header = http.Header{}
+		for k, v := range w.Header() {
+			w.header[k] = v
+		}
+		w.truncated = strings.HasPrefix(w.header.Get("Content-Type"), "text/event-stream")
+		if n, err := strconv.Atoi(w.header.Get("Content-Length")); err == nil && n > w.max {
+			w.truncated = true
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *idempotentWriter) Write(b []byte) (int, error) {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.truncated {
+		if w.body.Len()+len(b) > w.max {
+			w.truncated = true
+			w.body.Reset()
+		} else {
+			w.body.Write(b)
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *idempotentWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// deleteExpiredIdempotentRequests deletes the idempotent requests past their
+// expiry
+func deleteExpiredIdempotentRequests(e *Env) error {
+	return e.db.DeleteExpiredIdempotentRequests()
+}
@@ -0,0 +1,80 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/dchest/uniuri"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdempotencyKey(t *testing.T) {
+	_, cookie := signupUser()
+	_, other := signupUser()
+
+	var orders int32
+	release := make(chan struct{})
+	busy := make(chan struct{}, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/orders/slow" {
+			busy <- struct{}{}
+			<-release
+		}
+		if r.URL.Path == "/orders/broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		n := atomic.AddInt32(&orders, 1)
+		w.Header().Set("Location", "/orders/"+strconv.Itoa(int(n)))
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("order " + strconv.Itoa(int(n))))
+	}))
+	defer upstream.Close()
+	defer useRoutes(t, `{"routes": [{"path_prefix": "/orders", "upstream": "`+upstream.URL+`"}]}`)()
+
+	order := func(path, key, body string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set("Idempotency-Key", key)
+		req.AddCookie(cookie)
+		return executeRequest(req)
+	}
+
+	key := uniuri.New()
+	response := order("/orders", key, "book", cookie)
+	assert.Equal(t, http.StatusCreated, response.Code, "Response should be 201")
+	assert.Empty(t, response.Header().Get("Idempotent-Replayed"))
+
+	replayed := order("/orders", key, "book", cookie)
+	assert.Equal(t, http.StatusCreated, replayed.Code, "Retries should get the stored response")
+	assert.Equal(t, response.Body.String(), replayed.Body.String())
+	assert.Equal(t, response.Header().Get("Location"), replayed.Header().Get("Location"))
+	assert.Equal(t, "true", replayed.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&orders), "Retries should not reach the upstream")
+
+	assert.Equal(t, http.StatusUnprocessableEntity, order("/orders", key, "pen", cookie).Code, "Keys can't be reused for other requests")
+
+	response = order("/orders", key, "book", other)
+	assert.Equal(t, http.StatusCreated, response.Code, "Keys should be scoped per user")
+	assert.Empty(t, response.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&orders))
+
+	key = uniuri.New()
+	assert.Equal(t, http.StatusInternalServerError, order("/orders/broken", key, "book", cookie).Code)
+	assert.Empty(t, order("/orders/broken", key, "book", cookie).Header().Get("Idempotent-Replayed"), "Failures should not be stored")
+
+	key = uniuri.New()
+	done := make(chan struct{})
+	go func() {
+		order("/orders/slow", key, "book", cookie)
+		close(done)
+	}()
+	<-busy
+	assert.Equal(t, http.StatusConflict, order("/orders/slow", key, "book", cookie).Code, "Duplicates in flight should get a 409")
+	close(release)
+	<-done
+	assert.Equal(t, "true", order("/orders/slow", key, "book", cookie).Header().Get("Idempotent-Replayed"))
+}
@@ -0,0 +1,306 @@
+package app
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"secure/database"
+	"secure/jwk"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/rs/xid"
+	"golang.org/x/crypto/ed25519"
+)
+
+var (
+	errUnknownKey   = errors.New("Token signed with an unknown key")
+	errKeyAlgorithm = errors.New("Token algorithm does not match its key")
+)
+
+// keyAlgorithms are the asymmetric algorithms a keyring can sign with
+var keyAlgorithms = map[string]elliptic.Curve{
+	"RS256": nil,
+	"RS384": nil,
+	"RS512": nil,
+	"ES256": elliptic.P256(),
+	"ES384": elliptic.P384(),
+	"ES512": elliptic.P521(),
+	"EdDSA": nil,
+}
+
+// signingKey is a decoded database.SigningKey
+type signingKey struct {
+	*database.SigningKey
+	private interface{}
+	public  interface{}
+}
+
+// jwksMaxAge is how long clients can cache the key set for
+const jwksMaxAge = 5 * time.Minute
+
+// keyring holds the keys used to sign and verify tokens. A single key signs
+// new tokens until it expires. The next key is published in the key set at
+// least a cache lifetime of the set before it starts signing, so that
+// clients have it by then, and keys that stopped signing are kept for the
+// overlap window so that the tokens they signed stay valid until they
+// expire.
+type keyring struct {
+	sync.RWMutex
+	db       database.Datastore
+	alg      string
+	rotation time.Duration
+	overlap  time.Duration
+	current  *signingKey
+	keys     map[string]*signingKey
+}
+
+func newKeyring(db database.Datastore, alg string, rotation, overlap time.Duration) (*keyring, error) {
+	if _, ok := keyAlgorithms[alg]; !ok {
+		return nil, fmt.Errorf("Unsupported JWT_ALG %s", alg)
+	}
+
+	k := &keyring{db: db, alg: alg, rotation: rotation, overlap: overlap}
+	return k, k.refresh()
+}
+
+// refresh loads the keys from the datastore, signing with the newest active
+// one, generating the next one when the current one is about to expire and
+// removing the ones that stopped signing longer than the overlap window ago.
+// The current key keeps signing past its expiry until the next one is
+// active.
+func (k *keyring) refresh() error {
+	stored, err := k.db.SigningKeys()
+	if err != nil {
+		return err
+	}
+
+	// keys stop signing when the one after them starts
+	sort.Slice(stored, func(i, j int) bool {
+		return stored[i].Active().Before(stored[j].Active())
+	})
+
+	now := time.Now()
+	keys := map[string]*signingKey{}
+	var current, next *signingKey
+
+	for i, s := range stored {
+		if i+1 < len(stored) && now.After(stored[i+1].Active().Add(k.overlap)) {
+			if err := k.db.DeleteSigningKey(s.ID); err != nil {
+				return err
+			}
+			continue
+		}
+
+		key, err := decodeSigningKey(s)
+		if err != nil {
+			return err
+		}
+		keys[s.ID] = key
+
+		if s.Algorithm != k.alg {
+			continue
+		}
+		if s.Active().After(now) {
+			next = key
+		} else {
+			current = key
+		}
+	}
+
+	// without a key yet, the first one signs right away
+	if current == nil {
+		current, err = k.generate(now)
+		if err != nil {
+			return err
+		}
+		keys[current.ID] = current
+	}
+
+	// the next key is generated two cache lifetimes of the key set before the
+	// current one expires, so that it is published for one at least before
+	// it signs, refreshes being a minute apart
+	if next == nil && now.Add(2*jwksMaxAge).After(current.ExpiresAt) {
+		activeAt := current.ExpiresAt
+		if earliest := now.Add(jwksMaxAge); activeAt.Before(earliest) {
+			activeAt = earliest
+		}
+		next, err = k.generate(activeAt)
+		if err != nil {
+			return err
+		}
+		keys[next.ID] = next
+	}
+
+	k.Lock()
+	k.current = current
+	k.keys = keys
+	k.Unlock()
+	return nil
+}
+
+// rotate refreshes the keyring on every tick
+func (k *keyring) rotate(e *Env, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := k.refresh(); err != nil {
+			e.l.LogError(err, "")
+		}
+	}
+}
+
+// generate generates a key that signs from activeAt for the rotation period
+func (k *keyring) generate(activeAt time.Time) (*signingKey, error) {
+	var der []byte
+
+	switch k.alg {
+	case "RS256", "RS384", "RS512":
+		priv, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		der = x509.MarshalPKCS1PrivateKey(priv)
+	case "ES256", "ES384", "ES512":
+		priv, err := ecdsa.GenerateKey(keyAlgorithms[k.alg], rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err = x509.MarshalECPrivateKey(priv)
+		if err != nil {
+			return nil, err
+		}
+	case "EdDSA":
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der = priv
+	}
+
+	s := database.NewSigningKey(xid.New().String(), k.alg, der, activeAt, activeAt.Add(k.rotation))
+	if err := k.db.AddSigningKey(s); err != nil {
+		return nil, err
+	}
+
+	return decodeSigningKey(s)
+}
+
+func decodeSigningKey(s *database.SigningKey) (*signingKey, error) {
+	key := &signingKey{SigningKey: s}
+
+	switch s.Algorithm {
+	case "RS256", "RS384", "RS512":
+		priv, err := x509.ParsePKCS1PrivateKey(s.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		key.private, key.public = priv, &priv.PublicKey
+	case "ES256", "ES384", "ES512":
+		priv, err := x509.ParseECPrivateKey(s.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		key.private, key.public = priv, &priv.PublicKey
+	case "EdDSA":
+		if len(s.PrivateKey) != ed25519.PrivateKeySize {
+			return nil, fmt.Errorf("Invalid EdDSA key %s", s.ID)
+		}
+		priv := ed25519.PrivateKey(s.PrivateKey)
+		key.private, key.public = priv, priv.Public()
+	default:
+		return nil, fmt.Errorf("Unsupported key algorithm %s", s.Algorithm)
+	}
+
+	return key, nil
+}
+
+// sign signs the claims with the current key, setting the kid header
+func (k *keyring) sign(claims jwt.Claims) (string, error) {
+	return k.signWithType(claims, "JWT")
+}
+
+// signWithType signs the claims setting the typ header to typ, so that
+// tokens meant for different uses can't be substituted for one another
+func (k *keyring) signWithType(claims jwt.Claims, typ string) (string, error) {
+	k.RLock()
+	key := k.current
+	k.RUnlock()
+
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Algorithm), claims)
+	token.Header["kid"] = key.ID
+	token.Header["typ"] = typ
+	return token.SignedString(key.private)
+}
+
+// verificationKey is the jwt.Keyfunc for tokens signed by the keyring
+func (k *keyring) verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	k.RLock()
+	key, ok := k.keys[kid]
+	k.RUnlock()
+
+	if !ok {
+		return nil, errUnknownKey
+	}
+
+	if token.Method.Alg() != key.Algorithm {
+		return nil, errKeyAlgorithm
+	}
+
+	return key.public, nil
+}
+
+// set returns the public JSON Web Key Set, newest key first
+func (k *keyring) set() (jwk.Set, error) {
+	k.RLock()
+	keys := make([]*signingKey, 0, len(k.keys))
+	for _, key := range k.keys {
+		keys = append(keys, key)
+	}
+	k.RUnlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.After(keys[j].CreatedAt)
+	})
+
+	set := jwk.Set{Keys: []jwk.Key{}}
+	for _, key := range keys {
+		j, err := jwk.New(key.ID, key.Algorithm, key.public)
+		if err != nil {
+			return jwk.Set{}, err
+		}
+		set.Keys = append(set.Keys, j)
+	}
+
+	return set, nil
+}
+
+func jwks(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStatus {
+	if r.Method != http.MethodGet {
+		return httpStatus{http.StatusNotFound, nil, http.StatusText(http.StatusNotFound), nil}
+	}
+
+	set, err := e.keys.set()
+
+	if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "Error encoding keys", err}
+	}
+
+	res, err := json.Marshal(set)
+
+	if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "Error marshalling results", err}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(jwksMaxAge.Seconds())))
+	return httpStatus{http.StatusOK, res, "", nil}
+}
@@ -0,0 +1,184 @@
+package app
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"secure/database"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// minPasswordLength is the shortest password a user can change to
+const minPasswordLength = 8
+
+// validName checks a first or last name is of a sensible length and free of
+// control characters
+func validName(name string) bool {
+	if utf8.RuneCountInString(name) > 100 {
+		return false
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// me shows, updates and deletes the profile of the user
+func me(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStatus {
+	if c.User.Email == "" {
+		return forbidden(w, forbiddenReason{
+			Code:      "user_required",
+			Principal: c.Principal,
+			Message:   "Only users have a profile",
+		})
+	}
+
+	var user *database.User
+	var err error
+
+	switch r.Method {
+	case http.MethodGet:
+		user, err = e.db.GetUser(c.User.Email)
+
+		if err != nil {
+			return httpStatus{http.StatusNotFound, nil, "Unknown user", err}
+		}
+	case http.MethodPatch:
+		var a struct {
+			FirstName *string `json:"first_name"`
+			LastName  *string `json:"last_name"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+			return httpStatus{http.StatusBadRequest, nil, "Could not decode request body", err}
+		}
+
+		for _, name := range []*string{a.FirstName, a.LastName} {
+			if name != nil {
+				*name = strings.TrimSpace(*name)
+				if !validName(*name) {
+					return httpStatus{http.StatusBadRequest, nil, "Names must be at most 100 characters without control characters", nil}
+				}
+			}
+		}
+
+		user, err = e.db.UpdateUser(c.User.Email, func(u *database.User) error {
+			if a.FirstName != nil {
+				u.FirstName = *a.FirstName
+			}
+			if a.LastName != nil {
+				u.LastName = *a.LastName
+			}
+			return nil
+		})
+
+		if err != nil {
+			return httpStatus{http.StatusNotFound, nil, "Unknown user", err}
+		}
+
+		// the token carries the name, so a session gets a fresh one
+		if c.Principal == principalUser {
+			c.User.FirstName, c.User.LastName = user.FirstName, user.LastName
+			if err := issueToken(e, w, c); err != nil {
+				return httpStatus{http.StatusInternalServerError, nil, "", err}
+			}
+		}
+	case http.MethodDelete:
+		return deleteMe(e, w, r, c)
+	default:
+		return httpStatus{http.StatusNotFound, nil, http.StatusText(http.StatusNotFound), nil}
+	}
+
+	res, err := json.Marshal(result{"success", user})
+
+	if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "Error marshalling results", err}
+	}
+
+	return httpStatus{http.StatusOK, res, "", nil}
+}
+
+// changePassword changes the password of the logged in user, who must know
+// their current one, or have the reset token they were emailed when an admin
+// required them to reset it. Every other session of the user is revoked,
+// and the current one is given a new token.
+func changePassword(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStatus {
+	if r.Method != http.MethodPost {
+		return httpStatus{http.StatusNotFound, nil, http.StatusText(http.StatusNotFound), nil}
+	}
+
+	if c.Principal != principalUser {
+		return forbidden(w, forbiddenReason{
+			Code:      "user_session_required",
+			Principal: c.Principal,
+			Message:   "Passwords can only be changed by a logged in user",
+		})
+	}
+
+	var a struct {
+		CurrentPassword string `json:"current_password"`
+		ResetToken      string `json:"reset_token"`
+		NewPassword     string `json:"new_password"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		return httpStatus{http.StatusBadRequest, nil, "Could not decode request body", err}
+	}
+
+	if e.ssoEnforced(c.User.Email) {
+		return forbidden(w, forbiddenReason{
+			Code:      "sso_enforced",
+			Principal: c.Principal,
+			Message:   "The user's domain logs in with single sign-on",
+		})
+	}
+
+	if utf8.RuneCountInString(a.NewPassword) < minPasswordLength {
+		return httpStatus{http.StatusBadRequest, nil, "The new password is too short", nil}
+	}
+
+	if c.PasswordResetRequired {
+		// the current password is what the reset is required to replace
+		p, err := e.db.GetPasswordReset(c.User.Email)
+		if err != nil || subtle.ConstantTimeCompare([]byte(hashToken(a.ResetToken)), []byte(p.TokenHash)) != 1 {
+			failedLogin(e, c.User.Email)
+			return httpStatus{http.StatusForbidden, nil, "Invalid or expired reset token", err}
+		}
+	} else if _, err := e.db.FindUser(c.User.Email, a.CurrentPassword); err != nil {
+		failedLogin(e, c.User.Email)
+		return httpStatus{http.StatusForbidden, nil, "Incorrect current password", err}
+	}
+
+	if _, err := e.db.FindUser(c.User.Email, a.NewPassword); err == nil {
+		return httpStatus{http.StatusBadRequest, nil, "The new password must be different from the current one", nil}
+	}
+
+	// taking the reset makes sure only one of concurrent requests uses it
+	if c.PasswordResetRequired {
+		if err := e.db.TakePasswordReset(c.User.Email); err != nil {
+			return httpStatus{http.StatusForbidden, nil, "Invalid or expired reset token", nil}
+		}
+	}
+
+	user, err := e.db.UpdateUser(c.User.Email, func(u *database.User) error {
+		u.PasswordResetRequired = false
+		u.SessionVersion++
+		return u.SetPassword(a.NewPassword)
+	})
+
+	if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "", err}
+	}
+	e.streams.revoke(user.Email, user)
+
+	c.Session = user.SessionVersion
+	if err := issueToken(e, w, c); err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "", err}
+	}
+
+	return httpStatus{http.StatusOK, []byte(`{"status":"success"}`), "", nil}
+}
@@ -0,0 +1,91 @@
+package app
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/dchest/uniuri"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMe(t *testing.T) {
+	email := uniuri.New() + "@me.com"
+	payload := `{"email":"` + email + `","password":"secret123"}`
+	signup, _ := http.NewRequest("POST", "/signup", bytes.NewBufferString(payload))
+	cookie := executeRequest(signup).Result().Cookies()[0]
+
+	login, _ := http.NewRequest("POST", "/login", bytes.NewBufferString(payload))
+	other := executeRequest(login).Result().Cookies()[0]
+
+	as := func(cookie *http.Cookie, method, path, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.AddCookie(cookie)
+		return executeRequest(req)
+	}
+
+	response := as(cookie, "PATCH", "/me", `{"first_name":" Ada ","last_name":"Lovelace"}`)
+	assert.Equal(t, http.StatusOK, response.Code, "Response should be 200")
+	assert.Contains(t, response.Body.String(), `"first_name":"Ada","last_name":"Lovelace"`)
+	cookie = response.Result().Cookies()[0]
+
+	assert.Equal(t, http.StatusBadRequest, as(cookie, "PATCH", "/me", `{"first_name":"`+strings.Repeat("a", 101)+`"}`).Code)
+	assert.Contains(t, as(cookie, "GET", "/me", "").Body.String(), `"first_name":"Ada"`)
+
+	assert.Equal(t, http.StatusForbidden, as(cookie, "POST", "/me/password", `{"current_password":"wrong","new_password":"new-secret"}`).Code)
+
+	assert.Equal(t, http.StatusBadRequest, as(cookie, "POST", "/me/password", `{"current_password":"secret123","new_password":"secret123"}`).Code, "The new password should be different")
+
+	response = as(cookie, "POST", "/me/password", `{"current_password":"secret123","new_password":"new-secret"}`)
+	assert.Equal(t, http.StatusOK, response.Code, "Response should be 200")
+
+	assert.Equal(t, http.StatusOK, as(response.Result().Cookies()[0], "GET", "/me", "").Code, "The current session should continue")
+	assert.Equal(t, http.StatusUnauthorized, as(other, "GET", "/me", "").Code, "Other sessions should be revoked")
+
+	login, _ = http.NewRequest("POST", "/login", bytes.NewBufferString(`{"email":"`+email+`","password":"new-secret"}`))
+	assert.Equal(t, http.StatusOK, executeRequest(login).Code)
+}
+
+func TestRequiredPasswordReset(t *testing.T) {
+	email := uniuri.New() + "@me.com"
+	payload := `{"email":"` + email + `","password":"secret123"}`
+	signup, _ := http.NewRequest("POST", "/signup", bytes.NewBufferString(payload))
+	executeRequest(signup)
+
+	os.Setenv("ADMIN_EMAILS", "admin-"+email)
+	defer os.Unsetenv("ADMIN_EMAILS")
+	signup, _ = http.NewRequest("POST", "/signup", bytes.NewBufferString(`{"email":"admin-`+email+`","password":"secret"}`))
+	admin := executeRequest(signup).Result().Cookies()[0]
+
+	as := func(cookie *http.Cookie, method, path, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.AddCookie(cookie)
+		return executeRequest(req)
+	}
+
+	assert.Equal(t, http.StatusOK, as(admin, "POST", "/admin/users/"+email+"/reset-password", "").Code)
+	token := regexp.MustCompile(`token\n(\S+)`).FindStringSubmatch(testMail.last(email))
+	if !assert.Len(t, token, 2, "The user should be emailed a reset token") {
+		return
+	}
+
+	login, _ := http.NewRequest("POST", "/login", bytes.NewBufferString(payload))
+	cookie := executeRequest(login).Result().Cookies()[0]
+
+	assert.Equal(t, http.StatusForbidden, as(cookie, "POST", "/me/password", `{"current_password":"secret123","new_password":"new-secret"}`).Code,
+		"The current password should not be enough once a reset is required")
+	assert.Equal(t, http.StatusForbidden, as(cookie, "POST", "/me/password", `{"reset_token":"wrong","new_password":"new-secret"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, as(cookie, "POST", "/me/password", `{"reset_token":"`+token[1]+`","new_password":"secret123"}`).Code,
+		"The new password should be different")
+
+	response := as(cookie, "POST", "/me/password", `{"reset_token":"`+token[1]+`","new_password":"new-secret"}`)
+	assert.Equal(t, http.StatusOK, response.Code, "Response should be 200")
+	assert.Equal(t, http.StatusOK, as(response.Result().Cookies()[0], "GET", "/me", "").Code)
+
+	_, err := testEnv.db.GetPasswordReset(email)
+	assert.Error(t, err, "Reset tokens should work once")
+}
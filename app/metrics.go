@@ -0,0 +1,124 @@
+package app
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// metricHelp describes the metrics, which are served in the Prometheus text
+// format
+var metricHelp = map[string]string{
+	"gateway_upstream_requests_total":    "counter Requests proxied to the upstream of each route, by status code",
+	"gateway_upstream_retries_total":     "counter Requests to upstreams retried after an error",
+	"gateway_circuit_breaker_open_total": "counter Times the circuit breaker of each route opened",
+	"gateway_circuit_breaker_state":      "gauge State of the circuit breaker of each route: 0 closed, 1 open, 2 half open",
+	"gateway_upstream_target_healthy":    "gauge Whether each target of a route is healthy and not ejected",
+	"gateway_upstream_target_active":     "gauge Requests in flight to each target of a route",
+	"gateway_upstream_rejected_total":    "counter Requests failed fast because the circuit breaker of the route was open",
+	"gateway_quota_exceeded_total":       "counter Requests refused as the principal was over the quota of the route",
+	"gateway_rate_limited_total":         "counter Requests refused as they were over the rate limit of each policy",
+}
+
+// metrics are the counters of the gateway, by name and labels
+type metrics struct {
+	mu       sync.Mutex
+	counters map[string]float64
+}
+
+// series is the name of a metric with its labels, given as name, value
+// pairs
+func series(name string, labels ...string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+// inc adds one to the counter
+func (m *metrics) inc(name string, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.counters == nil {
+		m.counters = map[string]float64{}
+	}
+	m.counters[series(name, labels...)]++
+}
+
+// get returns the value of the counter
+func (m *metrics) get(name string, labels ...string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.counters[series(name, labels...)]
+}
+
+// write writes the counters and the gauges in the Prometheus text format
+func (m *metrics) write(buf *bytes.Buffer, gauges map[string]float64) {
+	m.mu.Lock()
+	all := map[string]float64{}
+	for k, v := range m.counters {
+		all[k] = v
+	}
+	m.mu.Unlock()
+	for k, v := range gauges {
+		all[k] = v
+	}
+
+	byName := map[string][]string{}
+	for k := range all {
+		name := k
+		if i := strings.Index(k, "{"); i >= 0 {
+			name = k[:i]
+		}
+		byName[name] = append(byName[name], k)
+	}
+
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if help, ok := metricHelp[name]; ok {
+			parts := strings.SplitN(help, " ", 2)
+			fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, parts[1], name, parts[0])
+		}
+		keys := byName[name]
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(buf, "%s %v\n", k, all[k])
+		}
+	}
+}
+
+// serveMetrics serves the metrics of the gateway and its upstreams with GET
+// /metrics, to scrapers with the METRICS_TOKEN as a bearer token when it is
+// set
+func serveMetrics(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStatus {
+	if r.Method != http.MethodGet {
+		return httpStatus{http.StatusNotFound, nil, http.StatusText(http.StatusNotFound), nil}
+	}
+
+	if token := os.Getenv("METRICS_TOKEN"); token != "" {
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			return httpStatus{http.StatusUnauthorized, nil, http.StatusText(http.StatusUnauthorized), nil}
+		}
+	}
+
+	var buf bytes.Buffer
+	e.metrics.write(&buf, e.routes.gauges())
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	return httpStatus{http.StatusOK, buf.Bytes(), "", nil}
+}
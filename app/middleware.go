@@ -2,7 +2,6 @@ package app
 
 import (
 	"net/http"
-	"os"
 	"secure/database"
 	"strings"
 	"time"
@@ -10,22 +9,40 @@ import (
 	"github.com/dgrijalva/jwt-go"
 )
 
+// tokenLifetime is how long an issued token is valid for
+const tokenLifetime = 48 * time.Hour
+
+// Principal types, forwarded upstream in X-Forwarded-User
+const (
+	principalUser   = "user"
+	principalClient = "client"
+	principalAPIKey = "api_key"
+)
+
+// Claims are the claims of the tokens issued by the service
 type Claims struct {
-	User database.User `json:"user"`
+	User      database.User `json:"user"`
+	Principal string        `json:"principal,omitempty"`
+	ClientID  string        `json:"client_id,omitempty"`
+	Scope     string        `json:"scope,omitempty"`
+	Org       string        `json:"org,omitempty"`
+	OrgRole   string        `json:"org_role,omitempty"`
+	// Session is the session version of the user the token was issued at
+	Session int `json:"sv,omitempty"`
 	jwt.StandardClaims
 }
 
 func setupMiddleware(r Handler) Handler {
-	return logRequests(checkToken(r))
+	return logRequests(checkToken(limitRequests(defaultLimit, r)))
 }
 
 func logRequests(h Handler) Handler {
 	return Handler{h.Env, hFunc(func(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStatus {
 		t := time.Now()
 		res := h.H(h.Env, w, r, c)
-		go e.l.LogRequest(r, time.Since(t).String(), res.Error(), res.Status(), c.User.Email)
+		go e.l.LogRequest(r, time.Since(t).String(), res.Error(), res.Status(), c.id())
 		if res.FuncErr != nil {
-			go e.l.LogError(res.FuncErr, c.User.Email)
+			go e.l.LogError(res.FuncErr, c.id())
 		}
 		return res
 	})}
@@ -33,73 +50,151 @@ func logRequests(h Handler) Handler {
 
 func checkToken(h Handler) Handler {
 	return Handler{h.Env, hFunc(func(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStatus {
-		var tokenString string
-		tokens, ok := r.Header["Authorization"]
-		if ok && len(tokens) >= 1 {
-			tokenString = tokens[0]
-			tokenString = strings.TrimPrefix(tokenString, "Bearer ")
+		if status := authenticate(e, r, c); status.Code != http.StatusOK {
+			return status
 		}
 
-		if tokenString == "" {
-			cookie, err := r.Cookie("jwt")
-			if err != nil {
-				return httpStatus{http.StatusUnauthorized, nil, http.StatusText(http.StatusUnauthorized), err}
-			}
-			tokenString = cookie.String()
-			tokenString = strings.TrimPrefix(tokenString, "jwt=")
+		// the only thing a user who must reset their password can do is that
+		if c.PasswordResetRequired && r.URL.Path != "/me/password" {
+			return forbidden(w, forbiddenReason{
+				Code:      "password_reset_required",
+				Principal: c.Principal,
+				Message:   "The user must change their password",
+			})
 		}
 
-		token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-			return []byte(os.Getenv("JWT_SECRET")), nil
-		})
+		return h.H(h.Env, w, r, c)
+	})}
+}
 
+// authenticate validates the API key, or the token sent as a bearer token or
+// jwt cookie, and sets the principal of the context from it
+func authenticate(e *Env, r *http.Request, c *context) httpStatus {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return authenticateAPIKey(e, key, c)
+	}
+
+	var tokenString string
+	tokens, ok := r.Header["Authorization"]
+	if ok && len(tokens) >= 1 {
+		tokenString = tokens[0]
+		tokenString = strings.TrimPrefix(tokenString, "Bearer ")
+	}
+
+	if strings.HasPrefix(tokenString, apiKeyPrefix) {
+		return authenticateAPIKey(e, tokenString, c)
+	}
+
+	if tokenString == "" {
+		cookie, err := r.Cookie("jwt")
 		if err != nil {
 			return httpStatus{http.StatusUnauthorized, nil, http.StatusText(http.StatusUnauthorized), err}
 		}
+		tokenString = cookie.String()
+		tokenString = strings.TrimPrefix(tokenString, "jwt=")
+	}
 
-		if !token.Valid {
-			if ve, okVal := err.(*jwt.ValidationError); okVal {
-				return httpStatus{http.StatusUnauthorized, nil, ve.Error(), nil}
-			}
-			return httpStatus{http.StatusUnauthorized, nil, http.StatusText(http.StatusUnauthorized), nil}
-		}
+	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, e.keys.verificationKey)
 
-		if claims, ok := token.Claims.(*Claims); ok {
-			c.User = claims.User
+	if err != nil {
+		return httpStatus{http.StatusUnauthorized, nil, http.StatusText(http.StatusUnauthorized), err}
+	}
+
+	if !token.Valid {
+		if ve, okVal := err.(*jwt.ValidationError); okVal {
+			return httpStatus{http.StatusUnauthorized, nil, ve.Error(), nil}
 		}
+		return httpStatus{http.StatusUnauthorized, nil, http.StatusText(http.StatusUnauthorized), nil}
+	}
 
-		return h.H(h.Env, w, r, c)
-	})}
+	claims, ok := token.Claims.(*Claims)
+
+	// tokens issued to OpenID Connect clients carry an audience and are not
+	// sessions with this service
+	if !ok || claims.Audience != "" {
+		return httpStatus{http.StatusUnauthorized, nil, http.StatusText(http.StatusUnauthorized), nil}
+	}
+
+	switch claims.Principal {
+	case "", principalUser:
+		if claims.User.Email == "" {
+			return httpStatus{http.StatusUnauthorized, nil, http.StatusText(http.StatusUnauthorized), nil}
+		}
+		// the user is looked up so that disabling them or revoking their
+		// sessions takes effect immediately
+		u, err := e.db.GetUser(claims.User.Email)
+		if err != nil || u.Disabled || u.Deleted() || u.SessionVersion != claims.Session {
+			return httpStatus{http.StatusUnauthorized, nil, http.StatusText(http.StatusUnauthorized), err}
+		}
+		c.Principal = principalUser
+		c.User = claims.User
+		// roles are those of the user now, not when the token was issued
+		c.User.Roles, c.User.Permissions = u.Roles, u.Permissions
+		// and so is their role in the organization, which is dropped once
+		// they are no longer a member
+		if claims.Org != "" {
+			if m, err := e.db.GetMembership(claims.Org, u.Email); err == nil {
+				c.Org, c.OrgRole = m.OrgID, m.Role
+			}
+		}
+		c.Session = claims.Session
+		c.PasswordResetRequired = u.PasswordResetRequired
+	case principalClient:
+		if claims.ClientID == "" {
+			return httpStatus{http.StatusUnauthorized, nil, http.StatusText(http.StatusUnauthorized), nil}
+		}
+		c.Principal = principalClient
+		c.ClientID = claims.ClientID
+	default:
+		return httpStatus{http.StatusUnauthorized, nil, http.StatusText(http.StatusUnauthorized), nil}
+	}
+
+	c.Scopes = strings.Fields(claims.Scope)
+	return httpStatus{http.StatusOK, nil, "", nil}
 }
 
 func addToken(h Handler) Handler {
 	return Handler{h.Env, hFunc(func(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStatus {
 		res := h.H(h.Env, w, r, c)
-		if res.FuncErr != nil {
+		if res.FuncErr != nil || res.ResponseError != "" {
 			time.Sleep(100 * time.Millisecond)
 			return res
 		}
 
-		expires := time.Now().Local().Add(48 * time.Hour)
-		mySigningKey := []byte(os.Getenv("JWT_SECRET"))
-
-		claims := Claims{
-			c.User,
-			jwt.StandardClaims{
-				ExpiresAt: expires.Unix(),
-				Issuer:    "server",
-			},
+		if c.User.Email == "" {
+			return res
 		}
 
-		token := jwt.NewWithClaims(jwt.SigningMethodHS256, &claims)
-		ss, signErr := token.SignedString(mySigningKey)
-
-		if signErr != nil {
-			return httpStatus{http.StatusInternalServerError, nil, "", signErr}
+		if err := issueToken(e, w, c); err != nil {
+			return httpStatus{http.StatusInternalServerError, nil, "", err}
 		}
-
-		cookie := http.Cookie{Name: "jwt", Value: ss, Expires: expires}
-		http.SetCookie(w, &cookie)
 		return res
 	})}
 }
+
+// issueToken sets the jwt cookie to a new token for the user of the context
+func issueToken(e *Env, w http.ResponseWriter, c *context) error {
+	expires := time.Now().Local().Add(tokenLifetime)
+
+	claims := Claims{
+		User:      c.User,
+		Principal: principalUser,
+		Org:       c.Org,
+		OrgRole:   c.OrgRole,
+		Session:   c.Session,
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: expires.Unix(),
+			Issuer:    "server",
+		},
+	}
+
+	ss, err := e.keys.sign(&claims)
+
+	if err != nil {
+		return err
+	}
+
+	cookie := http.Cookie{Name: "jwt", Value: ss, Expires: expires}
+	http.SetCookie(w, &cookie)
+	return nil
+}
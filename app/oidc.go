@@ -0,0 +1,525 @@
+package app
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"secure/database"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/rs/xid"
+)
+
+const (
+	authCodeLifetime    = time.Minute
+	accessTokenLifetime = time.Hour
+)
+
+// accessClaims are the claims of access tokens issued to OpenID Connect
+// clients. They are signed with the at+jwt type and are only accepted by
+// the userinfo endpoint.
+type accessClaims struct {
+	Scope    string `json:"scope"`
+	ClientID string `json:"client_id"`
+	jwt.StandardClaims
+}
+
+// idClaims are the claims of OpenID Connect ID tokens
+type idClaims struct {
+	Nonce      string `json:"nonce,omitempty"`
+	Email      string `json:"email,omitempty"`
+	GivenName  string `json:"given_name,omitempty"`
+	FamilyName string `json:"family_name,omitempty"`
+	jwt.StandardClaims
+}
+
+// randomToken returns a url safe random string of n bytes
+func randomToken(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// hashToken returns the hash tokens are stored under
+func hashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// issuer is the issuer URL of the OpenID Connect provider, and the base URL
+// of the links this service hands out, set by ISSUER. It is never taken from
+// the Host of the request, which whoever sends it sets, so that tokens and
+// emails can't name other sites. The provider is only enabled when it is set.
+func issuer() string {
+	return strings.TrimSuffix(os.Getenv("ISSUER"), "/")
+}
+
+// noIssuer answers the endpoints of the OpenID Connect provider while ISSUER
+// is not set
+var noIssuer = httpStatus{http.StatusNotFound, nil, "The OpenID Connect provider needs ISSUER to be set", nil}
+
+// oauthError writes an error in the format defined by RFC 6749
+func oauthError(w http.ResponseWriter, code int, errCode, description string) httpStatus {
+	res, _ := json.Marshal(map[string]string{"error": errCode, "error_description": description})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	return httpStatus{code, res, "", nil}
+}
+
+// redirectWith redirects to uri adding the non empty params to its query
+func redirectWith(w http.ResponseWriter, r *http.Request, uri string, params url.Values) httpStatus {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return httpStatus{http.StatusBadRequest, nil, "Invalid redirect_uri", err}
+	}
+
+	q := u.Query()
+	for k, v := range params {
+		if len(v) > 0 && v[0] != "" {
+			q[k] = v
+		}
+	}
+	u.RawQuery = q.Encode()
+
+	http.Redirect(w, r, u.String(), http.StatusFound)
+	return httpStatus{http.StatusFound, nil, "", nil}
+}
+
+func hasScope(scope, s string) bool {
+	for _, f := range strings.Fields(scope) {
+		if f == s {
+			return true
+		}
+	}
+	return false
+}
+
+func discovery(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStatus {
+	if r.Method != http.MethodGet {
+		return httpStatus{http.StatusNotFound, nil, http.StatusText(http.StatusNotFound), nil}
+	}
+
+	iss := issuer()
+	if iss == "" {
+		return noIssuer
+	}
+
+	res, err := json.Marshal(map[string]interface{}{
+		"issuer":                                iss,
+		"authorization_endpoint":                iss + "/authorize",
+		"token_endpoint":                        iss + "/token",
+		"userinfo_endpoint":                     iss + "/userinfo",
+		"jwks_uri":                              iss + "/.well-known/jwks.json",
+		"registration_endpoint":                 iss + "/clients",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code", "client_credentials"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{e.keys.alg},
+		"scopes_supported":                      []string{"openid", "email", "profile"},
+		"claims_supported":                      []string{"sub", "iss", "aud", "exp", "iat", "nonce", "email", "given_name", "family_name"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+	})
+
+	if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "Error marshalling results", err}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return httpStatus{http.StatusOK, res, "", nil}
+}
+
+// authorize handles the authorization code flow. Users that aren't logged in
+// are sent to LOGIN_URL with a return_to back to this request.
+func authorize(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStatus {
+	if r.Method != http.MethodGet {
+		return httpStatus{http.StatusNotFound, nil, http.StatusText(http.StatusNotFound), nil}
+	}
+
+	if issuer() == "" {
+		return noIssuer
+	}
+
+	q := r.URL.Query()
+	client, err := e.db.GetClient(q.Get("client_id"))
+
+	if err != nil {
+		return httpStatus{http.StatusBadRequest, nil, "Unknown client_id", err}
+	}
+
+	// errors are only sent back to redirect URIs we know belong to the client
+	redirectURI := q.Get("redirect_uri")
+	if !client.AllowsGrant("authorization_code") || !client.ValidRedirectURI(redirectURI) {
+		return httpStatus{http.StatusBadRequest, nil, "Invalid redirect_uri", nil}
+	}
+
+	fail := func(errCode, description string) httpStatus {
+		return redirectWith(w, r, redirectURI, url.Values{
+			"error":             {errCode},
+			"error_description": {description},
+			"state":             {q.Get("state")},
+		})
+	}
+
+	if q.Get("response_type") != "code" {
+		return fail("unsupported_response_type", "Only the code response type is supported")
+	}
+
+	if !hasScope(q.Get("scope"), "openid") {
+		return fail("invalid_scope", "The openid scope is required")
+	}
+
+	if q.Get("code_challenge") == "" || q.Get("code_challenge_method") != "S256" {
+		return fail("invalid_request", "PKCE with the S256 code challenge method is required")
+	}
+
+	if status := authenticate(e, r, c); status.Code != http.StatusOK {
+		login := os.Getenv("LOGIN_URL")
+		if login == "" || q.Get("prompt") == "none" {
+			return fail("login_required", "The user is not logged in")
+		}
+		return redirectWith(w, r, login, url.Values{"return_to": {issuer() + r.URL.RequestURI()}})
+	}
+
+	code := randomToken(32)
+	now := time.Now()
+	err = e.db.AddAuthCode(&database.AuthCode{
+		ID:            hashToken(code),
+		ClientID:      client.ID,
+		Email:         c.User.Email,
+		RedirectURI:   redirectURI,
+		Scope:         q.Get("scope"),
+		Nonce:         q.Get("nonce"),
+		CodeChallenge: q.Get("code_challenge"),
+		ExpiresAt:     now.Add(authCodeLifetime),
+	})
+
+	if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "", err}
+	}
+
+	return redirectWith(w, r, redirectURI, url.Values{"code": {code}, "state": {q.Get("state")}})
+}
+
+func token(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStatus {
+	if r.Method != http.MethodPost {
+		return httpStatus{http.StatusNotFound, nil, http.StatusText(http.StatusNotFound), nil}
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return oauthError(w, http.StatusBadRequest, "invalid_request", "Could not decode request body")
+	}
+
+	id, secret, ok := r.BasicAuth()
+	if ok {
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		id, secret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+
+	client, err := e.db.GetClient(id)
+
+	if err != nil || (!client.Public && !client.ValidSecret(secret)) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="token"`)
+		return oauthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+	}
+
+	grant := r.PostFormValue("grant_type")
+	if !client.AllowsGrant(grant) {
+		return oauthError(w, http.StatusBadRequest, "unauthorized_client", "The client is not registered for this grant_type")
+	}
+
+	switch grant {
+	case "authorization_code":
+		return exchangeCode(e, w, r, client)
+	case "client_credentials":
+		return clientCredentials(e, w, r, client)
+	}
+	return oauthError(w, http.StatusBadRequest, "unsupported_grant_type", "Unsupported grant_type")
+}
+
+func exchangeCode(e *Env, w http.ResponseWriter, r *http.Request, client *database.Client) httpStatus {
+	if issuer() == "" {
+		return oauthError(w, http.StatusBadRequest, "unsupported_grant_type", noIssuer.ResponseError)
+	}
+
+	code, err := e.db.RedeemAuthCode(hashToken(r.PostFormValue("code")))
+
+	if err != nil || code.ClientID != client.ID || code.RedirectURI != r.PostFormValue("redirect_uri") {
+		return oauthError(w, http.StatusBadRequest, "invalid_grant", "Invalid authorization code")
+	}
+
+	challenge := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(challenge[:])), []byte(code.CodeChallenge)) != 1 {
+		return oauthError(w, http.StatusBadRequest, "invalid_grant", "Invalid code_verifier")
+	}
+
+	user, err := e.db.GetUser(code.Email)
+
+	// users disabled or deleted since they authorized the client get no
+	// tokens
+	if err != nil || user.Disabled || user.Deleted() {
+		return oauthError(w, http.StatusBadRequest, "invalid_grant", "Unknown user")
+	}
+
+	now := time.Now()
+	standard := jwt.StandardClaims{
+		Issuer:    issuer(),
+		Subject:   user.Email,
+		Audience:  client.ID,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(accessTokenLifetime).Unix(),
+	}
+
+	access, err := e.keys.signWithType(&accessClaims{code.Scope, client.ID, standard}, "at+jwt")
+
+	if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "", err}
+	}
+
+	id := idClaims{Nonce: code.Nonce, StandardClaims: standard}
+	if hasScope(code.Scope, "email") {
+		id.Email = user.Email
+	}
+	if hasScope(code.Scope, "profile") {
+		id.GivenName, id.FamilyName = user.FirstName, user.LastName
+	}
+
+	idToken, err := e.keys.sign(&id)
+
+	if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "", err}
+	}
+
+	res, err := json.Marshal(map[string]interface{}{
+		"access_token": access,
+		"token_type":   "Bearer",
+		"expires_in":   int(accessTokenLifetime.Seconds()),
+		"id_token":     idToken,
+		"scope":        code.Scope,
+	})
+
+	if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "Error marshalling results", err}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	return httpStatus{http.StatusOK, res, "", nil}
+}
+
+// clientCredentials issues a token for a machine client to call the services
+// behind the proxy. The token carries the granted scopes, which default to
+// all the scopes the client was registered with.
+func clientCredentials(e *Env, w http.ResponseWriter, r *http.Request, client *database.Client) httpStatus {
+	if client.Public {
+		return oauthError(w, http.StatusBadRequest, "unauthorized_client", "Public clients can't use the client_credentials grant")
+	}
+
+	scopes := strings.Fields(r.PostFormValue("scope"))
+	if len(scopes) == 0 {
+		scopes = client.Scopes
+	}
+
+	for _, s := range scopes {
+		if !client.AllowsScope(s) {
+			return oauthError(w, http.StatusBadRequest, "invalid_scope", "The client may not request the scope "+s)
+		}
+	}
+
+	now := time.Now()
+	claims := Claims{
+		Principal: principalClient,
+		ClientID:  client.ID,
+		Scope:     strings.Join(scopes, " "),
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    "server",
+			Subject:   client.ID,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(accessTokenLifetime).Unix(),
+		},
+	}
+
+	access, err := e.keys.sign(&claims)
+
+	if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "", err}
+	}
+
+	res, err := json.Marshal(map[string]interface{}{
+		"access_token": access,
+		"token_type":   "Bearer",
+		"expires_in":   int(accessTokenLifetime.Seconds()),
+		"scope":        claims.Scope,
+	})
+
+	if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "Error marshalling results", err}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	return httpStatus{http.StatusOK, res, "", nil}
+}
+
+func userinfo(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStatus {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		return httpStatus{http.StatusNotFound, nil, http.StatusText(http.StatusNotFound), nil}
+	}
+
+	if issuer() == "" {
+		return noIssuer
+	}
+
+	invalid := func() httpStatus {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		return oauthError(w, http.StatusUnauthorized, "invalid_token", "Invalid access token")
+	}
+
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return invalid()
+	}
+
+	var claims accessClaims
+	token, err := jwt.ParseWithClaims(strings.TrimPrefix(auth, "Bearer "), &claims, e.keys.verificationKey)
+
+	if err != nil || !token.Valid || token.Header["typ"] != "at+jwt" || claims.Issuer != issuer() {
+		return invalid()
+	}
+
+	user, err := e.db.GetUser(claims.Subject)
+
+	if err != nil || user.Disabled || user.Deleted() {
+		return invalid()
+	}
+
+	info := map[string]string{"sub": user.Email}
+	if hasScope(claims.Scope, "email") {
+		info["email"] = user.Email
+	}
+	if hasScope(claims.Scope, "profile") {
+		info["given_name"], info["family_name"] = user.FirstName, user.LastName
+	}
+
+	res, err := json.Marshal(info)
+
+	if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "Error marshalling results", err}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return httpStatus{http.StatusOK, res, "", nil}
+}
+
+// registerClient registers a client as described by RFC 7591. Registration
+// requires the OIDC_REGISTRATION_TOKEN as a bearer token, or a principal
+// with the clients:manage permission.
+func registerClient(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStatus {
+	if r.Method != http.MethodPost {
+		return httpStatus{http.StatusNotFound, nil, http.StatusText(http.StatusNotFound), nil}
+	}
+
+	secret := os.Getenv("OIDC_REGISTRATION_TOKEN")
+	auth := []byte(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	if secret == "" || subtle.ConstantTimeCompare(auth, []byte(secret)) != 1 {
+		if status := authenticate(e, r, c); status.Code != http.StatusOK {
+			return status
+		}
+		if !c.can(permClientsManage) {
+			return missingPermission(w, c, permClientsManage)
+		}
+	}
+
+	var a struct {
+		Name         string   `json:"client_name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		AuthMethod   string   `json:"token_endpoint_auth_method"`
+		GrantTypes   []string `json:"grant_types"`
+		Scope        string   `json:"scope"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		return oauthError(w, http.StatusBadRequest, "invalid_client_metadata", "Could not decode request body")
+	}
+
+	if len(a.GrantTypes) == 0 {
+		a.GrantTypes = []string{"authorization_code"}
+	}
+
+	machine := false
+	for _, g := range a.GrantTypes {
+		switch g {
+		case "authorization_code":
+			if len(a.RedirectURIs) == 0 {
+				return oauthError(w, http.StatusBadRequest, "invalid_redirect_uri", "Please supply redirect_uris")
+			}
+		case "client_credentials":
+			machine = true
+		default:
+			return oauthError(w, http.StatusBadRequest, "invalid_client_metadata", "Unsupported grant type "+g)
+		}
+	}
+
+	for _, uri := range a.RedirectURIs {
+		u, err := url.Parse(uri)
+		if err != nil || u.Fragment != "" || !(u.Scheme == "https" || u.Scheme == "http" && u.Hostname() == "localhost") {
+			return oauthError(w, http.StatusBadRequest, "invalid_redirect_uri", "Redirect URIs must be absolute https URLs without a fragment")
+		}
+	}
+
+	clientSecret := ""
+	switch a.AuthMethod {
+	case "none":
+		if machine {
+			return oauthError(w, http.StatusBadRequest, "invalid_client_metadata", "Machine clients must authenticate with a secret")
+		}
+	case "", "client_secret_basic", "client_secret_post":
+		clientSecret = randomToken(32)
+	default:
+		return oauthError(w, http.StatusBadRequest, "invalid_client_metadata", "Unsupported token_endpoint_auth_method")
+	}
+
+	client, err := database.NewClient(xid.New().String(), a.Name, clientSecret, a.RedirectURIs, a.GrantTypes, strings.Fields(a.Scope))
+
+	if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "", err}
+	}
+
+	if err := e.db.AddClient(client); err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "", err}
+	}
+
+	res, err := json.Marshal(map[string]interface{}{
+		"client_id":           client.ID,
+		"client_secret":       clientSecret,
+		"client_name":         client.Name,
+		"client_id_issued_at": client.CreatedAt.Unix(),
+		"redirect_uris":       client.RedirectURIs,
+		"grant_types":         client.GrantTypes,
+		"scope":               strings.Join(client.Scopes, " "),
+	})
+
+	if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "Error marshalling results", err}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	return httpStatus{http.StatusCreated, res, "", nil}
+}
@@ -0,0 +1,161 @@
+package app
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"secure/database"
+	"strings"
+	"testing"
+
+	"github.com/dchest/uniuri"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	os.Setenv("OIDC_REGISTRATION_TOKEN", "registration")
+	defer os.Unsetenv("OIDC_REGISTRATION_TOKEN")
+
+	discover, _ := http.NewRequest("GET", "/.well-known/openid-configuration", nil)
+	discover.Host = "evil.example.com"
+	assert.Equal(t, http.StatusNotFound, executeRequest(discover).Code, "The issuer should not be taken from the Host")
+	os.Setenv("ISSUER", "https://auth.example.com/")
+	defer os.Unsetenv("ISSUER")
+	response := executeRequest(discover)
+	assert.Equal(t, http.StatusOK, response.Code, "Response should be 200")
+	assert.Contains(t, response.Body.String(), `"issuer":"https://auth.example.com"`)
+
+	register, _ := http.NewRequest("POST", "/clients", bytes.NewBufferString(`{"client_name":"app","redirect_uris":["https://app.example.com/cb"]}`))
+	register.Header.Set("Authorization", "Bearer registration")
+	response = executeRequest(register)
+	assert.Equal(t, http.StatusCreated, response.Code, "Response should be 201")
+
+	var client struct {
+		ID     string `json:"client_id"`
+		Secret string `json:"client_secret"`
+	}
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &client))
+
+	email := strings.ToLower(uniuri.New()) + "@me.com"
+	payload := []byte(`{"email":"` + email + `","password":"` + uniuri.New() + `"}`)
+	signup, _ := http.NewRequest("POST", "/signup", bytes.NewBuffer(payload))
+	cookie := executeRequest(signup).Result().Cookies()[0]
+
+	verifier := uniuri.NewLen(64)
+	challenge := sha256.Sum256([]byte(verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {client.ID},
+		"redirect_uri":          {"https://app.example.com/cb"},
+		"scope":                 {"openid email"},
+		"state":                 {"xyz"},
+		"nonce":                 {"n-0S6"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	authz, _ := http.NewRequest("GET", "/authorize?"+q.Encode(), nil)
+	authz.AddCookie(cookie)
+	response = executeRequest(authz)
+	assert.Equal(t, http.StatusFound, response.Code, "Response should be 302")
+
+	location, _ := url.Parse(response.Header().Get("Location"))
+	assert.Equal(t, "xyz", location.Query().Get("state"))
+	code := location.Query().Get("code")
+	assert.NotEmpty(t, code)
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {"https://app.example.com/cb"},
+		"code_verifier": {verifier},
+	}
+	exchange := func() *http.Response {
+		req, _ := http.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(client.ID, client.Secret)
+		return executeRequest(req).Result()
+	}
+
+	res := exchange()
+	assert.Equal(t, http.StatusOK, res.StatusCode, "Response should be 200")
+
+	var tokens struct {
+		AccessToken string `json:"access_token"`
+		IDToken     string `json:"id_token"`
+	}
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&tokens))
+	assert.NotEmpty(t, tokens.IDToken)
+
+	assert.Equal(t, http.StatusBadRequest, exchange().StatusCode, "Codes should only be redeemable once")
+
+	info, _ := http.NewRequest("GET", "/userinfo", nil)
+	info.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+	response = executeRequest(info)
+	assert.Equal(t, http.StatusOK, response.Code, "Response should be 200")
+	assert.Contains(t, response.Body.String(), `"email":"`+email+`"`)
+
+	proxy, _ := http.NewRequest("GET", "/proxy", nil)
+	proxy.Header.Set("Authorization", "Bearer "+tokens.IDToken)
+	assert.Equal(t, http.StatusUnauthorized, executeRequest(proxy).Code, "ID tokens are not sessions")
+
+	authz, _ = http.NewRequest("GET", "/authorize?"+q.Encode(), nil)
+	authz.AddCookie(cookie)
+	location, _ = url.Parse(executeRequest(authz).Header().Get("Location"))
+	form.Set("code", location.Query().Get("code"))
+
+	_, err := testEnv.db.UpdateUser(email, func(u *database.User) error {
+		u.Disabled = true
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, exchange().StatusCode, "Disabled users should not get tokens")
+	assert.Equal(t, http.StatusUnauthorized, executeRequest(info).Code, "Disabled users should not get their info")
+}
+
+func TestClientCredentials(t *testing.T) {
+	os.Setenv("OIDC_REGISTRATION_TOKEN", "registration")
+	defer os.Unsetenv("OIDC_REGISTRATION_TOKEN")
+
+	defer forwardedUpstream()()
+
+	register, _ := http.NewRequest("POST", "/clients", bytes.NewBufferString(`{"client_name":"job","grant_types":["client_credentials"],"scope":"reports:read reports:write"}`))
+	register.Header.Set("Authorization", "Bearer registration")
+	response := executeRequest(register)
+	assert.Equal(t, http.StatusCreated, response.Code, "Response should be 201")
+
+	var client struct {
+		ID     string `json:"client_id"`
+		Secret string `json:"client_secret"`
+	}
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &client))
+
+	form := url.Values{"grant_type": {"client_credentials"}, "scope": {"reports:read"}}
+	req, _ := http.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(client.ID, client.Secret)
+	response = executeRequest(req)
+	assert.Equal(t, http.StatusOK, response.Code, "Response should be 200")
+
+	var tokens struct {
+		AccessToken string `json:"access_token"`
+		Scope       string `json:"scope"`
+	}
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &tokens))
+	assert.Equal(t, "reports:read", tokens.Scope)
+
+	proxy, _ := http.NewRequest("GET", "/reports", strings.NewReader(""))
+	proxy.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+	response = executeRequest(proxy)
+	assert.Equal(t, `{"type":"client","client_id":"`+client.ID+`","scopes":["reports:read"]}`, response.Body.String())
+
+	form.Set("scope", "admin")
+	req, _ = http.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(client.ID, client.Secret)
+	assert.Equal(t, http.StatusBadRequest, executeRequest(req).Code, "Unregistered scopes should be refused")
+}
@@ -0,0 +1,314 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"secure/database"
+	"strings"
+	"time"
+
+	"github.com/rs/xid"
+)
+
+// orgs lists the organizations of the user and creates new ones
+func orgs(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStatus {
+	switch r.Method {
+	case http.MethodGet:
+		memberships, err := e.db.Memberships(c.User.Email)
+
+		if err != nil {
+			return httpStatus{http.StatusInternalServerError, nil, "", err}
+		}
+
+		type org struct {
+			*database.Organization
+			Role   string `json:"role"`
+			Active bool   `json:"active"`
+		}
+
+		list := make([]org, 0, len(memberships))
+		for _, m := range memberships {
+			o, err := e.db.GetOrganization(m.OrgID)
+			if err != nil {
+				return httpStatus{http.StatusInternalServerError, nil, "", err}
+			}
+			list = append(list, org{o, m.Role, m.OrgID == c.Org})
+		}
+
+		res, err := json.Marshal(results{"success", list})
+
+		if err != nil {
+			return httpStatus{http.StatusInternalServerError, nil, "Error marshalling results", err}
+		}
+
+		return httpStatus{http.StatusOK, res, "", nil}
+	case http.MethodPost:
+		var a struct {
+			Name string
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+			return httpStatus{http.StatusBadRequest, nil, "Could not decode request body", err}
+		}
+
+		if strings.TrimSpace(a.Name) == "" {
+			return httpStatus{http.StatusBadRequest, nil, "Please supply a name", nil}
+		}
+
+		o := database.NewOrganization(xid.New().String(), strings.TrimSpace(a.Name))
+
+		if err := e.db.AddOrganization(o); err != nil {
+			return httpStatus{http.StatusInternalServerError, nil, "", err}
+		}
+
+		if err := e.db.AddMembership(database.NewMembership(o.ID, c.User.Email, database.OrgOwner)); err != nil {
+			return httpStatus{http.StatusInternalServerError, nil, "", err}
+		}
+
+		res, err := json.Marshal(result{"success", o})
+
+		if err != nil {
+			return httpStatus{http.StatusInternalServerError, nil, "Error marshalling results", err}
+		}
+
+		return httpStatus{http.StatusOK, res, "", nil}
+	}
+	return httpStatus{http.StatusNotFound, nil, http.StatusText(http.StatusNotFound), nil}
+}
+
+// org handles /orgs/switch, /orgs/<id>/members and /orgs/<id>/invitations
+func org(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStatus {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/orgs/"), "/"), "/")
+
+	switch {
+	case len(parts) == 1 && parts[0] == "switch" && r.Method == http.MethodPost:
+		return switchOrg(e, w, r, c)
+	case len(parts) == 2 && parts[1] == "members" && r.Method == http.MethodGet:
+		return orgMembers(e, w, c, parts[0])
+	case len(parts) == 2 && parts[1] == "invitations" && r.Method == http.MethodPost:
+		return invite(e, w, r, c, parts[0])
+	case len(parts) == 2 && parts[1] == "usage":
+		return orgUsage(e, w, r, c, parts[0])
+	}
+	return httpStatus{http.StatusNotFound, nil, http.StatusText(http.StatusNotFound), nil}
+}
+
+// orgRole returns the role of the user in the organization. Principals with
+// the orgs:manage permission act as owners of every organization.
+func orgRole(e *Env, c *context, orgID string) string {
+	if c.can(permOrgsManage) {
+		return database.OrgOwner
+	}
+
+	m, err := e.db.GetMembership(orgID, c.User.Email)
+	if err != nil {
+		return ""
+	}
+	return m.Role
+}
+
+func notOrgMember(w http.ResponseWriter, c *context) httpStatus {
+	return forbidden(w, forbiddenReason{
+		Code:      "not_org_member",
+		Principal: c.Principal,
+		Message:   "The user is not a member of the organization",
+	})
+}
+
+func orgMembers(e *Env, w http.ResponseWriter, c *context, orgID string) httpStatus {
+	if orgRole(e, c, orgID) == "" {
+		return notOrgMember(w, c)
+	}
+
+	members, err := e.db.OrgMembers(orgID)
+
+	if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "", err}
+	}
+
+	res, err := json.Marshal(results{"success", members})
+
+	if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "Error marshalling results", err}
+	}
+
+	return httpStatus{http.StatusOK, res, "", nil}
+}
+
+// invite emails an invitation to join the organization. Owners can invite
+// any role, admins can invite admins and members.
+func invite(e *Env, w http.ResponseWriter, r *http.Request, c *context, orgID string) httpStatus {
+	role := orgRole(e, c, orgID)
+	if role == "" {
+		return notOrgMember(w, c)
+	}
+
+	var a struct {
+		Email string
+		Role  string
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		return httpStatus{http.StatusBadRequest, nil, "Could not decode request body", err}
+	}
+
+	if a.Role == "" {
+		a.Role = database.OrgMember
+	}
+
+	a.Email = database.NormalizeEmail(a.Email)
+	if a.Email == "" || !database.ValidOrgRole(a.Role) {
+		return httpStatus{http.StatusBadRequest, nil, "Please supply an email and a valid role", nil}
+	}
+
+	if role == database.OrgMember || (role == database.OrgAdmin && a.Role == database.OrgOwner) {
+		return forbidden(w, forbiddenReason{
+			Code:      "org_role_required",
+			Principal: c.Principal,
+			Message:   "The user's role in the organization can't invite a " + a.Role,
+		})
+	}
+
+	o, err := e.db.GetOrganization(orgID)
+
+	if err != nil {
+		return httpStatus{http.StatusNotFound, nil, "Unknown organization", err}
+	}
+
+	// the link is never taken from the Host of the request, which whoever
+	// sends it sets
+	link := os.Getenv("INVITATION_URL")
+	if link == "" && issuer() != "" {
+		link = issuer() + "/invitations/accept"
+	}
+	if link == "" {
+		return httpStatus{http.StatusInternalServerError, nil, "Invitations need INVITATION_URL or ISSUER to be set", nil}
+	}
+
+	token := randomToken(32)
+	now := time.Now()
+	err = e.db.AddInvitation(&database.Invitation{
+		ID:        hashToken(token),
+		OrgID:     o.ID,
+		Email:     a.Email,
+		Role:      a.Role,
+		InvitedBy: c.User.Email,
+		ExpiresAt: now.Add(envDuration("INVITATION_LIFETIME", 7*24*time.Hour)),
+	})
+
+	if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "", err}
+	}
+
+	link += "?" + url.Values{"token": {token}}.Encode()
+
+	body := c.User.Email + " has invited you to join " + o.Name + ".\n\n" +
+		"Log in or sign up as " + a.Email + " and accept the invitation at\n" + link + "\n"
+
+	if err := e.mail.Send(a.Email, "You've been invited to join "+o.Name, body); err != nil {
+		return httpStatus{http.StatusBadGateway, nil, "Could not send the invitation", err}
+	}
+
+	return httpStatus{http.StatusOK, []byte(`{"status":"success"}`), "", nil}
+}
+
+// acceptInvitation makes the logged in user a member of the organization they
+// were invited to. The token is taken from the query or a JSON body.
+func acceptInvitation(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStatus {
+	token := r.URL.Query().Get("token")
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var a struct {
+			Token string
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+			return httpStatus{http.StatusBadRequest, nil, "Could not decode request body", err}
+		}
+		token = a.Token
+	default:
+		return httpStatus{http.StatusNotFound, nil, http.StatusText(http.StatusNotFound), nil}
+	}
+
+	inv, err := e.db.RedeemInvitation(hashToken(token))
+
+	if err != nil {
+		return httpStatus{http.StatusNotFound, nil, "Invalid or expired invitation", err}
+	}
+
+	if database.NormalizeEmail(inv.Email) != database.NormalizeEmail(c.User.Email) {
+		// put the invitation back for the user it was meant for
+		if err := e.db.AddInvitation(inv); err != nil {
+			return httpStatus{http.StatusInternalServerError, nil, "", err}
+		}
+		return forbidden(w, forbiddenReason{
+			Code:      "invitation_email_mismatch",
+			Principal: c.Principal,
+			Message:   "The invitation was sent to another email",
+		})
+	}
+
+	m, err := e.db.GetMembership(inv.OrgID, c.User.Email)
+	if err != nil {
+		m = database.NewMembership(inv.OrgID, c.User.Email, inv.Role)
+		if err := e.db.AddMembership(m); err != nil {
+			return httpStatus{http.StatusInternalServerError, nil, "", err}
+		}
+	}
+
+	res, err := json.Marshal(result{"success", m})
+
+	if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "Error marshalling results", err}
+	}
+
+	return httpStatus{http.StatusOK, res, "", nil}
+}
+
+// switchOrg makes another organization of the user the active one, issuing
+// a new token carrying it. An empty org_id leaves every organization.
+func switchOrg(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStatus {
+	if c.Principal != principalUser {
+		return forbidden(w, forbiddenReason{
+			Code:      "user_session_required",
+			Principal: c.Principal,
+			Message:   "Only a logged in user can switch organization",
+		})
+	}
+
+	var a struct {
+		OrgID string `json:"org_id"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		return httpStatus{http.StatusBadRequest, nil, "Could not decode request body", err}
+	}
+
+	c.Org, c.OrgRole = "", ""
+	if a.OrgID != "" {
+		m, err := e.db.GetMembership(a.OrgID, c.User.Email)
+		if err != nil {
+			return notOrgMember(w, c)
+		}
+		c.Org, c.OrgRole = m.OrgID, m.Role
+	}
+
+	if err := issueToken(e, w, c); err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "", err}
+	}
+
+	res, err := json.Marshal(result{"success", struct {
+		Org     string `json:"org"`
+		OrgRole string `json:"org_role"`
+	}{c.Org, c.OrgRole}})
+
+	if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "Error marshalling results", err}
+	}
+
+	return httpStatus{http.StatusOK, res, "", nil}
+}
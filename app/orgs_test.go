@@ -0,0 +1,107 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"secure/database"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrganizations(t *testing.T) {
+	defer forwardedUpstream()()
+
+	owner, ownerCookie := signupUser()
+	member, memberCookie := signupUser()
+
+	create, _ := http.NewRequest("POST", "/orgs", bytes.NewBufferString(`{"name":"Acme"}`))
+	create.AddCookie(ownerCookie)
+	response := executeRequest(create)
+	assert.Equal(t, http.StatusOK, response.Code, "Response should be 200")
+
+	var org struct {
+		Result struct {
+			ID string `json:"id"`
+		} `json:"result"`
+	}
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &org))
+	assert.NotEmpty(t, org.Result.ID)
+
+	inviteAs := func(cookie *http.Cookie, email string) int {
+		req, _ := http.NewRequest("POST", "/orgs/"+org.Result.ID+"/invitations", bytes.NewBufferString(`{"email":"`+email+`","role":"admin"}`))
+		req.AddCookie(cookie)
+		return executeRequest(req).Code
+	}
+	assert.Equal(t, http.StatusInternalServerError, inviteAs(ownerCookie, member), "Invitation links should not be taken from the Host")
+	os.Setenv("ISSUER", "https://auth.example.com")
+	defer os.Unsetenv("ISSUER")
+
+	assert.Equal(t, http.StatusForbidden, inviteAs(memberCookie, member), "Non members can't invite")
+	assert.Equal(t, http.StatusOK, inviteAs(ownerCookie, member), "Response should be 200")
+
+	link := regexp.MustCompile(`https?://\S+`).FindString(testMail.last(member))
+	assert.True(t, strings.HasPrefix(link, "https://auth.example.com/invitations/accept?"))
+	u, err := url.Parse(link)
+	assert.NoError(t, err)
+	token := u.Query().Get("token")
+	assert.NotEmpty(t, token)
+
+	accept := func(cookie *http.Cookie) int {
+		req, _ := http.NewRequest("POST", "/invitations/accept", bytes.NewBufferString(`{"token":"`+token+`"}`))
+		req.AddCookie(cookie)
+		return executeRequest(req).Code
+	}
+	assert.Equal(t, http.StatusForbidden, accept(ownerCookie), "Invitations are for the invited email")
+	assert.Equal(t, http.StatusOK, accept(memberCookie), "Response should be 200")
+	assert.Equal(t, http.StatusNotFound, accept(memberCookie), "Invitations can only be accepted once")
+
+	members, _ := http.NewRequest("GET", "/orgs/"+org.Result.ID+"/members", nil)
+	members.AddCookie(memberCookie)
+	response = executeRequest(members)
+	assert.Contains(t, response.Body.String(), owner)
+	assert.Contains(t, response.Body.String(), member)
+
+	switchOrg, _ := http.NewRequest("POST", "/orgs/switch", bytes.NewBufferString(`{"org_id":"`+org.Result.ID+`"}`))
+	switchOrg.AddCookie(memberCookie)
+	response = executeRequest(switchOrg)
+	assert.Equal(t, http.StatusOK, response.Code, "Response should be 200")
+
+	orgCookie := response.Result().Cookies()[0]
+	proxy, _ := http.NewRequest("GET", "/proxy", strings.NewReader(""))
+	proxy.AddCookie(orgCookie)
+	response = executeRequest(proxy)
+	assert.Contains(t, response.Body.String(), `"org":"`+org.Result.ID+`","org_role":"admin"`)
+
+	assert.NoError(t, testEnv.db.AddMembership(database.NewMembership(org.Result.ID, member, database.OrgMember)))
+	proxy, _ = http.NewRequest("GET", "/proxy", strings.NewReader(""))
+	proxy.AddCookie(orgCookie)
+	response = executeRequest(proxy)
+	assert.Contains(t, response.Body.String(), `"org":"`+org.Result.ID+`","org_role":"member"`, "The role should be the one the user has now")
+}
+
+func TestCaseVariantSignup(t *testing.T) {
+	owner, ownerCookie := signupUser()
+
+	create, _ := http.NewRequest("POST", "/orgs", bytes.NewBufferString(`{"name":"Acme"}`))
+	create.AddCookie(ownerCookie)
+	assert.Equal(t, http.StatusOK, executeRequest(create).Code, "Response should be 200")
+
+	variant := " " + strings.ToUpper(owner)
+	signup, _ := http.NewRequest("POST", "/signup", bytes.NewBufferString(`{"email":"`+variant+`","password":"secret"}`))
+	response := executeRequest(signup)
+	assert.Equal(t, http.StatusBadRequest, response.Code, "Emails differing in case are the same user")
+	assert.Empty(t, response.Result().Cookies(), "Case variants should not get a session")
+
+	memberships, err := testEnv.db.Memberships(variant)
+	assert.NoError(t, err)
+	assert.Len(t, memberships, 1)
+	users, _, err := testEnv.db.ListUsers(owner, 0, 0)
+	assert.NoError(t, err)
+	assert.Len(t, users, 1, "There should be a single user for the email")
+}
@@ -0,0 +1,265 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// policyRule matches requests on method, path and host, and principals on
+// roles, scopes, email domain and claims. Every condition that is set must
+// match; a list matches when any of its values do.
+type policyRule struct {
+	Name         string            `json:"name"`
+	Effect       string            `json:"effect"`
+	Methods      []string          `json:"methods"`
+	Path         string            `json:"path"`
+	Host         string            `json:"host"`
+	Roles        []string          `json:"roles"`
+	Scopes       []string          `json:"scopes"`
+	EmailDomains []string          `json:"email_domains"`
+	Claims       map[string]string `json:"claims"`
+
+	path *regexp.Regexp
+	host *regexp.Regexp
+}
+
+// policy is the authorization policy for proxied requests, loaded from the
+// POLICY_FILE. The first matching rule decides; requests matching no rule
+// get the default effect, which is deny unless set to allow. In dry run the
+// decisions are logged but not enforced.
+type policy struct {
+	Default string       `json:"default"`
+	DryRun  bool         `json:"dry_run"`
+	Rules   []policyRule `json:"rules"`
+}
+
+// policies holds the current policy, which is swapped when its file changes
+type policies struct {
+	sync.RWMutex
+	current *policy
+}
+
+func (p *policies) get() *policy {
+	p.RLock()
+	defer p.RUnlock()
+	return p.current
+}
+
+func (p *policies) load(b []byte) error {
+	pol, err := parsePolicy(b)
+	if err != nil {
+		return err
+	}
+
+	p.Lock()
+	p.current = pol
+	p.Unlock()
+	return nil
+}
+
+func parsePolicy(b []byte) (*policy, error) {
+	var p policy
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, err
+	}
+
+	switch p.Default {
+	case "":
+		p.Default = "deny"
+	case "allow", "deny":
+	default:
+		return nil, fmt.Errorf("Invalid policy default %s", p.Default)
+	}
+
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if rule.Effect != "allow" && rule.Effect != "deny" {
+			return nil, fmt.Errorf("Invalid effect %s for policy rule %d", rule.Effect, i)
+		}
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule %d", i)
+		}
+		if rule.Path != "" {
+			rule.path = glob(rule.Path, "/")
+		}
+		if rule.Host != "" {
+			rule.host = glob(rule.Host, ".")
+		}
+	}
+
+	return &p, nil
+}
+
+// glob compiles a pattern where * matches within a sep separated segment and
+// ** across segments
+func glob(pattern, sep string) *regexp.Regexp {
+	segment := "[^" + regexp.QuoteMeta(sep) + "]*"
+	parts := strings.Split(pattern, "**")
+	for i, part := range parts {
+		parts[i] = strings.Replace(regexp.QuoteMeta(part), `\*`, segment, -1)
+	}
+	return regexp.MustCompile("^" + strings.Join(parts, ".*") + "$")
+}
+
+// evaluate returns the name of the rule that decided and if it allowed the
+// request
+func (p *policy) evaluate(r *http.Request, c *context) (string, bool) {
+	for _, rule := range p.Rules {
+		if rule.matches(r, c) {
+			return rule.Name, rule.Effect == "allow"
+		}
+	}
+	return "default", p.Default == "allow"
+}
+
+func (rule *policyRule) matches(r *http.Request, c *context) bool {
+	if len(rule.Methods) > 0 && !containsFold(rule.Methods, r.Method) {
+		return false
+	}
+
+	if rule.path != nil && !rule.path.MatchString(r.URL.Path) {
+		return false
+	}
+
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	if rule.host != nil && !rule.host.MatchString(strings.ToLower(host)) {
+		return false
+	}
+
+	if len(rule.Roles) > 0 && !containsAny(rule.Roles, c.roles()) {
+		return false
+	}
+
+	if len(rule.Scopes) > 0 && !containsAny(rule.Scopes, c.Scopes) {
+		return false
+	}
+
+	if len(rule.EmailDomains) > 0 {
+		at := strings.LastIndex(c.User.Email, "@")
+		if at < 0 || !containsFold(rule.EmailDomains, c.User.Email[at+1:]) {
+			return false
+		}
+	}
+
+	if len(rule.Claims) > 0 {
+		claims := c.claims()
+		for k, v := range rule.Claims {
+			if !claimMatches(claims[k], v) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// claims returns the identity forwarded upstream as a map, for matching on
+func (c *context) claims() map[string]interface{} {
+	claims := map[string]interface{}{}
+	b, _ := json.Marshal(c.forwarded())
+	json.Unmarshal(b, &claims)
+	return claims
+}
+
+func claimMatches(claim interface{}, v string) bool {
+	if list, ok := claim.([]interface{}); ok {
+		for _, item := range list {
+			if fmt.Sprint(item) == v {
+				return true
+			}
+		}
+		return false
+	}
+	return claim != nil && fmt.Sprint(claim) == v
+}
+
+func containsFold(list []string, s string) bool {
+	for _, l := range list {
+		if strings.EqualFold(l, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAny(list, values []string) bool {
+	for _, v := range values {
+		for _, l := range list {
+			if l == v {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// enforcePolicy authorizes a request against the policy before handing it
+// on
+func enforcePolicy(h hFunc) hFunc {
+	return func(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStatus {
+		p := e.policies.get()
+		if p == nil {
+			return h(e, w, r, c)
+		}
+
+		rule, allowed := p.evaluate(r, c)
+
+		if p.DryRun {
+			go e.l.LogPolicyDecision(r, c.id(), rule, allowed, false)
+			return h(e, w, r, c)
+		}
+
+		if !allowed {
+			go e.l.LogPolicyDecision(r, c.id(), rule, allowed, true)
+			return forbidden(w, forbiddenReason{
+				Code:      "policy_denied",
+				Rule:      rule,
+				Principal: c.Principal,
+				Message:   "The request is not allowed by the policy",
+			})
+		}
+
+		return h(e, w, r, c)
+	}
+}
+
+// watchFile calls load with the contents of the file whenever it changes.
+// Errors are logged and the last good version is kept.
+func watchFile(e *Env, path string, interval time.Duration, load func([]byte) error) {
+	var modified time.Time
+	if info, err := os.Stat(path); err == nil {
+		modified = info.ModTime()
+	}
+
+	for range time.Tick(interval) {
+		info, err := os.Stat(path)
+		if err != nil {
+			e.l.LogError(err, "")
+			continue
+		}
+
+		if info.ModTime().Equal(modified) {
+			continue
+		}
+		modified = info.ModTime()
+
+		b, err := ioutil.ReadFile(path)
+		if err == nil {
+			err = load(b)
+		}
+		if err != nil {
+			e.l.LogError(fmt.Errorf("Could not reload %s: %v", path, err), "")
+		}
+	}
+}
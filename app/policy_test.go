@@ -0,0 +1,40 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPolicy(t *testing.T) {
+	defer forwardedUpstream()()
+	defer func() { testEnv.policies.current = nil }()
+
+	assert.NoError(t, testEnv.policies.load([]byte(`{
+		"default": "deny",
+		"rules": [
+			{"name": "no-deletes", "effect": "deny", "methods": ["DELETE"], "path": "/reports/**"},
+			{"name": "reports", "effect": "allow", "path": "/reports/**", "email_domains": ["me.com"]},
+			{"name": "admin", "effect": "allow", "path": "/admin/*", "roles": ["admin"]}
+		]
+	}`)))
+
+	_, cookie := signupUser()
+	request := func(method, path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, strings.NewReader(""))
+		req.AddCookie(cookie)
+		return executeRequest(req)
+	}
+
+	assert.Equal(t, http.StatusOK, request("GET", "/reports/2019/jan").Code)
+	assert.Equal(t, http.StatusForbidden, request("DELETE", "/reports/2019/jan").Code)
+	assert.Contains(t, request("DELETE", "/reports/2019").Body.String(), `"rule":"no-deletes"`)
+	assert.Equal(t, http.StatusForbidden, request("GET", "/admin/settings").Code)
+	assert.Contains(t, request("GET", "/other").Body.String(), `"rule":"default"`)
+
+	assert.NoError(t, testEnv.policies.load([]byte(`{"default": "deny", "dry_run": true}`)))
+	assert.Equal(t, http.StatusOK, request("GET", "/other").Code, "Dry run should not enforce")
+}
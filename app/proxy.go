@@ -0,0 +1,514 @@
+package app
+
+import (
+	"bufio"
+	gocontext "context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"secure/identity"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// proxyTransport is shared by all the requests to upstreams, so that their
+// connections are pooled
+var proxyTransport = &http.Transport{
+	Proxy:                 http.ProxyFromEnvironment,
+	DialContext:           dialProxy,
+	MaxIdleConns:          100,
+	MaxIdleConnsPerHost:   32,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ExpectContinueTimeout: time.Second,
+}
+
+// stripCookie removes the cookie from the Cookie headers, keeping the others
+func stripCookie(h http.Header, name string) {
+	var kept []string
+	for _, line := range h["Cookie"] {
+		for _, part := range strings.Split(line, ";") {
+			part = strings.TrimSpace(part)
+			if part != "" && !strings.HasPrefix(part, name+"=") {
+				kept = append(kept, part)
+			}
+		}
+	}
+
+	h.Del("Cookie")
+	if len(kept) > 0 {
+		h.Set("Cookie", strings.Join(kept, "; "))
+	}
+}
+
+// stripSetCookie removes the Set-Cookie headers of the cookie, keeping the
+// others
+func stripSetCookie(h http.Header, name string) {
+	cookies := h["Set-Cookie"]
+	h.Del("Set-Cookie")
+	for _, cookie := range cookies {
+		if !strings.HasPrefix(strings.TrimSpace(cookie), name+"=") {
+			h.Add("Set-Cookie", cookie)
+		}
+	}
+}
+
+// hopHeaders are the hop-by-hop headers, which are meant for a single
+// connection and not forwarded
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders removes the hop-by-hop headers, and the ones listed in
+// the Connection header
+func removeHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// isUpgrade checks if the client asks to switch protocols, as WebSockets do
+func isUpgrade(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range r.Header["Connection"] {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// proxyTimeout is how long the upstream has to send the headers of its
+// response once it has the whole request
+func proxyTimeout() time.Duration {
+	return envDuration("PROXY_TIMEOUT", 30*time.Second)
+}
+
+// proxyIdleTimeout is how long the bodies of requests and responses can go
+// without a byte before the request is given up, with no limit when 0
+func proxyIdleTimeout() time.Duration {
+	return envDuration("PROXY_IDLE_TIMEOUT", time.Minute)
+}
+
+// proxyStreamTimeout is how long WebSockets and event streams can stay
+// open, with no limit by default
+func proxyStreamTimeout() time.Duration {
+	return envDuration("PROXY_STREAM_TIMEOUT", 0)
+}
+
+// flushWriter flushes every write once streaming, so that events reach the
+// client as soon as the upstream sends them
+type flushWriter struct {
+	http.ResponseWriter
+	flush bool
+	idle  *idleTimer
+}
+
+func (w *flushWriter) Write(b []byte) (int, error) {
+	w.idle.touch()
+	n, err := w.ResponseWriter.Write(b)
+	if f, ok := w.ResponseWriter.(http.Flusher); ok && w.flush {
+		f.Flush()
+	}
+	return n, err
+}
+
+// proxy sends the request to the upstream of its route, unless its circuit
+// breaker is open, and records the outcome in the breaker and the metrics
+func proxy(e *Env, w http.ResponseWriter, r *http.Request, c *context, route *upstreamRoute) httpStatus {
+	var status httpStatus
+	if route.breaker.allow() {
+		// the outcome is recorded as soon as the upstream answers, so that a
+		// trial that opens a stream doesn't hold the breaker until it closes
+		var once sync.Once
+		settle := func(code int) {
+			once.Do(func() {
+				// clients going away is not the fault of the upstream
+				failed := retryableStatus(code) && r.Context().Err() == nil
+				if route.breaker.record(!failed) {
+					e.metrics.inc("gateway_circuit_breaker_open_total", "route", route.Name)
+				}
+			})
+		}
+		status = forward(e, w, r, c, route, settle)
+		settle(status.Code)
+	} else {
+		e.metrics.inc("gateway_upstream_rejected_total", "route", route.Name)
+		status = httpStatus{http.StatusServiceUnavailable, nil, "The upstream is unavailable, try again later", nil}
+	}
+
+	e.metrics.inc("gateway_upstream_requests_total", "route", route.Name, "code", strconv.Itoa(status.Code))
+	return status
+}
+
+// forward streams the request to a target of its route, with the identity
+// of the principal in X-Forwarded-User or a signed assertion, and streams its
+// response back. Hop-by-hop headers are dropped both ways. Event streams and
+// upgraded connections stay open until the session they were opened with is
+// revoked. settle is called with the status of the upstream once it answers.
+func forward(e *Env, w http.ResponseWriter, r *http.Request, c *context, route *upstreamRoute, settle func(int)) httpStatus {
+	var fwd []byte
+	var assertion string
+	if c.Principal != "" {
+		var err error
+		if route.Assertion == nil || route.Assertion.ForwardUser {
+			if fwd, err = json.Marshal(c.forwarded()); err != nil {
+				return httpStatus{http.StatusInternalServerError, nil, "Error marshalling results", err}
+			}
+		}
+		if route.Assertion != nil {
+			if assertion, err = route.Assertion.sign(e, r, c); err != nil {
+				return httpStatus{http.StatusInternalServerError, nil, "", err}
+			}
+		}
+	}
+
+	// the target is set by the transport, or proxyUpgrade
+	director := func(req *http.Request) {
+		// the upstream gets the session as X-Forwarded-User, not the token
+		// or API key, which would be good for every route and the admin API
+		stripCookie(req.Header, "jwt")
+		if c.Principal != "" {
+			req.Header.Del("Authorization")
+			req.Header.Del("X-API-Key")
+		}
+		route.RequestHeaders.apply(req.Header)
+
+		// this is the edge, so the forwarding headers of clients aren't
+		// trusted. X-Forwarded-For is set to the client by the proxy.
+		req.Header.Del("X-Forwarded-For")
+		req.Header.Set("X-Forwarded-Host", r.Host)
+		req.Header.Set("X-Forwarded-Proto", "http")
+		if r.TLS != nil {
+			req.Header.Set("X-Forwarded-Proto", "https")
+		}
+
+		req.Header.Del("X-Forwarded-User")
+		req.Header.Del("X-Forwarded-Org")
+		req.Header.Del("X-Forwarded-Org-Role")
+		req.Header.Del(identity.Header)
+		if fwd != nil {
+			req.Header.Set("X-Forwarded-User", string(fwd))
+			if c.Org != "" {
+				req.Header.Set("X-Forwarded-Org", c.Org)
+				req.Header.Set("X-Forwarded-Org-Role", c.OrgRole)
+			}
+		}
+		if assertion != "" {
+			req.Header.Set(identity.Header, assertion)
+		}
+	}
+
+	if isUpgrade(r) {
+		t := route.pick(r, c, nil)
+		if t == nil {
+			return httpStatus{http.StatusServiceUnavailable, nil, errNoUpstream.Error(), nil}
+		}
+		atomic.AddInt64(&t.active, 1)
+		defer atomic.AddInt64(&t.active, -1)
+		return proxyUpgrade(e, w, r, c, route, t, director, settle)
+	}
+
+	ctx, cancel := gocontext.WithCancel(r.Context())
+	defer cancel()
+
+	var timedOut int32
+	expire := func() {
+		atomic.StoreInt32(&timedOut, 1)
+		cancel()
+	}
+
+	// requests only have a total deadline when their route has a timeout, so
+	// that long uploads and downloads go through as long as bytes flow
+	var deadline *time.Timer
+	if route.timeout > 0 {
+		deadline = time.AfterFunc(route.timeout, expire)
+	}
+	idle := &idleTimer{timeout: proxyIdleTimeout(), expire: expire}
+	untrack := func() {}
+	defer func() {
+		if deadline != nil {
+			deadline.Stop()
+		}
+		idle.stop()
+		untrack()
+	}()
+
+	out := r.WithContext(ctx)
+	if r.ContentLength != 0 && r.Body != nil && r.Body != http.NoBody {
+		out.Body = &idleBody{ReadCloser: r.Body, idle: idle}
+		idle.touch()
+	}
+
+	fw := &flushWriter{ResponseWriter: w, idle: idle}
+	status := httpStatus{http.StatusBadGateway, nil, "", nil}
+	rp := &httputil.ReverseProxy{
+		Transport: &upstreamTransport{e, route, r, c},
+		Director:  director,
+		ModifyResponse: func(res *http.Response) error {
+			// upstreams can't replace the session of the user
+			stripSetCookie(res.Header, "jwt")
+			route.ResponseHeaders.apply(res.Header)
+
+			if strings.HasPrefix(res.Header.Get("Content-Type"), "text/event-stream") {
+				if deadline != nil {
+					deadline.Stop()
+				}
+				idle.stop()
+				if t := proxyStreamTimeout(); t > 0 {
+					deadline = time.AfterFunc(t, cancel)
+				}
+				if c.Principal == principalUser {
+					untrack = e.streams.add(c.User.Email, c.Session, cancel)
+				}
+				fw.flush = true
+			}
+
+			idle.touch()
+			status.Code = res.StatusCode
+			settle(res.StatusCode)
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			status.Code, status.FuncErr = http.StatusBadGateway, err
+			result := http.StatusText(status.Code)
+			switch {
+			case err == errNoUpstream:
+				status.Code, status.FuncErr, result = http.StatusServiceUnavailable, nil, err.Error()
+			case err == errResponseHeaderTimeout || atomic.LoadInt32(&timedOut) == 1:
+				status.Code, result = http.StatusGatewayTimeout, http.StatusText(http.StatusGatewayTimeout)
+			}
+			http.Error(w, `{"status":"failure","result":"`+result+`"}`, status.Code)
+		},
+	}
+
+	rp.ServeHTTP(fw, out)
+	return status
+}
+
+// idleTimer calls expire when it is not touched for the timeout, once it
+// has been touched
+type idleTimer struct {
+	mu      sync.Mutex
+	timeout time.Duration
+	expire  func()
+	timer   *time.Timer
+	stopped bool
+}
+
+// touch restarts the timer, unless it was stopped for good
+func (it *idleTimer) touch() {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	switch {
+	case it.stopped || it.timeout <= 0:
+	case it.timer == nil:
+		it.timer = time.AfterFunc(it.timeout, it.expire)
+	default:
+		it.timer.Reset(it.timeout)
+	}
+}
+
+// pause stops the timer until it is touched again
+func (it *idleTimer) pause() {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	if it.timer != nil {
+		it.timer.Stop()
+	}
+}
+
+// stop stops the timer for good
+func (it *idleTimer) stop() {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	it.stopped = true
+	if it.timer != nil {
+		it.timer.Stop()
+	}
+}
+
+// idleBody touches the idle timer as the request body is read, and pauses
+// it once it has all been read, as the upstream is then answering
+type idleBody struct {
+	io.ReadCloser
+	idle *idleTimer
+}
+
+func (b *idleBody) Read(p []byte) (int, error) {
+	b.idle.touch()
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.idle.pause()
+	}
+	return n, err
+}
+
+// proxyUpgrade forwards a request to switch protocols, and splices the
+// connection of the client to the upstream once it agrees
+func proxyUpgrade(e *Env, w http.ResponseWriter, r *http.Request, c *context, route *upstreamRoute, t *target, director func(*http.Request), settle func(int)) httpStatus {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return httpStatus{http.StatusInternalServerError, nil, "Upgrades are not supported", nil}
+	}
+
+	out := r.WithContext(r.Context())
+	out.Header = http.Header{}
+	for k, v := range r.Header {
+		out.Header[k] = v
+	}
+	director(out)
+	route.direct(out, t, r.URL.Path)
+	removeHopHeaders(out.Header)
+	out.Header.Set("Connection", "Upgrade")
+	out.Header.Set("Upgrade", r.Header.Get("Upgrade"))
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		out.Header.Set("X-Forwarded-For", ip)
+	}
+
+	ctx, cancel := gocontext.WithTimeout(r.Context(), route.headerTimeout())
+	defer cancel()
+
+	upstream, err := dialUpstream(gocontext.WithValue(ctx, connectTimeoutKey{}, route.connectTimeout), t.url)
+	if err != nil {
+		t.report(err, route.Outlier)
+		return httpStatus{http.StatusBadGateway, nil, http.StatusText(http.StatusBadGateway), err}
+	}
+
+	// the upstream has until the timeout to agree to switch
+	handshake := time.AfterFunc(route.headerTimeout(), func() { upstream.Close() })
+
+	br := bufio.NewReader(upstream)
+	err = out.Write(upstream)
+	var res *http.Response
+	if err == nil {
+		res, err = http.ReadResponse(br, out)
+	}
+	if !handshake.Stop() || err != nil {
+		t.report(fmt.Errorf("Upgrade failed: %v", err), route.Outlier)
+		upstream.Close()
+		return httpStatus{http.StatusBadGateway, nil, http.StatusText(http.StatusBadGateway), err}
+	}
+
+	t.report(nil, route.Outlier)
+	settle(res.StatusCode)
+	// whether they switch or not, upstreams can't replace the session of
+	// the user
+	stripSetCookie(res.Header, "jwt")
+
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		defer upstream.Close()
+		defer res.Body.Close()
+
+		removeHopHeaders(res.Header)
+		route.ResponseHeaders.apply(res.Header)
+		for k, v := range res.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(res.StatusCode)
+		io.Copy(w, res.Body)
+		return httpStatus{res.StatusCode, nil, "", nil}
+	}
+
+	client, buf, err := hj.Hijack()
+	if err != nil {
+		upstream.Close()
+		return httpStatus{http.StatusInternalServerError, nil, "", err}
+	}
+
+	// the timeouts of the server don't apply to the spliced connection
+	client.SetDeadline(time.Time{})
+
+	var once sync.Once
+	closeBoth := func() {
+		once.Do(func() {
+			client.Close()
+			upstream.Close()
+		})
+	}
+	defer closeBoth()
+
+	if c.Principal == principalUser {
+		defer e.streams.add(c.User.Email, c.Session, closeBoth)()
+	}
+	if t := proxyStreamTimeout(); t > 0 {
+		defer time.AfterFunc(t, closeBoth).Stop()
+	}
+
+	if _, err := io.WriteString(client, "HTTP/1.1 101 Switching Protocols\r\n"); err != nil {
+		return httpStatus{http.StatusSwitchingProtocols, nil, "", err}
+	}
+	route.ResponseHeaders.apply(res.Header)
+	if err := res.Header.Write(client); err != nil {
+		return httpStatus{http.StatusSwitchingProtocols, nil, "", err}
+	}
+	if _, err := io.WriteString(client, "\r\n"); err != nil {
+		return httpStatus{http.StatusSwitchingProtocols, nil, "", err}
+	}
+
+	// the readers hold what either side sent before the switch
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, buf)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(client, br)
+		done <- struct{}{}
+	}()
+	<-done
+
+	return httpStatus{http.StatusSwitchingProtocols, nil, "", nil}
+}
+
+// dialUpstream connects to the upstream, over TLS for https ones
+func dialUpstream(ctx gocontext.Context, target *url.URL) (net.Conn, error) {
+	port := target.Port()
+	if port == "" {
+		port = "80"
+		if target.Scheme == "https" {
+			port = "443"
+		}
+	}
+
+	conn, err := proxyTransport.DialContext(ctx, "tcp", net.JoinHostPort(target.Hostname(), port))
+	if err != nil || target.Scheme != "https" {
+		return conn, err
+	}
+
+	// the handshake happens on the first write, within the timeout of the
+	// upgrade
+	config := &tls.Config{}
+	if proxyTransport.TLSClientConfig != nil {
+		config = proxyTransport.TLSClientConfig.Clone()
+	}
+	config.ServerName = target.Hostname()
+	return tls.Client(conn, config), nil
+}
@@ -0,0 +1,114 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyStreamsRequestsAndResponses(t *testing.T) {
+	_, cookie := signupUser()
+
+	var got *http.Request
+	var uploaded int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		uploaded, _ = io.Copy(ioutil.Discard, r.Body)
+
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Add("Set-Cookie", "theme=dark")
+		w.Header().Add("Set-Cookie", "jwt=upstream")
+		w.Header().Set("Connection", "X-Hop")
+		w.Header().Set("X-Hop", "1")
+		w.WriteHeader(http.StatusCreated)
+		io.Copy(w, io.LimitReader(zeros{}, 4<<20))
+	}))
+	defer upstream.Close()
+	defer useForwardURL(strings.TrimPrefix(upstream.URL, "http://"))()
+
+	req, _ := http.NewRequest("POST", "/upload?x=1", io.LimitReader(zeros{}, 8<<20))
+	req.ContentLength = 8 << 20
+	req.Host = "gateway.example.com"
+	req.Header.Set("X-Forwarded-For", "6.6.6.6")
+	req.AddCookie(&http.Cookie{Name: "theme", Value: "light"})
+	req.AddCookie(cookie)
+	response := executeRequest(req)
+
+	assert.Equal(t, http.StatusCreated, response.Code, "The status of the upstream should be kept")
+	assert.Equal(t, "/upload", got.URL.Path)
+	assert.Equal(t, "x=1", got.URL.RawQuery)
+	assert.Equal(t, int64(8<<20), uploaded, "The request body should be streamed")
+	assert.Equal(t, "theme=light", got.Header.Get("Cookie"), "Only the jwt cookie should be stripped")
+	assert.Equal(t, "gateway.example.com", got.Header.Get("X-Forwarded-Host"))
+	assert.Equal(t, "http", got.Header.Get("X-Forwarded-Proto"))
+	assert.NotContains(t, got.Header.Get("X-Forwarded-For"), "6.6.6.6", "Forwarding headers of clients should not be trusted")
+	assert.NotEmpty(t, got.Header.Get("X-Forwarded-User"))
+
+	assert.Equal(t, "text/csv", response.Header().Get("Content-Type"))
+	assert.Equal(t, "max-age=60", response.Header().Get("Cache-Control"))
+	assert.Equal(t, []string{"theme=dark"}, response.Header()["Set-Cookie"], "Upstreams can't set the jwt cookie")
+	assert.Empty(t, response.Header().Get("X-Hop"), "Hop-by-hop headers should be dropped")
+	assert.Equal(t, 4<<20, response.Body.Len())
+}
+
+func TestProxyUnreachableUpstream(t *testing.T) {
+	_, cookie := signupUser()
+
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	upstream.Close()
+	defer useForwardURL(strings.TrimPrefix(upstream.URL, "http://"))()
+
+	req, _ := http.NewRequest("GET", "/", bytes.NewBufferString(""))
+	req.AddCookie(cookie)
+	response := executeRequest(req)
+	assert.Equal(t, http.StatusBadGateway, response.Code, "Response should be 502")
+}
+
+// zeros is an endless reader of zeros
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestProxyStripsCredentials(t *testing.T) {
+	var got *http.Request
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+	}))
+	defer upstream.Close()
+	defer useForwardURL(strings.TrimPrefix(upstream.URL, "http://"))()
+
+	_, cookie := signupUser()
+	create, _ := http.NewRequest("POST", "/apikeys", bytes.NewBufferString(`{"name":"ci"}`))
+	create.AddCookie(cookie)
+	var created struct {
+		Result struct {
+			Key string `json:"key"`
+		} `json:"result"`
+	}
+	assert.NoError(t, json.Unmarshal(executeRequest(create).Body.Bytes(), &created))
+
+	for _, header := range []string{"Authorization", "X-API-Key"} {
+		req, _ := http.NewRequest("GET", "/", nil)
+		value := created.Result.Key
+		if header == "Authorization" {
+			value = "Bearer " + value
+		}
+		req.Header.Set(header, value)
+		assert.Equal(t, http.StatusOK, executeRequest(req).Code, "Response should be 200")
+		assert.Empty(t, got.Header.Get("Authorization"), "Upstreams should not get the credentials of the gateway")
+		assert.Empty(t, got.Header.Get("X-API-Key"), "Upstreams should not get the credentials of the gateway")
+	}
+}
@@ -0,0 +1,245 @@
+package app
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"secure/database"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// What rate limits are counted per
+const (
+	limitByIP     = "ip"
+	limitByUser   = "user"
+	limitByAPIKey = "api_key"
+	limitByRoute  = "route"
+)
+
+// limitPolicy allows Rate requests, such as "100/m", per Key in a token
+// bucket refilled continuously. The bucket holds Burst tokens, the count of
+// the rate by default. Keys are the client IP, the principal, the API key
+// the request was made with, or the whole route; anonymous requests are
+// counted per IP, and requests without an API key per principal.
+type limitPolicy struct {
+	Rate  string `json:"rate"`
+	Burst int    `json:"burst"`
+	Key   string `json:"key"`
+
+	name      string
+	perSecond float64
+}
+
+func (p *limitPolicy) parse() error {
+	parts := strings.SplitN(p.Rate, "/", 2)
+	n, err := strconv.Atoi(parts[0])
+	if err != nil || n <= 0 || len(parts) != 2 {
+		return fmt.Errorf("Invalid rate %s", p.Rate)
+	}
+
+	per := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}[parts[1]]
+	if per == 0 {
+		return fmt.Errorf("Invalid rate %s", p.Rate)
+	}
+	p.perSecond = float64(n) / per.Seconds()
+
+	if p.Burst <= 0 {
+		p.Burst = n
+	}
+
+	switch p.Key {
+	case "":
+		p.Key = limitByUser
+	case limitByIP, limitByUser, limitByAPIKey, limitByRoute:
+	default:
+		return fmt.Errorf("Invalid rate limit key %s", p.Key)
+	}
+	return nil
+}
+
+// envLimit is the policy in the environment variable, such as "100/m", or
+// the default one. It is off when set to "off".
+func envLimit(name, def, key string) *limitPolicy {
+	rate := os.Getenv(name)
+	if rate == "off" {
+		return nil
+	}
+
+	p := &limitPolicy{Rate: rate, Key: key, name: strings.ToLower(name)}
+	if rate == "" || p.parse() != nil {
+		p = &limitPolicy{Rate: def, Key: key, name: strings.ToLower(name)}
+		p.parse()
+	}
+	return p
+}
+
+// defaultLimit is the limit of authenticated routes and upstream routes
+// without one of their own, RATE_LIMIT or 600/m per principal
+func defaultLimit() *limitPolicy {
+	return envLimit("RATE_LIMIT", "600/m", limitByUser)
+}
+
+// pathLimit is the limit of the open and public routes, RATE_LIMIT_LOGIN or
+// 10/m per IP for logins, RATE_LIMIT_SIGNUP or 5/m per IP for signups, and
+// the default one per IP for the others
+func pathLimit(path string) func() *limitPolicy {
+	switch {
+	case path == "/login" || strings.HasPrefix(path, "/login/email"):
+		return func() *limitPolicy { return envLimit("RATE_LIMIT_LOGIN", "10/m", limitByIP) }
+	case path == "/signup":
+		return func() *limitPolicy { return envLimit("RATE_LIMIT_SIGNUP", "5/m", limitByIP) }
+	}
+	return func() *limitPolicy { return envLimit("RATE_LIMIT", "600/m", limitByIP) }
+}
+
+// clientIP is the IP of the client of the request
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// key is what the request is counted against
+func (p *limitPolicy) key(r *http.Request, c *context) string {
+	switch {
+	case p.Key == limitByRoute:
+		return p.name
+	case p.Key == limitByAPIKey && c.APIKeyID != "":
+		return p.name + ":apikey:" + c.APIKeyID
+	case p.Key != limitByIP && c.Principal != "":
+		return p.name + ":" + c.id()
+	}
+	return p.name + ":ip:" + clientIP(r)
+}
+
+// refill refills the bucket since it was last updated, new ones being full,
+// and takes a token when there is one
+func (p *limitPolicy) refill(tokens float64, last, now time.Time) (float64, bool) {
+	if last.IsZero() {
+		tokens = float64(p.Burst)
+	} else {
+		tokens = math.Min(float64(p.Burst), tokens+now.Sub(last).Seconds()*p.perSecond)
+	}
+	if tokens < 1 {
+		return tokens, false
+	}
+	return tokens - 1, true
+}
+
+// full is how long until the bucket is full again
+func (p *limitPolicy) full(tokens float64) time.Duration {
+	return time.Duration((float64(p.Burst) - tokens) / p.perSecond * float64(time.Second))
+}
+
+// bucket is a token bucket kept in memory
+type bucket struct {
+	tokens float64
+	last   time.Time
+	full   time.Time
+}
+
+// limiter keeps the token buckets of the rate limits, in memory or in the
+// datastore when RATE_LIMIT_STORE is "db", so that they survive restarts and
+// are shared by the instances using it
+type limiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+// take takes a token from the bucket of the key, and returns the tokens
+// left
+func (l *limiter) take(e *Env, p *limitPolicy, key string) (float64, bool, error) {
+	now := time.Now()
+
+	if os.Getenv("RATE_LIMIT_STORE") == "db" {
+		var ok bool
+		stored, err := e.db.UpdateRateLimit(key, func(rl *database.RateLimit) error {
+			rl.Tokens, ok = p.refill(rl.Tokens, rl.UpdatedAt, now)
+			rl.UpdatedAt, rl.ExpiresAt = now, now.Add(p.full(rl.Tokens))
+			return nil
+		})
+		if err != nil {
+			return 0, false, err
+		}
+		return stored.Tokens, ok, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.buckets == nil {
+		l.buckets = map[string]*bucket{}
+	}
+
+	b := l.buckets[key]
+	if b == nil {
+		b = &bucket{}
+		l.buckets[key] = b
+	}
+	var ok bool
+	b.tokens, ok = p.refill(b.tokens, b.last, now)
+	b.last, b.full = now, now.Add(p.full(b.tokens))
+	return b.tokens, ok, nil
+}
+
+// sweep forgets the buckets in memory that are full again, as they are then
+// the same as new ones
+func (l *limiter) sweep() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, b := range l.buckets {
+		if time.Now().After(b.full) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// limit takes a token for the request, and sets the RateLimit-Limit,
+// RateLimit-Remaining and RateLimit-Reset headers. Requests over the limit
+// get a 429 with a Retry-After header. Requests are let through when the
+// store of the buckets fails.
+func limit(e *Env, w http.ResponseWriter, r *http.Request, c *context, p *limitPolicy) (httpStatus, bool) {
+	if p == nil {
+		return httpStatus{}, true
+	}
+
+	tokens, ok, err := e.limits.take(e, p, p.key(r, c))
+	if err != nil {
+		go e.l.LogError(err, c.id())
+		return httpStatus{}, true
+	}
+
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(p.Burst))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(int(tokens)))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(p.full(tokens).Seconds()))))
+	if ok {
+		return httpStatus{}, true
+	}
+
+	e.metrics.inc("gateway_rate_limited_total", "policy", p.name)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil((1-tokens)/p.perSecond))))
+	return httpStatus{http.StatusTooManyRequests, nil, http.StatusText(http.StatusTooManyRequests), nil}, false
+}
+
+// limitRequests refuses the requests over the limit of the policy with a 429
+func limitRequests(policy func() *limitPolicy, h Handler) Handler {
+	return Handler{h.Env, hFunc(func(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStatus {
+		if status, ok := limit(e, w, r, c, policy()); !ok {
+			return status
+		}
+		return h.H(h.Env, w, r, c)
+	})}
+}
+
+// sweepRateLimits forgets the buckets that are full again, in memory and in
+// the datastore
+func sweepRateLimits(e *Env) error {
+	e.limits.sweep()
+	return e.db.DeleteExpiredRateLimits()
+}
@@ -0,0 +1,83 @@
+package app
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/dchest/uniuri"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoginRateLimit(t *testing.T) {
+	os.Setenv("RATE_LIMIT_LOGIN", "2/m")
+	defer os.Setenv("RATE_LIMIT_LOGIN", "off")
+
+	login := func(ip string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/login", bytes.NewBufferString(`{"email":"`+uniuri.New()+`@me.com","password":"wrong"}`))
+		req.RemoteAddr = ip + ":1234"
+		return executeRequest(req)
+	}
+
+	response := login("10.0.0.1")
+	assert.NotEqual(t, http.StatusTooManyRequests, response.Code)
+	assert.Equal(t, "2", response.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "1", response.Header().Get("RateLimit-Remaining"))
+
+	assert.NotEqual(t, http.StatusTooManyRequests, login("10.0.0.1").Code)
+	response = login("10.0.0.1")
+	assert.Equal(t, http.StatusTooManyRequests, response.Code, "Logins over the limit should be refused")
+	assert.Equal(t, "0", response.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "30", response.Header().Get("Retry-After"))
+	assert.Equal(t, "60", response.Header().Get("RateLimit-Reset"))
+
+	assert.NotEqual(t, http.StatusTooManyRequests, login("10.0.0.2").Code, "Limits should be per IP")
+}
+
+func TestRouteRateLimit(t *testing.T) {
+	_, cookie := signupUser()
+	_, other := signupUser()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("done"))
+	}))
+	defer upstream.Close()
+	defer useRoutes(t, `{"routes": [{"name": "search", "path_prefix": "/search", "upstream": "`+upstream.URL+`",
+		"rate_limit": {"rate": "1/m", "burst": 2}}]}`)()
+
+	search := func(cookie *http.Cookie) int {
+		req, _ := http.NewRequest("GET", "/search", nil)
+		req.AddCookie(cookie)
+		return executeRequest(req).Code
+	}
+
+	assert.Equal(t, http.StatusOK, search(cookie), "Response should be 200")
+	assert.Equal(t, http.StatusOK, search(cookie), "Bursts should be allowed")
+	assert.Equal(t, http.StatusTooManyRequests, search(cookie), "Requests over the limit should be refused")
+	assert.Equal(t, http.StatusOK, search(other), "Limits should be per user")
+
+	assert.Error(t, testEnv.routes.load([]byte(`{"routes": [{"upstream": "`+upstream.URL+`", "rate_limit": {"rate": "1/week"}}]}`)))
+}
+
+func TestPersistentRateLimit(t *testing.T) {
+	os.Setenv("RATE_LIMIT_SIGNUP", "1/h")
+	os.Setenv("RATE_LIMIT_STORE", "db")
+	defer os.Setenv("RATE_LIMIT_SIGNUP", "off")
+	defer os.Unsetenv("RATE_LIMIT_STORE")
+
+	signup := func() int {
+		req, _ := http.NewRequest("POST", "/signup", bytes.NewBufferString(`{"email":"`+uniuri.New()+`@me.com","password":"secret"}`))
+		req.RemoteAddr = "10.0.1.1:1234"
+		return executeRequest(req).Code
+	}
+
+	assert.Equal(t, http.StatusOK, signup(), "Response should be 200")
+
+	// a restart loses the buckets kept in memory
+	limits := testEnv.limits
+	testEnv.limits = &limiter{}
+	defer func() { testEnv.limits = limits }()
+	assert.Equal(t, http.StatusTooManyRequests, signup(), "Limits should survive restarts")
+}
@@ -0,0 +1,207 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"secure/database"
+	"strings"
+)
+
+// Permissions required by the routes
+const (
+	permAll           = "*"
+	permProxy         = "proxy:access"
+	permAPIKeysCreate = "apikeys:create"
+	permAPIKeysManage = "apikeys:manage"
+	permClientsManage = "clients:manage"
+	permRolesManage   = "roles:manage"
+	permOrgs          = "orgs:use"
+	permOrgsManage    = "orgs:manage"
+	permUsersManage   = "users:manage"
+	permUpstreamsRead = "upstreams:read"
+	permUsageRead     = "usage:read"
+)
+
+// defaultRole is the role of users that haven't been given any
+const defaultRole = "user"
+
+// rolePermissions are the permissions granted by each role
+var rolePermissions = map[string][]string{
+	"admin":     {permAll},
+	defaultRole: {permProxy, permAPIKeysCreate, permOrgs},
+}
+
+// forbiddenReason is returned with a 403 so clients can tell why they were
+// refused
+type forbiddenReason struct {
+	Code       string `json:"code"`
+	Permission string `json:"permission,omitempty"`
+	Rule       string `json:"rule,omitempty"`
+	Principal  string `json:"principal,omitempty"`
+	Message    string `json:"message"`
+}
+
+// forbidden writes a 403 with a structured reason
+func forbidden(w http.ResponseWriter, reason forbiddenReason) httpStatus {
+	res, _ := json.Marshal(struct {
+		Status string          `json:"status"`
+		Result string          `json:"result"`
+		Reason forbiddenReason `json:"reason"`
+	}{"failure", http.StatusText(http.StatusForbidden), reason})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	return httpStatus{http.StatusForbidden, res, "", nil}
+}
+
+// permissions returns the permissions of the principal. Users get the
+// permissions of their roles and any granted to them directly, and machine
+// clients can use the proxy with the scopes they were granted. API keys can
+// use the proxy if their owner can, and get the other permissions of their
+// owner only when they are among their scopes.
+func (c *context) permissions() []string {
+	if c.Principal == principalClient {
+		return append([]string{permProxy}, c.Scopes...)
+	}
+
+	var perms []string
+	for _, r := range c.roles() {
+		perms = append(perms, rolePermissions[r]...)
+	}
+	perms = append(perms, c.User.Permissions...)
+
+	if c.Principal != principalAPIKey {
+		return perms
+	}
+
+	owner := &context{Principal: principalUser, User: c.User}
+	var scoped []string
+	for _, p := range append([]string{permProxy}, c.Scopes...) {
+		if owner.can(p) {
+			scoped = append(scoped, p)
+		}
+	}
+	return scoped
+}
+
+// gatewayPermissions are the permissions of the gateway itself, as opposed
+// to the scopes of upstreams
+var gatewayPermissions = []string{
+	permAll,
+	permProxy,
+	permAPIKeysCreate,
+	permAPIKeysManage,
+	permClientsManage,
+	permRolesManage,
+	permOrgs,
+	permOrgsManage,
+	permUsersManage,
+	permUpstreamsRead,
+	permUsageRead,
+}
+
+// roles returns the roles of the principal. Machine clients have none.
+func (c *context) roles() []string {
+	if c.Principal == principalClient {
+		return nil
+	}
+	if len(c.User.Roles) == 0 {
+		return []string{defaultRole}
+	}
+	return c.User.Roles
+}
+
+// can checks the principal has the permission
+func (c *context) can(perm string) bool {
+	for _, p := range c.permissions() {
+		if p == permAll || p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// requirePermission refuses principals without the permission. An empty
+// permission lets every authenticated principal through.
+func requirePermission(perm string, h Handler) Handler {
+	if perm == "" {
+		return h
+	}
+	return Handler{h.Env, hFunc(func(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStatus {
+		if !c.can(perm) {
+			return missingPermission(w, c, perm)
+		}
+		return h.H(h.Env, w, r, c)
+	})}
+}
+
+func missingPermission(w http.ResponseWriter, c *context, perm string) httpStatus {
+	return forbidden(w, forbiddenReason{
+		Code:       "missing_permission",
+		Permission: perm,
+		Principal:  c.Principal,
+		Message:    "The " + c.Principal + " does not have the " + perm + " permission",
+	})
+}
+
+// isAdminEmail checks if the email is one of the comma separated
+// ADMIN_EMAILS, who are given the admin role when they sign up
+func isAdminEmail(email string) bool {
+	for _, a := range strings.Split(os.Getenv("ADMIN_EMAILS"), ",") {
+		if a != "" && strings.EqualFold(strings.TrimSpace(a), email) {
+			return true
+		}
+	}
+	return false
+}
+
+// setRoles sets the roles and directly granted permissions of a user. They
+// take effect on the next request of the user, whatever their token says.
+func setRoles(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStatus {
+	if r.Method == http.MethodPost {
+		var a struct {
+			Email       string
+			Roles       []string
+			Permissions []string
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+			return httpStatus{http.StatusBadRequest, nil, "Could not decode request body", err}
+		}
+
+		for _, role := range a.Roles {
+			if _, ok := rolePermissions[role]; !ok {
+				return httpStatus{http.StatusBadRequest, nil, "Unknown role " + role, nil}
+			}
+		}
+
+		user, err := e.db.UpdateUser(a.Email, func(u *database.User) error {
+			u.Roles = a.Roles
+			u.Permissions = a.Permissions
+			return nil
+		})
+
+		if err != nil {
+			return httpStatus{http.StatusNotFound, nil, "Unknown user", err}
+		}
+
+		err = audit(e, c, "user.roles", a.Email, map[string]string{
+			"roles":       strings.Join(a.Roles, " "),
+			"permissions": strings.Join(a.Permissions, " "),
+		})
+
+		if err != nil {
+			return httpStatus{http.StatusInternalServerError, nil, "", err}
+		}
+
+		res, err := json.Marshal(result{"success", user})
+
+		if err != nil {
+			return httpStatus{http.StatusInternalServerError, nil, "Error marshalling results", err}
+		}
+
+		return httpStatus{http.StatusOK, res, "", nil}
+	}
+	return httpStatus{http.StatusNotFound, nil, http.StatusText(http.StatusNotFound), nil}
+}
@@ -0,0 +1,54 @@
+package app
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/dchest/uniuri"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminRoutesRequireAPermission(t *testing.T) {
+	email, cookie := signupUser()
+	payload := `{"email":"` + email + `","roles":["admin"]}`
+
+	grant, _ := http.NewRequest("POST", "/admin/roles", bytes.NewBufferString(payload))
+	grant.AddCookie(cookie)
+	response := executeRequest(grant)
+	assert.Equal(t, http.StatusForbidden, response.Code, "Response should be 403")
+	assert.Equal(t, `{"status":"failure","result":"Forbidden","reason":{"code":"missing_permission","permission":"roles:manage","principal":"user","message":"The user does not have the roles:manage permission"}}`, response.Body.String())
+
+	os.Setenv("ADMIN_EMAILS", "admin-"+email)
+	defer os.Unsetenv("ADMIN_EMAILS")
+	signup, _ := http.NewRequest("POST", "/signup", bytes.NewBufferString(`{"email":"admin-`+email+`","password":"secret"}`))
+	admin := executeRequest(signup).Result().Cookies()[0]
+
+	grant, _ = http.NewRequest("POST", "/admin/roles", bytes.NewBufferString(payload))
+	grant.AddCookie(admin)
+	response = executeRequest(grant)
+	assert.Equal(t, http.StatusOK, response.Code, "Response should be 200")
+	assert.Contains(t, response.Body.String(), `"roles":["admin"]`)
+}
+
+func TestDemotedAdmin(t *testing.T) {
+	email := "admin-" + uniuri.New() + "@me.com"
+	os.Setenv("ADMIN_EMAILS", email)
+	defer os.Unsetenv("ADMIN_EMAILS")
+	signup, _ := http.NewRequest("POST", "/signup", bytes.NewBufferString(`{"email":"`+email+`","password":"secret"}`))
+	admin := executeRequest(signup).Result().Cookies()[0]
+
+	listUsers := func() int {
+		req, _ := http.NewRequest("GET", "/admin/users", nil)
+		req.AddCookie(admin)
+		return executeRequest(req).Code
+	}
+	assert.Equal(t, http.StatusOK, listUsers(), "Response should be 200")
+
+	demote, _ := http.NewRequest("POST", "/admin/roles", bytes.NewBufferString(`{"email":"`+email+`","roles":["user"]}`))
+	demote.AddCookie(admin)
+	assert.Equal(t, http.StatusOK, executeRequest(demote).Code, "Response should be 200")
+
+	assert.Equal(t, http.StatusForbidden, listUsers(), "Demoted admins should lose their rights with the token they have")
+}
@@ -0,0 +1,332 @@
+package app
+
+import (
+	gocontext "context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errNoUpstream            = errors.New("No upstream is available")
+	errResponseHeaderTimeout = errors.New("The upstream took too long to answer")
+)
+
+// Circuit breaker states
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// breakerConfig opens the circuit breaker of a route after Failures failed
+// requests in a row, 5 by default. Requests then fail fast for OpenFor, 30s
+// by default, after which a single trial request decides if it closes again.
+type breakerConfig struct {
+	Failures int    `json:"failures"`
+	OpenFor  string `json:"open_for"`
+
+	openFor time.Duration
+}
+
+func (b *breakerConfig) parse() error {
+	b.openFor = 30 * time.Second
+	if b.OpenFor != "" {
+		var err error
+		if b.openFor, err = time.ParseDuration(b.OpenFor); err != nil {
+			return fmt.Errorf("Invalid circuit breaker open_for %s", b.OpenFor)
+		}
+	}
+	if b.Failures <= 0 {
+		b.Failures = 5
+	}
+	return nil
+}
+
+// breaker is the circuit breaker of the upstream of a route. It is kept
+// across reloads of the routes.
+type breaker struct {
+	mu       sync.Mutex
+	config   breakerConfig
+	state    int
+	failures int
+	trial    bool
+}
+
+// allow checks a request can be sent to the upstream. In the half open state
+// only the trial request is.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		return false
+	case breakerHalfOpen:
+		if b.trial {
+			return false
+		}
+		b.trial = true
+	}
+	return true
+}
+
+// record records the outcome of an allowed request, and returns true when it
+// opened the breaker
+func (b *breaker) record(ok bool) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ok {
+		b.state, b.failures, b.trial = breakerClosed, 0, false
+		return false
+	}
+
+	b.failures++
+	if b.state == breakerOpen || (b.state == breakerClosed && b.failures < b.config.Failures) {
+		return false
+	}
+
+	b.state, b.failures, b.trial = breakerOpen, 0, false
+	time.AfterFunc(b.config.openFor, func() {
+		b.mu.Lock()
+		b.state = breakerHalfOpen
+		b.mu.Unlock()
+	})
+	return true
+}
+
+func (b *breaker) current() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// retryPolicy retries requests with idempotent methods and no body that
+// failed to connect or got a 502, 503 or 504, on another target when there
+// is one. Attempts counts the first one, and is 2 by default; the backoff
+// doubles from Backoff, 25ms by default, with jitter.
+type retryPolicy struct {
+	Attempts int    `json:"attempts"`
+	Backoff  string `json:"backoff"`
+
+	backoff time.Duration
+}
+
+func (p *retryPolicy) parse() error {
+	p.backoff = 25 * time.Millisecond
+	if p.Backoff != "" {
+		var err error
+		if p.backoff, err = time.ParseDuration(p.Backoff); err != nil {
+			return fmt.Errorf("Invalid retry backoff %s", p.Backoff)
+		}
+	}
+	if p.Attempts <= 0 {
+		p.Attempts = 2
+	}
+	return nil
+}
+
+// wait returns the backoff before the retry after n attempts
+func (p *retryPolicy) wait(n int) time.Duration {
+	d := p.backoff << uint(n-1)
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retries checks the request can safely be sent again
+func (p *retryPolicy) retries(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return p.Attempts > 1 && (req.Body == nil || req.Body == http.NoBody)
+	}
+	return false
+}
+
+func retryableStatus(code int) bool {
+	return code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout
+}
+
+// connectTimeoutKey is the context key of the connect timeout of a route,
+// which the dialer of proxyTransport applies
+type connectTimeoutKey struct{}
+
+var proxyDialer = &net.Dialer{
+	Timeout:   30 * time.Second,
+	KeepAlive: 30 * time.Second,
+}
+
+func dialProxy(ctx gocontext.Context, network, addr string) (net.Conn, error) {
+	if d, ok := ctx.Value(connectTimeoutKey{}).(time.Duration); ok && d > 0 {
+		var cancel gocontext.CancelFunc
+		ctx, cancel = gocontext.WithTimeout(ctx, d)
+		defer cancel()
+	}
+	return proxyDialer.DialContext(ctx, network, addr)
+}
+
+// upstreamTransport sends a proxied request to a target of the route,
+// retrying on other targets when it is safe to
+type upstreamTransport struct {
+	e     *Env
+	route *upstreamRoute
+	r     *http.Request
+	c     *context
+}
+
+func (ut *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	attempts := 1
+	if ut.route.Retries.retries(req) {
+		attempts = ut.route.Retries.Attempts
+	}
+
+	tried := map[*target]bool{}
+	for n := 1; ; n++ {
+		t := ut.route.pick(ut.r, ut.c, tried)
+		if t == nil {
+			return nil, errNoUpstream
+		}
+		tried[t] = true
+
+		res, err := ut.attempt(req, t)
+		if n >= attempts || req.Context().Err() != nil || (err == nil && !retryableStatus(res.StatusCode)) {
+			return res, err
+		}
+		if res != nil {
+			res.Body.Close()
+		}
+
+		ut.e.metrics.inc("gateway_upstream_retries_total", "route", ut.route.Name)
+		select {
+		case <-time.After(ut.route.Retries.wait(n)):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// attempt sends the request to the target, within the connect and response
+// header timeouts of the route. The upstream has the response header timeout
+// once it has the whole request, so that uploads take as long as they need.
+func (ut *upstreamTransport) attempt(req *http.Request, t *target) (*http.Response, error) {
+	route := ut.route
+
+	ctx, cancel := gocontext.WithCancel(req.Context())
+	ctx = gocontext.WithValue(ctx, connectTimeoutKey{}, route.connectTimeout)
+
+	out := req.WithContext(ctx)
+	route.direct(out, t, ut.r.URL.Path)
+
+	hw := &headerWait{timeout: route.headerTimeout(), cancel: cancel}
+	if out.Body == nil || out.Body == http.NoBody {
+		hw.start()
+	} else {
+		out.Body = &sentBody{ReadCloser: out.Body, sent: hw.start}
+	}
+
+	atomic.AddInt64(&t.active, 1)
+	res, err := proxyTransport.RoundTrip(out)
+	if hw.stop() {
+		if res != nil {
+			res.Body.Close()
+		}
+		res, err = nil, errResponseHeaderTimeout
+	}
+
+	if err != nil {
+		atomic.AddInt64(&t.active, -1)
+		cancel()
+		// clients going away is not the fault of the upstream
+		if ut.r.Context().Err() == nil {
+			t.report(err, route.Outlier)
+		}
+		return nil, err
+	}
+
+	if res.StatusCode >= 500 {
+		t.report(fmt.Errorf("Upstream answered %d", res.StatusCode), route.Outlier)
+	} else {
+		t.report(nil, route.Outlier)
+	}
+
+	res.Body = &upstreamBody{ReadCloser: res.Body, done: func() {
+		atomic.AddInt64(&t.active, -1)
+		cancel()
+	}}
+	return res, nil
+}
+
+// headerWait cancels an attempt when the upstream takes longer than the
+// timeout to send the headers of its response, from when it is started
+type headerWait struct {
+	mu      sync.Mutex
+	timeout time.Duration
+	cancel  func()
+	timer   *time.Timer
+	done    bool
+	expired bool
+}
+
+func (hw *headerWait) start() {
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+	if hw.done || hw.timer != nil {
+		return
+	}
+	hw.timer = time.AfterFunc(hw.timeout, func() {
+		hw.mu.Lock()
+		defer hw.mu.Unlock()
+		if !hw.done {
+			hw.expired = true
+			hw.cancel()
+		}
+	})
+}
+
+// stop stops waiting, and tells whether the timeout expired
+func (hw *headerWait) stop() bool {
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+	hw.done = true
+	if hw.timer != nil {
+		hw.timer.Stop()
+	}
+	return hw.expired
+}
+
+// sentBody calls sent once the request body has been sent
+type sentBody struct {
+	io.ReadCloser
+	sent func()
+}
+
+func (b *sentBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.sent()
+	}
+	return n, err
+}
+
+func (b *sentBody) Close() error {
+	b.sent()
+	return b.ReadCloser.Close()
+}
+
+// upstreamBody ends the attempt when the proxy is done with the response
+type upstreamBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *upstreamBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
@@ -0,0 +1,171 @@
+package app
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpstreamRetries(t *testing.T) {
+	_, cookie := signupUser()
+
+	a, b := newPoolTarget("a"), newPoolTarget("b")
+	defer a.Close()
+	defer b.Close()
+	atomic.StoreInt32(&a.failing, 1)
+
+	defer useRoutes(t, `{"routes": [{"name": "retried", "path_prefix": "/pool", "upstreams": ["`+a.URL+`", "`+b.URL+`"],
+		"retries": {"attempts": 2, "backoff": "1ms"}, "outlier_detection": {"consecutive_errors": 100}}]}`)()
+
+	retries := testEnv.metrics.get("gateway_upstream_retries_total", "route", "retried")
+	assert.Equal(t, map[string]int{"b": 4}, spread(cookie, 4), "Idempotent requests should be retried on another target")
+	assert.Equal(t, retries+3, testEnv.metrics.get("gateway_upstream_retries_total", "route", "retried"))
+
+	codes := map[int]int{}
+	for i := 0; i < 4; i++ {
+		req, _ := http.NewRequest("POST", "/pool", strings.NewReader("order"))
+		req.AddCookie(cookie)
+		codes[executeRequest(req).Code]++
+	}
+	assert.Equal(t, map[int]int{http.StatusOK: 2, http.StatusBadGateway: 2}, codes, "Requests with side effects should not be retried")
+}
+
+func TestUpstreamResponseHeaderTimeout(t *testing.T) {
+	_, cookie := signupUser()
+
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	defer useRoutes(t, `{"routes": [{"path_prefix": "/slow", "upstream": "`+upstream.URL+`",
+		"response_header_timeout": "50ms", "retries": {"attempts": 1}}]}`)()
+
+	req, _ := http.NewRequest("GET", "/slow", nil)
+	req.AddCookie(cookie)
+	response := executeRequest(req)
+	assert.Equal(t, http.StatusGatewayTimeout, response.Code, "Response should be 504")
+	assert.Contains(t, response.Body.String(), `"status":"failure"`)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	_, cookie := signupUser()
+
+	var hits int32
+	a := newPoolTarget("a")
+	defer a.Close()
+	atomic.StoreInt32(&a.failing, 1)
+	counted := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		a.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer counted.Close()
+
+	defer useRoutes(t, `{"routes": [{"name": "breaker", "path_prefix": "/pool", "upstream": "`+counted.URL+`",
+		"retries": {"attempts": 1}, "outlier_detection": {"consecutive_errors": 100},
+		"circuit_breaker": {"failures": 2, "open_for": "100ms"}}]}`)()
+
+	assert.Equal(t, map[string]int{"Bad Gateway": 2}, spread(cookie, 2))
+
+	req, _ := http.NewRequest("GET", "/pool", nil)
+	req.AddCookie(cookie)
+	response := executeRequest(req)
+	assert.Equal(t, http.StatusServiceUnavailable, response.Code, "Open breakers should fail fast")
+	assert.Equal(t, `{"status":"failure","result":"The upstream is unavailable, try again later"}`+"\n", response.Body.String())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&hits), "Open breakers should not reach the upstream")
+
+	os.Setenv("METRICS_TOKEN", "scraper")
+	defer os.Unsetenv("METRICS_TOKEN")
+	req, _ = http.NewRequest("GET", "/metrics", nil)
+	assert.Equal(t, http.StatusUnauthorized, executeRequest(req).Code, "Metrics need the token when it is set")
+
+	req.Header.Set("Authorization", "Bearer scraper")
+	response = executeRequest(req)
+	assert.Equal(t, http.StatusOK, response.Code, "Response should be 200")
+	assert.Contains(t, response.Body.String(), "# TYPE gateway_circuit_breaker_state gauge\n")
+	assert.Contains(t, response.Body.String(), `gateway_circuit_breaker_state{route="breaker"} 1`)
+	assert.Contains(t, response.Body.String(), `gateway_upstream_requests_total{route="breaker",code="502"}`)
+	assert.Contains(t, response.Body.String(), `gateway_upstream_rejected_total{route="breaker"}`)
+
+	atomic.StoreInt32(&a.failing, 0)
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, map[string]int{"a": 3}, spread(cookie, 3), "A successful trial should close the breaker")
+}
+
+func TestCircuitBreakerReload(t *testing.T) {
+	_, cookie := signupUser()
+
+	a := newPoolTarget("a")
+	defer a.Close()
+	atomic.StoreInt32(&a.failing, 1)
+	b := newPoolTarget("b")
+	defer b.Close()
+
+	breaking := `{"path_prefix": "/pool", "upstream": "` + a.URL + `", "retries": {"attempts": 1},
+		"outlier_detection": {"consecutive_errors": 100}, "circuit_breaker": {"failures": 2, "open_for": "1m"}}`
+	other := `{"path_prefix": "/other", "upstream": "` + b.URL + `"}`
+
+	defer useRoutes(t, `{"routes": [`+breaking+`, `+other+`]}`)()
+	assert.Equal(t, map[string]int{"Bad Gateway": 2}, spread(cookie, 2))
+
+	// the unnamed routes swap names
+	assert.NoError(t, testEnv.routes.load([]byte(`{"routes": [`+other+`, `+breaking+`]}`)))
+
+	req, _ := http.NewRequest("GET", "/pool", nil)
+	req.AddCookie(cookie)
+	assert.Equal(t, http.StatusServiceUnavailable, executeRequest(req).Code, "Breakers should follow their upstreams")
+
+	req, _ = http.NewRequest("GET", "/other", nil)
+	req.AddCookie(cookie)
+	assert.Equal(t, http.StatusOK, executeRequest(req).Code, "Breakers should not move to other upstreams")
+}
+
+func TestCircuitBreakerStreamingTrial(t *testing.T) {
+	_, cookie := signupUser()
+
+	var failing int32 = 1
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case atomic.LoadInt32(&failing) == 1:
+			w.WriteHeader(http.StatusBadGateway)
+		case r.URL.Path == "/pool/events":
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, "data: hello\n\n")
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		}
+	}))
+	defer upstream.Close()
+
+	defer useRoutes(t, `{"routes": [{"path_prefix": "/pool", "upstream": "`+upstream.URL+`", "retries": {"attempts": 1},
+		"outlier_detection": {"consecutive_errors": 100}, "circuit_breaker": {"failures": 2, "open_for": "100ms"}}]}`)()
+	assert.Equal(t, map[string]int{"Bad Gateway": 2}, spread(cookie, 2))
+
+	atomic.StoreInt32(&failing, 0)
+	time.Sleep(200 * time.Millisecond)
+
+	gateway := httptest.NewServer(r)
+	defer gateway.Close()
+
+	req, _ := http.NewRequest("GET", gateway.URL+"/pool/events", nil)
+	req.AddCookie(cookie)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	_, err = bufio.NewReader(res.Body).ReadString('\n')
+	assert.NoError(t, err)
+
+	req, _ = http.NewRequest("GET", "/pool", nil)
+	req.AddCookie(cookie)
+	assert.Equal(t, http.StatusOK, executeRequest(req).Code, "A trial that opened a stream should close the breaker")
+}
@@ -1,22 +1,39 @@
 package app
 
 import (
-	"bytes"
 	"encoding/json"
-	"fmt"
-	"io/ioutil"
+	"net"
 	"net/http"
-	"os"
 	"secure/database"
+	"time"
+
+	"github.com/rs/xid"
 )
 
 type hFunc func(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStatus
 
+// protectedRoutes require a token, and the permission when one is given
 var protectedRoutes = []struct {
-	key string
-	H   hFunc
+	key  string
+	H    hFunc
+	perm string
 }{
-	{"/", proxy},
+	{"/apikeys", apiKeys, permAPIKeysCreate},
+	{"/apikeys/", apiKeys, permAPIKeysCreate},
+	{"/admin/roles", setRoles, permRolesManage},
+	{"/me", me, ""},
+	{"/me/password", changePassword, ""},
+	{"/me/export", exportMe, ""},
+	{"/me/export/", exportMe, ""},
+	{"/me/usage", myUsage, ""},
+	{"/admin/users", adminUsers, permUsersManage},
+	{"/admin/users/", adminUser, permUsersManage},
+	{"/admin/audit", auditLog, permUsersManage},
+	{"/admin/upstreams", upstreams, permUpstreamsRead},
+	{"/admin/usage", adminUsage, permUsageRead},
+	{"/orgs", orgs, permOrgs},
+	{"/orgs/", org, permOrgs},
+	{"/invitations/accept", acceptInvitation, permOrgs},
 }
 
 var openRoutes = []struct {
@@ -26,6 +43,27 @@ var openRoutes = []struct {
 	{"/healthz", health},
 	{"/signup", signup},
 	{"/login", login},
+	{"/login/email", emailLogin},
+	{"/login/email/verify", verifyEmailLogin},
+	{"/restore", restore},
+}
+
+var publicRoutes = []struct {
+	key string
+	H   hFunc
+}{
+	{"/.well-known/jwks.json", jwks},
+	{"/.well-known/openid-configuration", discovery},
+	{"/authorize", authorize},
+	{"/token", token},
+	{"/userinfo", userinfo},
+	{"/clients", registerClient},
+	{"/exports/", downloadExport},
+	{"/login/", federatedLogin},
+	{"/saml/", saml},
+	{"/auth/verify", verifyAuth},
+	{"/auth/verify/", verifyAuth},
+	{"/metrics", serveMetrics},
 }
 
 // Error is the handler's error interface
@@ -60,7 +98,43 @@ type Handler struct {
 }
 
 type context struct {
-	User database.User
+	User      database.User
+	Principal string
+	ClientID  string
+	APIKeyID  string
+	Scopes    []string
+	Org       string
+	OrgRole   string
+	// Session and PasswordResetRequired are only set for user sessions
+	Session               int
+	PasswordResetRequired bool
+}
+
+// id identifies the principal of the request in logs
+func (c *context) id() string {
+	if c.Principal == principalClient {
+		return principalClient + ":" + c.ClientID
+	}
+	return c.User.Email
+}
+
+// forwardedUser is the identity sent upstream in X-Forwarded-User
+type forwardedUser struct {
+	Type string `json:"type"`
+	*database.User
+	ClientID string   `json:"client_id,omitempty"`
+	APIKeyID string   `json:"api_key_id,omitempty"`
+	Scopes   []string `json:"scopes,omitempty"`
+	Org      string   `json:"org,omitempty"`
+	OrgRole  string   `json:"org_role,omitempty"`
+}
+
+func (c *context) forwarded() forwardedUser {
+	fwd := forwardedUser{Type: c.Principal, ClientID: c.ClientID, APIKeyID: c.APIKeyID, Scopes: c.Scopes, Org: c.Org, OrgRole: c.OrgRole}
+	if c.Principal != principalClient {
+		fwd.User = &c.User
+	}
+	return fwd
 }
 
 type results struct {
@@ -82,13 +156,26 @@ func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Write(status.res)
 }
 
-// SetupRoutes sets up the routes
+// withTimeout limits how long the routes served here, all but the proxy
+// which has its own timeouts, have to answer. It is API_TIMEOUT, 10s by
+// default.
+func withTimeout(h http.Handler) http.Handler {
+	return http.TimeoutHandler(h, envDuration("API_TIMEOUT", 10*time.Second),
+		`{"status":"failure","result":"`+http.StatusText(http.StatusServiceUnavailable)+`"}`)
+}
+
+// SetupRoutes sets up the routes. Everything else goes through the gateway
+// to the upstreams.
 func (e *Env) setupRoutes() {
+	r.Handle("/", logRequests(Handler{e, gateway}))
 	for _, f := range protectedRoutes {
-		r.Handle(f.key, setupMiddleware(Handler{e, f.H}))
+		r.Handle(f.key, withTimeout(setupMiddleware(requirePermission(f.perm, Handler{e, f.H}))))
 	}
 	for _, f := range openRoutes {
-		r.Handle(f.key, logRequests(addToken(Handler{e, f.H})))
+		r.Handle(f.key, withTimeout(logRequests(limitRequests(pathLimit(f.key), addToken(Handler{e, f.H})))))
+	}
+	for _, f := range publicRoutes {
+		r.Handle(f.key, withTimeout(logRequests(limitRequests(pathLimit(f.key), Handler{e, f.H}))))
 	}
 }
 
@@ -106,18 +193,52 @@ func login(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStatu
 		if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
 			return httpStatus{http.StatusBadRequest, nil, "Could not decode request body", err}
 		}
+		a.Email = database.NormalizeEmail(a.Email)
+
+		// home realm discovery: users of a domain with an SSO connection are
+		// sent to it when they don't give a password, or always if it is
+		// enforced
+		if p := e.ssoConnection(a.Email); p != nil && (a.Password == "" || p.Enforce) {
+			return ssoRedirect(r, p, a.Email)
+		}
 
 		if a.Email == "" || a.Password == "" {
 			return httpStatus{http.StatusBadRequest, nil, "Please supply an email and password", nil}
 		}
 
+		if u, err := e.db.GetUser(a.Email); err == nil && u.Locked() {
+			return httpStatus{http.StatusForbidden, nil, "Too many failed logins, try again later", nil}
+		}
+
 		user, err := e.db.FindUser(a.Email, a.Password)
 
 		if err != nil {
+			failedLogin(e, a.Email)
+			recordLogin(e, r, a.Email, false, 0)
 			return httpStatus{http.StatusInternalServerError, nil, err.Error(), err}
 		}
 
-		c.User = database.User{Email: user.Email, FirstName: user.FirstName, LastName: user.LastName}
+		if user.Disabled {
+			return httpStatus{http.StatusForbidden, nil, "Account disabled", nil}
+		}
+
+		if user.Deleted() {
+			return httpStatus{http.StatusForbidden, nil, "Account deleted, it can be restored at /restore", nil}
+		}
+
+		if user.FailedLogins > 0 {
+			if _, err := e.db.UpdateUser(user.Email, func(u *database.User) error {
+				u.FailedLogins = 0
+				return nil
+			}); err != nil {
+				return httpStatus{http.StatusInternalServerError, nil, "", err}
+			}
+		}
+
+		if err := startSession(e, c, user); err != nil {
+			return httpStatus{http.StatusInternalServerError, nil, "", err}
+		}
+		recordLogin(e, r, user.Email, true, c.Session)
 
 		res, err := json.Marshal(result{"success", user})
 
@@ -130,6 +251,58 @@ func login(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStatu
 	return httpStatus{http.StatusNotFound, nil, http.StatusText(http.StatusNotFound), nil}
 }
 
+// startSession sets the user the token issued by addToken is for
+func startSession(e *Env, c *context, user *database.User) error {
+	c.User = database.User{Email: user.Email, FirstName: user.FirstName, LastName: user.LastName, Roles: user.Roles, Permissions: user.Permissions}
+	c.Session = user.SessionVersion
+
+	// the user starts in the first organization they joined
+	memberships, err := e.db.Memberships(user.Email)
+
+	if err != nil {
+		return err
+	}
+
+	if len(memberships) > 0 {
+		c.Org, c.OrgRole = memberships[0].OrgID, memberships[0].Role
+	}
+	return nil
+}
+
+// recordLogin adds a login attempt to the history of the user, if they exist
+func recordLogin(e *Env, r *http.Request, email string, success bool, session int) {
+	if _, err := e.db.GetUser(email); err != nil {
+		return
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	event := database.NewLoginEvent(xid.New().String(), email, ip, r.UserAgent(), success, session)
+	if err := e.db.AddLoginEvent(event); err != nil {
+		e.l.LogError(err, email)
+	}
+}
+
+// failedLogin counts a failed login, locking the user out for LOGIN_LOCKOUT
+// after LOGIN_MAX_ATTEMPTS of them in a row
+func failedLogin(e *Env, email string) {
+	_, err := e.db.UpdateUser(email, func(u *database.User) error {
+		u.FailedLogins++
+		if u.FailedLogins >= envInt("LOGIN_MAX_ATTEMPTS", 5) {
+			u.FailedLogins = 0
+			u.LockedUntil = time.Now().Add(envDuration("LOGIN_LOCKOUT", 15*time.Minute))
+		}
+		return nil
+	})
+
+	if err != nil && err != database.ErrNotFound {
+		e.l.LogError(err, email)
+	}
+}
+
 func signup(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStatus {
 	if r.Method == http.MethodPost {
 		var a struct {
@@ -140,24 +313,35 @@ func signup(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStat
 		if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
 			return httpStatus{http.StatusBadRequest, nil, "Could not decode request body", err}
 		}
+		a.Email = database.NormalizeEmail(a.Email)
 
 		if a.Email == "" || a.Password == "" {
 			return httpStatus{http.StatusBadRequest, nil, "Please supply an email and password", nil}
 		}
 
+		// users of enforced SSO domains are provisioned when they first log in
+		if p := e.ssoConnection(a.Email); p != nil && p.Enforce {
+			return ssoRedirect(r, p, a.Email)
+		}
+
 		user, err := database.NewUser(a.Email, a.Password)
 
 		if err != nil {
 			return httpStatus{http.StatusInternalServerError, nil, "", err}
 		}
 
-		c.User = database.User{Email: user.Email, FirstName: user.FirstName, LastName: user.LastName}
+		if isAdminEmail(user.Email) {
+			user.Roles = []string{"admin"}
+		}
+
+		c.User = database.User{Email: user.Email, FirstName: user.FirstName, LastName: user.LastName, Roles: user.Roles, Permissions: user.Permissions}
 
 		user, err = e.db.AddUser(user)
 
 		if err != nil {
 			return httpStatus{http.StatusBadRequest, nil, err.Error(), err}
 		}
+		recordLogin(e, r, user.Email, true, 0)
 
 		res, err := json.Marshal(result{"success", user})
 
@@ -169,52 +353,3 @@ func signup(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStat
 	}
 	return httpStatus{http.StatusNotFound, nil, http.StatusText(http.StatusNotFound), nil}
 }
-
-func proxy(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStatus {
-	res, err := json.Marshal(c.User)
-
-	if err != nil {
-		return httpStatus{http.StatusInternalServerError, nil, "Error marshalling results", err}
-	}
-
-	// we need to buffer the body if we want to read it here and send it
-	// in the request.
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		return httpStatus{http.StatusBadRequest, nil, "Could not decode request body", err}
-	}
-
-	// you can reassign the body if you need to parse it as multipart
-	r.Body = ioutil.NopCloser(bytes.NewReader(body))
-
-	// create a new url from the raw RequestURI sent by the client
-	url := fmt.Sprintf("http://%s%s", os.Getenv("FORWARD_URL"), r.RequestURI)
-
-	proxyReq, err := http.NewRequest(r.Method, url, bytes.NewReader(body))
-
-	// We may want to filter some headers, otherwise we could just use a shallow copy
-	// proxyReq.Header = r.Header
-	proxyReq.Header = make(http.Header)
-	for h, val := range r.Header {
-		if h != "Cookie" {
-			proxyReq.Header[h] = val
-		}
-	}
-
-	proxyReq.Header.Set("X-Forwarded-User", string(res))
-
-	httpClient := http.Client{}
-	proxyResp, err := httpClient.Do(proxyReq)
-	if err != nil {
-		return httpStatus{http.StatusBadGateway, nil, http.StatusText(http.StatusBadGateway), err}
-	}
-	defer proxyResp.Body.Close()
-
-	proxyBody, err := ioutil.ReadAll(proxyResp.Body)
-
-	if err != nil {
-		return httpStatus{http.StatusBadRequest, nil, "Could not decode request body of the proxied request", err}
-	}
-
-	return httpStatus{proxyResp.StatusCode, proxyBody, "", err}
-}
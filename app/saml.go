@@ -0,0 +1,450 @@
+package app
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"secure/database"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+	"github.com/russellhaering/goxmldsig/etreeutils"
+)
+
+const (
+	samlProtocolNS  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	samlAssertionNS = "urn:oasis:names:tc:SAML:2.0:assertion"
+	samlPOSTBinding = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+	samlEmailFormat = "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress"
+	samlSuccess     = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	samlBearer      = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+)
+
+// samlClockSkew is how far the clock of a SAML provider may be off
+const samlClockSkew = 3 * time.Minute
+
+var errInvalidSAMLResponse = errors.New("Invalid SAML response")
+
+// parseSAML checks the configuration of a SAML provider and parses its
+// certificates
+func (p *provider) parseSAML() error {
+	if p.Issuer == "" || p.SSOURL == "" || len(p.Certificates) == 0 {
+		return fmt.Errorf("Identity provider %s needs an issuer, an sso_url and certificates", p.Name)
+	}
+
+	for _, c := range p.Certificates {
+		block, _ := pem.Decode([]byte(c))
+		if block == nil {
+			return fmt.Errorf("Invalid certificate for identity provider %s", p.Name)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("Invalid certificate for identity provider %s: %v", p.Name, err)
+		}
+		p.certs = append(p.certs, cert)
+	}
+
+	attributes := map[string]string{"email": "email", "first_name": "first_name", "last_name": "last_name"}
+	for field, name := range p.Attributes {
+		if _, ok := attributes[field]; !ok {
+			return fmt.Errorf("Invalid attribute %s for identity provider %s", field, p.Name)
+		}
+		attributes[field] = name
+	}
+	p.Attributes = attributes
+
+	return nil
+}
+
+func (p *provider) entityID() string {
+	if p.EntityID != "" {
+		return p.EntityID
+	}
+	return issuer() + "/saml/" + p.Name + "/metadata"
+}
+
+// saml serves the metadata of this service for a SAML provider at
+// /saml/<provider>/metadata, and its assertion consumer service at
+// /saml/<provider>/acs
+func saml(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStatus {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/saml/"), "/")
+	p, ok := e.providers[parts[0]]
+
+	switch {
+	case !ok || p.Type != "saml" || len(parts) != 2:
+		return httpStatus{http.StatusNotFound, nil, "Unknown identity provider", nil}
+	case parts[1] == "metadata" && r.Method == http.MethodGet:
+		return samlMetadata(w, r, p)
+	case parts[1] == "acs" && r.Method == http.MethodPost:
+		return finishSAMLLogin(e, w, r, c, p)
+	}
+	return httpStatus{http.StatusNotFound, nil, http.StatusText(http.StatusNotFound), nil}
+}
+
+type spMetadata struct {
+	XMLName  xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntityDescriptor"`
+	EntityID string   `xml:"entityID,attr"`
+	SP       struct {
+		AuthnRequestsSigned        bool   `xml:"AuthnRequestsSigned,attr"`
+		WantAssertionsSigned       bool   `xml:"WantAssertionsSigned,attr"`
+		ProtocolSupportEnumeration string `xml:"protocolSupportEnumeration,attr"`
+		NameIDFormat               string `xml:"NameIDFormat"`
+		ACS                        struct {
+			Binding   string `xml:"Binding,attr"`
+			Location  string `xml:"Location,attr"`
+			Index     int    `xml:"index,attr"`
+			IsDefault bool   `xml:"isDefault,attr"`
+		} `xml:"AssertionConsumerService"`
+	} `xml:"SPSSODescriptor"`
+}
+
+func samlMetadata(w http.ResponseWriter, r *http.Request, p *provider) httpStatus {
+	m := spMetadata{EntityID: p.entityID()}
+	m.SP.WantAssertionsSigned = true
+	m.SP.ProtocolSupportEnumeration = samlProtocolNS
+	m.SP.NameIDFormat = samlEmailFormat
+	m.SP.ACS.Binding = samlPOSTBinding
+	m.SP.ACS.Location = p.redirectURL()
+	m.SP.ACS.IsDefault = true
+
+	res, err := xml.MarshalIndent(m, "", "  ")
+
+	if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "Error marshalling metadata", err}
+	}
+
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	return httpStatus{http.StatusOK, append([]byte(xml.Header), res...), "", nil}
+}
+
+type samlIssuer struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	Value   string   `xml:",chardata"`
+}
+
+type authnRequest struct {
+	XMLName         xml.Name   `xml:"urn:oasis:names:tc:SAML:2.0:protocol AuthnRequest"`
+	ID              string     `xml:"ID,attr"`
+	Version         string     `xml:"Version,attr"`
+	IssueInstant    string     `xml:"IssueInstant,attr"`
+	Destination     string     `xml:"Destination,attr"`
+	ACSURL          string     `xml:"AssertionConsumerServiceURL,attr"`
+	ProtocolBinding string     `xml:"ProtocolBinding,attr"`
+	Issuer          samlIssuer `xml:"Issuer"`
+	NameIDPolicy    struct {
+		Format      string `xml:"Format,attr"`
+		AllowCreate bool   `xml:"AllowCreate,attr"`
+	} `xml:"NameIDPolicy"`
+}
+
+// startSAMLLogin sends the user to log in at the provider with an
+// AuthnRequest, using the HTTP-Redirect binding
+func startSAMLLogin(e *Env, w http.ResponseWriter, r *http.Request, p *provider) httpStatus {
+	state, id := randomToken(32), "_"+randomToken(16)
+	err := e.db.AddLoginState(&database.LoginState{
+		ID:        hashToken(state),
+		Provider:  p.Name,
+		Nonce:     id,
+		ReturnTo:  safeReturnTo(r.URL.Query().Get("return_to")),
+		ExpiresAt: time.Now().Add(loginStateLifetime),
+	})
+
+	if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "", err}
+	}
+
+	req := authnRequest{
+		ID:              id,
+		Version:         "2.0",
+		IssueInstant:    time.Now().UTC().Format(time.RFC3339),
+		Destination:     p.SSOURL,
+		ACSURL:          p.redirectURL(),
+		ProtocolBinding: samlPOSTBinding,
+		Issuer:          samlIssuer{Value: p.entityID()},
+	}
+	req.NameIDPolicy.Format = samlEmailFormat
+	req.NameIDPolicy.AllowCreate = true
+
+	b, err := xml.Marshal(req)
+	if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "", err}
+	}
+
+	var deflated bytes.Buffer
+	fw, _ := flate.NewWriter(&deflated, flate.DefaultCompression)
+	fw.Write(b)
+	fw.Close()
+
+	// the provider posts the response back from its own site, so the cookie
+	// binding the state to the browser can't be SameSite
+	cookie := &http.Cookie{
+		Name:     "saml_state",
+		Value:    state,
+		Path:     "/saml/" + p.Name + "/",
+		MaxAge:   int(loginStateLifetime.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+	}
+	v := cookie.String()
+	if cookie.Secure {
+		v += "; SameSite=None"
+	}
+	w.Header().Add("Set-Cookie", v)
+
+	return redirectWith(w, r, p.SSOURL, url.Values{
+		"SAMLRequest": {base64.StdEncoding.EncodeToString(deflated.Bytes())},
+		"RelayState":  {state},
+	})
+}
+
+// finishSAMLLogin is the assertion consumer service, which the provider
+// posts the SAML response to with the HTTP-POST binding
+func finishSAMLLogin(e *Env, w http.ResponseWriter, r *http.Request, c *context, p *provider) httpStatus {
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
+	if err := r.ParseForm(); err != nil {
+		return httpStatus{http.StatusBadRequest, nil, "Could not decode request body", err}
+	}
+
+	invalidState := httpStatus{http.StatusBadRequest, nil, "Invalid or expired login state", nil}
+
+	// a login started here has to finish in the same browser. Logins started
+	// at the provider have no request to be in response to.
+	requestID, returnTo := "", "/"
+	cookie, err := r.Cookie("saml_state")
+
+	if err == nil && subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(r.PostForm.Get("RelayState"))) == 1 {
+		state, err := e.db.TakeLoginState(hashToken(cookie.Value))
+		if err != nil || state.Provider != p.Name {
+			return invalidState
+		}
+
+		http.SetCookie(w, &http.Cookie{Name: "saml_state", Value: "", Path: "/saml/" + p.Name + "/", MaxAge: -1})
+		requestID, returnTo = state.Nonce, state.ReturnTo
+	} else if !p.IdPInitiated {
+		return invalidState
+	}
+
+	a, err := p.parseSAMLResponse(r, r.PostForm.Get("SAMLResponse"), requestID)
+
+	if err != nil {
+		return httpStatus{http.StatusUnauthorized, nil, "Could not log in with the identity provider", err}
+	}
+
+	if err := e.db.UseAssertion(&database.Assertion{ID: a.ID, Provider: p.Name, ExpiresAt: a.ExpiresAt}); err == database.ErrReplayed {
+		return httpStatus{http.StatusUnauthorized, nil, err.Error(), nil}
+	} else if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "", err}
+	}
+
+	return completeFederatedLogin(e, w, r, c, p, &a.upstreamIdentity, returnTo)
+}
+
+// samlAssertion is the identity in a valid assertion, and how long the
+// assertion has to be remembered for so that it isn't replayed
+type samlAssertion struct {
+	upstreamIdentity
+	ID        string
+	ExpiresAt time.Time
+}
+
+// parseSAMLResponse checks the response is a success, and that it, or its
+// only assertion, is signed by the provider. Only the signed XML is read.
+func (p *provider) parseSAMLResponse(r *http.Request, encoded, requestID string) (*samlAssertion, error) {
+	b, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errInvalidSAMLResponse
+	}
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(b); err != nil {
+		return nil, errInvalidSAMLResponse
+	}
+
+	res := doc.Root()
+	if res == nil || res.Tag != "Response" || res.NamespaceURI() != samlProtocolNS {
+		return nil, errInvalidSAMLResponse
+	}
+
+	ctx := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{Roots: p.certs})
+
+	signed := false
+	if sig, _ := etreeutils.NSFindOneChild(res, dsig.Namespace, dsig.SignatureTag); sig != nil {
+		if res, err = ctx.Validate(res); err != nil {
+			return nil, err
+		}
+		signed = true
+	}
+
+	var assertion *etree.Element
+	for _, el := range res.ChildElements() {
+		if el.Tag == "EncryptedAssertion" || (el.Tag == "Assertion" && assertion != nil) {
+			return nil, errors.New("Only a single unencrypted assertion is supported")
+		}
+		if el.Tag == "Assertion" && el.NamespaceURI() == samlAssertionNS {
+			assertion = el
+		}
+	}
+	if assertion == nil {
+		return nil, errInvalidSAMLResponse
+	}
+
+	nsCtx, err := etreeutils.NSBuildParentContext(assertion)
+	if err != nil {
+		return nil, err
+	}
+	if assertion, err = etreeutils.NSDetatch(nsCtx, assertion); err != nil {
+		return nil, err
+	}
+
+	if !signed {
+		if assertion, err = ctx.Validate(assertion); err != nil {
+			return nil, err
+		}
+	}
+
+	if d := res.SelectAttrValue("Destination", ""); d != "" && d != p.redirectURL() {
+		return nil, errors.New("SAML response is for another destination")
+	}
+	if res.SelectAttrValue("InResponseTo", "") != requestID {
+		return nil, errors.New("SAML response is not in response to the login")
+	}
+	status := samlChild(res, samlProtocolNS, "Status", "StatusCode")
+	if status == nil || status.SelectAttrValue("Value", "") != samlSuccess {
+		return nil, errors.New("The identity provider did not log the user in")
+	}
+
+	return p.checkAssertion(r, assertion, requestID)
+}
+
+// samlChild finds the element at the path of children of an element, with
+// the namespaces declared on its ancestors
+func samlChild(el *etree.Element, ns string, path ...string) *etree.Element {
+	for _, tag := range path {
+		ctx, err := etreeutils.NSBuildParentContext(el)
+		if err != nil {
+			return nil
+		}
+		if el, err = etreeutils.NSFindOneChildCtx(ctx, el, ns, tag); err != nil || el == nil {
+			return nil
+		}
+	}
+	return el
+}
+
+// checkAssertion checks the assertion is from the provider, about a subject
+// logging in here, for this service and currently valid, and maps its
+// attributes to the user
+func (p *provider) checkAssertion(r *http.Request, assertion *etree.Element, requestID string) (*samlAssertion, error) {
+	a := samlAssertion{ID: assertion.SelectAttrValue("ID", "")}
+	now := time.Now()
+
+	if issuer := samlChild(assertion, samlAssertionNS, "Issuer"); issuer == nil || strings.TrimSpace(issuer.Text()) != p.Issuer {
+		return nil, errors.New("SAML assertion is from another issuer")
+	}
+
+	nameID := samlChild(assertion, samlAssertionNS, "Subject", "NameID")
+	if nameID == nil || strings.TrimSpace(nameID.Text()) == "" || a.ID == "" {
+		return nil, errInvalidSAMLResponse
+	}
+	a.Subject = strings.TrimSpace(nameID.Text())
+
+	// the assertion has to be a bearer assertion for a login here
+	confirmed := false
+	etreeutils.NSFindIterate(assertion, samlAssertionNS, "SubjectConfirmation", func(ctx etreeutils.NSContext, sc *etree.Element) error {
+		data, _ := etreeutils.NSFindOneChildCtx(ctx, sc, samlAssertionNS, "SubjectConfirmationData")
+		if sc.SelectAttrValue("Method", "") != samlBearer || data == nil {
+			return nil
+		}
+
+		notOnOrAfter, err := time.Parse(time.RFC3339, data.SelectAttrValue("NotOnOrAfter", ""))
+		if err != nil || !now.Before(notOnOrAfter.Add(samlClockSkew)) {
+			return nil
+		}
+
+		if data.SelectAttrValue("Recipient", "") == p.redirectURL() && data.SelectAttrValue("InResponseTo", "") == requestID {
+			confirmed = true
+			if notOnOrAfter.After(a.ExpiresAt) {
+				a.ExpiresAt = notOnOrAfter
+			}
+		}
+		return nil
+	})
+	if !confirmed {
+		return nil, errors.New("SAML assertion can't be used to log in here")
+	}
+
+	conditions := samlChild(assertion, samlAssertionNS, "Conditions")
+	if conditions == nil {
+		return nil, errInvalidSAMLResponse
+	}
+	if v := conditions.SelectAttrValue("NotBefore", ""); v != "" {
+		notBefore, err := time.Parse(time.RFC3339, v)
+		if err != nil || now.Add(samlClockSkew).Before(notBefore) {
+			return nil, errors.New("SAML assertion is not valid yet")
+		}
+	}
+	if v := conditions.SelectAttrValue("NotOnOrAfter", ""); v != "" {
+		notOnOrAfter, err := time.Parse(time.RFC3339, v)
+		if err != nil || !now.Before(notOnOrAfter.Add(samlClockSkew)) {
+			return nil, errors.New("SAML assertion has expired")
+		}
+		if notOnOrAfter.After(a.ExpiresAt) {
+			a.ExpiresAt = notOnOrAfter
+		}
+	}
+	a.ExpiresAt = a.ExpiresAt.Add(samlClockSkew)
+
+	// every audience restriction has to include this service
+	audiences := 0
+	var errAudience error
+	etreeutils.NSFindIterate(assertion, samlAssertionNS, "AudienceRestriction", func(ctx etreeutils.NSContext, ar *etree.Element) error {
+		audiences++
+		found := false
+		etreeutils.NSFindChildrenIterateCtx(ctx, ar, samlAssertionNS, "Audience", func(ctx etreeutils.NSContext, aud *etree.Element) error {
+			found = found || strings.TrimSpace(aud.Text()) == p.entityID()
+			return nil
+		})
+		if !found {
+			errAudience = errors.New("SAML assertion is for another audience")
+		}
+		return nil
+	})
+	if audiences == 0 || errAudience != nil {
+		return nil, errors.New("SAML assertion is for another audience")
+	}
+
+	attributes := map[string]string{}
+	etreeutils.NSFindIterate(assertion, samlAssertionNS, "Attribute", func(ctx etreeutils.NSContext, attr *etree.Element) error {
+		value, _ := etreeutils.NSFindOneChildCtx(ctx, attr, samlAssertionNS, "AttributeValue")
+		if value != nil {
+			attributes[attr.SelectAttrValue("Name", "")] = strings.TrimSpace(value.Text())
+		}
+		return nil
+	})
+
+	a.Email = attributes[p.Attributes["email"]]
+	if a.Email == "" && nameID.SelectAttrValue("Format", "") == samlEmailFormat {
+		a.Email = a.Subject
+	}
+	a.GivenName = attributes[p.Attributes["first_name"]]
+	a.FamilyName = attributes[p.Attributes["last_name"]]
+	a.EmailVerified = p.TrustEmail && a.Email != ""
+
+	return &a, nil
+}
+
+// deleteExpiredAssertions deletes the SAML assertions recorded against
+// replays once they have expired
+func deleteExpiredAssertions(e *Env) error {
+	return e.db.DeleteExpiredAssertions()
+}
@@ -0,0 +1,262 @@
+package app
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/dchest/uniuri"
+	dsig "github.com/russellhaering/goxmldsig"
+	"github.com/stretchr/testify/assert"
+)
+
+const samlIdPIssuer = "https://idp.example.com"
+
+// samlIdP signs assertions like a SAML identity provider would
+type samlIdP struct {
+	key  *rsa.PrivateKey
+	cert []byte
+}
+
+func newSAMLIdP(t *testing.T) *samlIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+
+	return &samlIdP{key, cert}
+}
+
+// providers configures a SAML provider named corp for the IdP
+func (idp *samlIdP) providers(t *testing.T, idpInitiated bool) map[string]*provider {
+	config, _ := json.Marshal(map[string]interface{}{"providers": []interface{}{map[string]interface{}{
+		"name":          "corp",
+		"type":          "saml",
+		"issuer":        samlIdPIssuer,
+		"sso_url":       samlIdPIssuer + "/sso",
+		"certificates":  []string{string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: idp.cert}))},
+		"trust_email":   true,
+		"attributes":    map[string]string{"first_name": "givenName"},
+		"idp_initiated": idpInitiated,
+	}}})
+
+	providers, err := parseProviders(config)
+	assert.NoError(t, err)
+	return providers
+}
+
+// response returns a SAML response with an assertion signed by the IdP. The
+// assertion can be changed after it is signed with tamper.
+func (idp *samlIdP) response(t *testing.T, inResponseTo, acs, audience, email string, tamper func(*etree.Element)) string {
+	now := time.Now().UTC()
+	at := func(d time.Duration) string { return now.Add(d).Format(time.RFC3339) }
+
+	assertion := etree.NewElement("saml:Assertion")
+	assertion.CreateAttr("xmlns:saml", samlAssertionNS)
+	assertion.CreateAttr("ID", "_"+uniuri.New())
+	assertion.CreateAttr("Version", "2.0")
+	assertion.CreateAttr("IssueInstant", at(0))
+	assertion.CreateElement("saml:Issuer").SetText(samlIdPIssuer)
+
+	subject := assertion.CreateElement("saml:Subject")
+	nameID := subject.CreateElement("saml:NameID")
+	nameID.CreateAttr("Format", samlEmailFormat)
+	nameID.SetText(email)
+	confirmation := subject.CreateElement("saml:SubjectConfirmation")
+	confirmation.CreateAttr("Method", samlBearer)
+	data := confirmation.CreateElement("saml:SubjectConfirmationData")
+	if inResponseTo != "" {
+		data.CreateAttr("InResponseTo", inResponseTo)
+	}
+	data.CreateAttr("Recipient", acs)
+	data.CreateAttr("NotOnOrAfter", at(5*time.Minute))
+
+	conditions := assertion.CreateElement("saml:Conditions")
+	conditions.CreateAttr("NotBefore", at(-time.Minute))
+	conditions.CreateAttr("NotOnOrAfter", at(5*time.Minute))
+	conditions.CreateElement("saml:AudienceRestriction").CreateElement("saml:Audience").SetText(audience)
+
+	attributes := assertion.CreateElement("saml:AttributeStatement")
+	for name, value := range map[string]string{"email": email, "givenName": "Sam"} {
+		attr := attributes.CreateElement("saml:Attribute")
+		attr.CreateAttr("Name", name)
+		attr.CreateElement("saml:AttributeValue").SetText(value)
+	}
+
+	ctx := dsig.NewDefaultSigningContext(dsig.TLSCertKeyStore(tls.Certificate{
+		Certificate: [][]byte{idp.cert},
+		PrivateKey:  idp.key,
+	}))
+	ctx.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
+	signed, err := ctx.SignEnveloped(assertion)
+	assert.NoError(t, err)
+
+	if tamper != nil {
+		tamper(signed)
+	}
+
+	doc := etree.NewDocument()
+	res := doc.CreateElement("samlp:Response")
+	res.CreateAttr("xmlns:samlp", samlProtocolNS)
+	res.CreateAttr("xmlns:saml", samlAssertionNS)
+	res.CreateAttr("ID", "_"+uniuri.New())
+	res.CreateAttr("Version", "2.0")
+	res.CreateAttr("IssueInstant", at(0))
+	res.CreateAttr("Destination", acs)
+	if inResponseTo != "" {
+		res.CreateAttr("InResponseTo", inResponseTo)
+	}
+	res.CreateElement("saml:Issuer").SetText(samlIdPIssuer)
+	res.CreateElement("samlp:Status").CreateElement("samlp:StatusCode").CreateAttr("Value", samlSuccess)
+	res.AddChild(signed)
+
+	b, err := doc.WriteToBytes()
+	assert.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func samlMetadataOf(t *testing.T) spMetadata {
+	req, _ := http.NewRequest("GET", "/saml/corp/metadata", nil)
+	response := executeRequest(req)
+	assert.Equal(t, http.StatusOK, response.Code, "Response should be 200")
+
+	var m spMetadata
+	assert.NoError(t, xml.Unmarshal(response.Body.Bytes(), &m))
+	return m
+}
+
+// startSAML starts a login and returns the ID of the AuthnRequest and the
+// state cookie
+func startSAML(t *testing.T) (string, *http.Cookie) {
+	req, _ := http.NewRequest("GET", "/login/corp?return_to=/dashboard", nil)
+	response := executeRequest(req)
+	assert.Equal(t, http.StatusFound, response.Code, "Response should be 302")
+
+	location, _ := url.Parse(response.Header().Get("Location"))
+	assert.True(t, strings.HasPrefix(location.String(), samlIdPIssuer+"/sso?"))
+
+	deflated, err := base64.StdEncoding.DecodeString(location.Query().Get("SAMLRequest"))
+	assert.NoError(t, err)
+	b, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(deflated)))
+	assert.NoError(t, err)
+
+	var authn authnRequest
+	assert.NoError(t, xml.Unmarshal(b, &authn))
+
+	state := response.Result().Cookies()[0]
+	assert.Equal(t, "saml_state", state.Name)
+	assert.Equal(t, state.Value, location.Query().Get("RelayState"))
+	return authn.ID, state
+}
+
+func postSAML(samlResponse string, state *http.Cookie) *httptest.ResponseRecorder {
+	form := url.Values{"SAMLResponse": {samlResponse}}
+	if state != nil {
+		form.Set("RelayState", state.Value)
+	}
+
+	req, _ := http.NewRequest("POST", "/saml/corp/acs", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if state != nil {
+		req.AddCookie(state)
+	}
+	return executeRequest(req)
+}
+
+func TestSAMLLogin(t *testing.T) {
+	idp := newSAMLIdP(t)
+	testEnv.providers = idp.providers(t, false)
+	defer func() { testEnv.providers = map[string]*provider{} }()
+
+	m := samlMetadataOf(t)
+	acs := m.SP.ACS.Location
+	assert.True(t, strings.HasSuffix(m.EntityID, "/saml/corp/metadata"))
+	assert.True(t, strings.HasSuffix(acs, "/saml/corp/acs"))
+	assert.Equal(t, samlPOSTBinding, m.SP.ACS.Binding)
+
+	email := uniuri.New() + "@corp.com"
+
+	id, state := startSAML(t)
+	response := postSAML(idp.response(t, id, acs, m.EntityID, email, func(a *etree.Element) {
+		nameID := a.FindElement("./Subject/NameID")
+		assert.NotNil(t, nameID)
+		nameID.SetText("mallory@corp.com")
+	}), state)
+	assert.Equal(t, http.StatusUnauthorized, response.Code, "Tampered assertions should be rejected")
+
+	id, state = startSAML(t)
+	response = postSAML(idp.response(t, id, acs, "https://other.example.com", email, nil), state)
+	assert.Equal(t, http.StatusUnauthorized, response.Code, "Assertions for other services should be rejected")
+
+	id, state = startSAML(t)
+	response = postSAML(idp.response(t, "_"+uniuri.New(), acs, m.EntityID, email, nil), state)
+	assert.Equal(t, http.StatusUnauthorized, response.Code, "Responses to other requests should be rejected")
+
+	id, state = startSAML(t)
+	samlResponse := idp.response(t, id, acs, m.EntityID, email, nil)
+	response = postSAML(samlResponse, state)
+	assert.Equal(t, http.StatusFound, response.Code, "Response should be 302")
+	assert.Equal(t, "/dashboard", response.Header().Get("Location"))
+
+	var jwt *http.Cookie
+	for _, c := range response.Result().Cookies() {
+		if c.Name == "jwt" {
+			jwt = c
+		}
+	}
+	assert.NotNil(t, jwt, "Logging in should set the jwt cookie")
+
+	user, err := testEnv.db.GetUser(email)
+	assert.NoError(t, err, "Users should be provisioned")
+	assert.Equal(t, "Sam", user.FirstName, "Attributes should be mapped to the user")
+
+	response = postSAML(samlResponse, state)
+	assert.Equal(t, http.StatusBadRequest, response.Code, "Login states can only be used once")
+
+	response = postSAML(idp.response(t, "", acs, m.EntityID, email, nil), nil)
+	assert.Equal(t, http.StatusBadRequest, response.Code, "Logins started at the provider are off by default")
+}
+
+func TestSAMLReplay(t *testing.T) {
+	idp := newSAMLIdP(t)
+	testEnv.providers = idp.providers(t, true)
+	defer func() { testEnv.providers = map[string]*provider{} }()
+
+	m := samlMetadataOf(t)
+	samlResponse := idp.response(t, "", m.SP.ACS.Location, m.EntityID, uniuri.New()+"@corp.com", nil)
+
+	response := postSAML(samlResponse, nil)
+	assert.Equal(t, http.StatusFound, response.Code, "Response should be 302")
+	assert.Equal(t, "/", response.Header().Get("Location"))
+
+	response = postSAML(samlResponse, nil)
+	assert.Equal(t, http.StatusUnauthorized, response.Code, "Assertions can only be used once")
+	assert.Contains(t, response.Body.String(), "Assertion already used")
+
+	other := newSAMLIdP(t)
+	response = postSAML(other.response(t, "", m.SP.ACS.Location, m.EntityID, uniuri.New()+"@corp.com", nil), nil)
+	assert.Equal(t, http.StatusUnauthorized, response.Code, "Assertions signed by other keys should be rejected")
+}
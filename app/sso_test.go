@@ -0,0 +1,61 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"secure/database"
+	"testing"
+
+	"github.com/dchest/uniuri"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSSOConnections(t *testing.T) {
+	idp := newStandInIdP(t)
+	defer idp.Close()
+
+	domain := uniuri.New() + ".com"
+	org := database.NewOrganization(uniuri.New(), "Acme")
+	assert.NoError(t, testEnv.db.AddOrganization(org))
+
+	providers, err := parseProviders([]byte(`{"providers":[{"name":"acme","type":"oidc","issuer":"` + idp.URL + `","client_id":"app","client_secret":"secret","domains":["` + domain + `"],"enforce":true,"org_id":"` + org.ID + `"}]}`))
+	assert.NoError(t, err)
+	testEnv.providers = providers
+	defer func() { testEnv.providers = map[string]*provider{} }()
+
+	email := "bob@" + domain
+	signup, _ := http.NewRequest("POST", "/signup", bytes.NewBufferString(`{"email":"`+email+`","password":"secret123"}`))
+	response := executeRequest(signup)
+	assert.Empty(t, response.Result().Cookies(), "Enforced domains can't sign up with a password")
+
+	login, _ := http.NewRequest("POST", "/login", bytes.NewBufferString(`{"email":"`+email+`"}`))
+	response = executeRequest(login)
+	assert.Equal(t, http.StatusOK, response.Code, "Response should be 200")
+
+	var discovery struct {
+		Status string `json:"status"`
+		Result struct {
+			RedirectURL string `json:"redirect_url"`
+		} `json:"result"`
+	}
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &discovery))
+	assert.Equal(t, "redirect", discovery.Status)
+
+	redirect, _ := url.Parse(discovery.Result.RedirectURL)
+	idp.subject, idp.email = uniuri.New(), "mallory@elsewhere.com"
+	assert.Equal(t, http.StatusForbidden, loginThrough(t, redirect.RequestURI()).Code, "Connections only log in users of their domains")
+
+	idp.subject, idp.email = uniuri.New(), email
+	assert.Equal(t, http.StatusFound, loginThrough(t, redirect.RequestURI()).Code)
+
+	m, err := testEnv.db.GetMembership(org.ID, email)
+	assert.NoError(t, err, "Users should be provisioned into the organization")
+	assert.Equal(t, database.OrgMember, m.Role)
+
+	login, _ = http.NewRequest("POST", "/login", bytes.NewBufferString(`{"email":"`+email+`","password":"anything"}`))
+	response = executeRequest(login)
+	assert.Contains(t, response.Body.String(), `"status":"redirect"`, "Local passwords are disabled for enforced domains")
+	assert.Empty(t, response.Result().Cookies())
+}
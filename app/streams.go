@@ -0,0 +1,62 @@
+package app
+
+import (
+	"secure/database"
+	"strings"
+	"sync"
+)
+
+// streams are the live proxied connections, WebSockets and event streams, of
+// user sessions. They outlive the check of the token at their start, so they
+// are closed when their session is revoked.
+type streams struct {
+	mu   sync.Mutex
+	live map[string]map[*stream]bool
+}
+
+type stream struct {
+	session int
+	close   func()
+}
+
+// add tracks a stream of the session of the user, and returns the function
+// to stop tracking it once it is over
+func (s *streams) add(email string, session int, close func()) func() {
+	email = strings.ToLower(email)
+	st := &stream{session, close}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.live == nil {
+		s.live = map[string]map[*stream]bool{}
+	}
+	if s.live[email] == nil {
+		s.live[email] = map[*stream]bool{}
+	}
+	s.live[email][st] = true
+
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		delete(s.live[email], st)
+		if len(s.live[email]) == 0 {
+			delete(s.live, email)
+		}
+	}
+}
+
+// revoke closes the streams of the user that are no longer of a valid
+// session, or all of them when the user can't log in anymore. A nil user has
+// been purged.
+func (s *streams) revoke(email string, u *database.User) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for st := range s.live[strings.ToLower(email)] {
+		if u == nil || u.Disabled || u.Deleted() || u.PasswordResetRequired || st.session != u.SessionVersion {
+			go st.close()
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package app
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"secure/database"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// useUpstream points FORWARD_URL at the handler
+func useUpstream(h http.HandlerFunc) func() {
+	upstream := httptest.NewServer(h)
+	restore := useForwardURL(strings.TrimPrefix(upstream.URL, "http://"))
+
+	return func() {
+		restore()
+		upstream.Close()
+	}
+}
+
+// revokeSessions revokes the sessions of the user as an admin would
+func revokeSessions(t *testing.T, email string) {
+	admin := &context{User: database.User{Email: "admin@me.com"}, Principal: principalUser}
+	assert.Equal(t, http.StatusOK, userAction(testEnv, admin, email, "revoke-sessions").Code)
+}
+
+// closedWithin checks the reader is closed within a few seconds
+func closedWithin(t *testing.T, r io.Reader) {
+	closed := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(ioutil.Discard, r)
+		closed <- err
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Error("The stream should be closed when the session is revoked")
+	}
+}
+
+func TestProxyWebSocket(t *testing.T) {
+	email, cookie := signupUser()
+
+	defer useUpstream(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" || r.Header.Get("X-Forwarded-User") == "" {
+			http.Error(w, "Not a WebSocket", http.StatusBadRequest)
+			return
+		}
+
+		conn, buf, _ := w.(http.Hijacker).Hijack()
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSet-Cookie: jwt=upstream\r\nSet-Cookie: theme=dark\r\n\r\n")
+		buf.Flush()
+		io.Copy(conn, buf)
+	})()
+
+	gateway := httptest.NewServer(r)
+	defer gateway.Close()
+
+	conn, err := net.Dial("tcp", gateway.Listener.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "GET /ws HTTP/1.1\r\nHost: gateway\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nCookie: jwt=%s\r\n\r\n", cookie.Value)
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusSwitchingProtocols, res.StatusCode, "Response should be 101")
+	assert.Equal(t, []string{"theme=dark"}, res.Header["Set-Cookie"], "Upstreams can't replace the session of the user")
+
+	conn.Write([]byte("ping"))
+	echo := make([]byte, 4)
+	_, err = io.ReadFull(br, echo)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(echo), "The connections should be spliced")
+
+	revokeSessions(t, email)
+	closedWithin(t, br)
+}
+
+func TestProxyRefusedUpgrade(t *testing.T) {
+	_, cookie := signupUser()
+
+	defer useUpstream(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Set-Cookie", "jwt=upstream")
+		w.Header().Add("Set-Cookie", "theme=dark")
+		http.Error(w, "Not a WebSocket", http.StatusBadRequest)
+	})()
+
+	gateway := httptest.NewServer(r)
+	defer gateway.Close()
+
+	conn, err := net.Dial("tcp", gateway.Listener.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "GET /ws HTTP/1.1\r\nHost: gateway\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nCookie: jwt=%s\r\n\r\n", cookie.Value)
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode, "Response should be 400")
+	assert.Equal(t, []string{"theme=dark"}, res.Header["Set-Cookie"], "Upstreams can't replace the session of the user")
+}
+
+func TestProxyEventStream(t *testing.T) {
+	email, cookie := signupUser()
+
+	defer useUpstream(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: hello\n\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})()
+
+	gateway := httptest.NewServer(r)
+	defer gateway.Close()
+
+	req, _ := http.NewRequest("GET", gateway.URL+"/events", nil)
+	req.AddCookie(cookie)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+
+	events := bufio.NewReader(res.Body)
+	line, err := events.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "data: hello\n", line, "Events should be sent as soon as the upstream sends them")
+
+	revokeSessions(t, email)
+	closedWithin(t, events)
+}
+
+func TestProxyTimeout(t *testing.T) {
+	_, cookie := signupUser()
+
+	defer useUpstream(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})()
+
+	os.Setenv("PROXY_TIMEOUT", "50ms")
+	defer os.Unsetenv("PROXY_TIMEOUT")
+
+	req, _ := http.NewRequest("GET", "/slow", nil)
+	req.AddCookie(cookie)
+	response := executeRequest(req)
+	assert.Equal(t, http.StatusGatewayTimeout, response.Code, "Response should be 504")
+}
+
+// slowReader reads a chunk at a time, with a pause before each
+type slowReader struct {
+	chunks []string
+	pause  time.Duration
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(r.pause)
+	n := copy(p, r.chunks[0])
+	r.chunks = r.chunks[1:]
+	return n, nil
+}
+
+func TestProxySlowBodies(t *testing.T) {
+	_, cookie := signupUser()
+
+	defer useUpstream(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Received", string(body))
+		for i := 0; i < 4; i++ {
+			fmt.Fprintf(w, "%d", i)
+			w.(http.Flusher).Flush()
+			time.Sleep(40 * time.Millisecond)
+		}
+	})()
+
+	os.Setenv("PROXY_TIMEOUT", "50ms")
+	defer os.Unsetenv("PROXY_TIMEOUT")
+
+	req, _ := http.NewRequest("POST", "/upload", &slowReader{[]string{"a", "b", "c", "d"}, 40 * time.Millisecond})
+	// the body is chunked, as clients send streams
+	req.ContentLength = -1
+	req.AddCookie(cookie)
+	response := executeRequest(req)
+	assert.Equal(t, http.StatusOK, response.Code, "Uploads longer than the timeout should go through")
+	assert.Equal(t, "abcd", response.Header().Get("X-Received"))
+	assert.Equal(t, "0123", response.Body.String(), "Downloads longer than the timeout should go through")
+
+	os.Setenv("PROXY_IDLE_TIMEOUT", "20ms")
+	defer os.Unsetenv("PROXY_IDLE_TIMEOUT")
+
+	req, _ = http.NewRequest("GET", "/download", nil)
+	req.AddCookie(cookie)
+	response = executeRequest(req)
+	assert.NotEqual(t, "0123", response.Body.String(), "Bodies idle for longer than the idle timeout should be cut")
+}
+
+func TestRouteTimeout(t *testing.T) {
+	_, cookie := signupUser()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer upstream.Close()
+	defer useRoutes(t, `{"routes": [{"path_prefix": "/reports", "upstream": "`+upstream.URL+`", "timeout": "50ms"}]}`)()
+
+	req, _ := http.NewRequest("GET", "/reports", nil)
+	req.AddCookie(cookie)
+	done := make(chan struct{})
+	go func() {
+		executeRequest(req)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Error("Routes with a timeout should have a total deadline")
+	}
+}
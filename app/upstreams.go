@@ -0,0 +1,404 @@
+package app
+
+import (
+	gocontext "context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Balancing of the requests of a route between its upstreams
+const (
+	balanceRoundRobin = "round_robin"
+	balanceLeastConn  = "least_conn"
+	balanceHash       = "hash"
+)
+
+// ringReplicas is how many points each target has on the ring of a route
+// balanced by hash, so that its users spread evenly when one goes away
+const ringReplicas = 100
+
+// healthCheck is the active check of the upstreams of a route. Targets are
+// unhealthy after UnhealthyThreshold failed checks in a row, and healthy
+// again after HealthyThreshold passed ones. A target listed by several
+// routes is checked once, with the health check of the first route of the
+// table that lists it, and its health applies to all of them.
+type healthCheck struct {
+	Path               string `json:"path"`
+	Timeout            string `json:"timeout"`
+	HealthyThreshold   int    `json:"healthy_threshold"`
+	UnhealthyThreshold int    `json:"unhealthy_threshold"`
+
+	timeout time.Duration
+}
+
+// outlierDetection ejects targets from a route for a while after
+// ConsecutiveErrors failed requests in a row, 5 by default
+type outlierDetection struct {
+	ConsecutiveErrors int    `json:"consecutive_errors"`
+	Ejection          string `json:"ejection"`
+
+	ejection time.Duration
+}
+
+func (hc *healthCheck) parse() error {
+	hc.timeout = 2 * time.Second
+	if hc.Timeout != "" {
+		var err error
+		if hc.timeout, err = time.ParseDuration(hc.Timeout); err != nil {
+			return fmt.Errorf("Invalid health check timeout %s", hc.Timeout)
+		}
+	}
+	if hc.Path == "" {
+		hc.Path = "/"
+	}
+	if hc.HealthyThreshold <= 0 {
+		hc.HealthyThreshold = 2
+	}
+	if hc.UnhealthyThreshold <= 0 {
+		hc.UnhealthyThreshold = 2
+	}
+	return nil
+}
+
+func (o *outlierDetection) parse() error {
+	o.ejection = 30 * time.Second
+	if o.Ejection != "" {
+		var err error
+		if o.ejection, err = time.ParseDuration(o.Ejection); err != nil {
+			return fmt.Errorf("Invalid ejection %s", o.Ejection)
+		}
+	}
+	if o.ConsecutiveErrors <= 0 {
+		o.ConsecutiveErrors = 5
+	}
+	return nil
+}
+
+// target is an upstream server. Its health is kept across reloads of the
+// routes, for as long as a route lists it.
+type target struct {
+	// active is the number of requests in flight, first for 64-bit alignment
+	active int64
+	url    *url.URL
+
+	mu        sync.Mutex
+	check     *healthCheck
+	healthy   bool
+	ejected   bool
+	passed    int
+	failed    int
+	errors    int
+	lastError string
+}
+
+func newTarget(u *url.URL) *target {
+	return &target{url: u, healthy: true}
+}
+
+// targetStatus is the health of a target, as shown to admins
+type targetStatus struct {
+	URL       string `json:"url"`
+	Healthy   bool   `json:"healthy"`
+	Ejected   bool   `json:"ejected"`
+	Active    int64  `json:"active_requests"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+func (t *target) status() targetStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return targetStatus{t.url.String(), t.healthy, t.ejected, atomic.LoadInt64(&t.active), t.lastError}
+}
+
+// available checks the target can be sent requests
+func (t *target) available() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.healthy && !t.ejected
+}
+
+// report records the outcome of a request sent to the target, and ejects it
+// after too many errors in a row
+func (t *target) report(err error, o outlierDetection) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err == nil {
+		t.errors = 0
+		return
+	}
+
+	t.errors++
+	t.lastError = err.Error()
+	if t.ejected || t.errors < o.ConsecutiveErrors {
+		return
+	}
+
+	t.ejected, t.errors = true, 0
+	time.AfterFunc(o.ejection, func() {
+		t.mu.Lock()
+		t.ejected = false
+		t.mu.Unlock()
+	})
+}
+
+// probe runs the health check of the target
+func (t *target) probe() {
+	t.mu.Lock()
+	hc := t.check
+	t.mu.Unlock()
+	if hc == nil {
+		return
+	}
+
+	u := *t.url
+	u.Path = strings.TrimSuffix(u.Path, "/") + hc.Path
+	ctx, cancel := gocontext.WithTimeout(gocontext.Background(), hc.timeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return
+	}
+
+	res, err := proxyTransport.RoundTrip(req.WithContext(ctx))
+	if err == nil {
+		res.Body.Close()
+		if res.StatusCode >= 400 {
+			err = fmt.Errorf("Health check answered %d", res.StatusCode)
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err != nil {
+		t.passed, t.failed = 0, t.failed+1
+		t.lastError = err.Error()
+		if t.failed >= hc.UnhealthyThreshold {
+			t.healthy = false
+		}
+		return
+	}
+
+	t.passed, t.failed = t.passed+1, 0
+	if t.passed >= hc.HealthyThreshold {
+		t.healthy = true
+	}
+}
+
+// ringPoint is a point of a target on the ring of a route balanced by hash
+type ringPoint struct {
+	hash   uint32
+	target *target
+}
+
+func hash32(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+// bind gives the routes their targets and circuit breakers, keeping the ones
+// of the previous table so that their state carries over
+func (rt *routes) bind(table *routeTable) {
+	targets, breakers := map[string]*target{}, map[string]*breaker{}
+	for i := range table.Routes {
+		route := &table.Routes[i]
+		for _, u := range route.urls {
+			t, listed := targets[u.String()]
+			if !listed {
+				if t = rt.targets[u.String()]; t == nil {
+					t = newTarget(u)
+				}
+				targets[u.String()] = t
+
+				// the first route that lists a target checks it, for
+				// every route that does
+				t.mu.Lock()
+				t.check = route.HealthCheck
+				if t.check == nil {
+					t.healthy = true
+				}
+				t.mu.Unlock()
+			}
+			route.targets = append(route.targets, t)
+		}
+
+		// breakers are those of the upstreams, so that they carry over
+		// whatever the routes are named, and routes to the same upstreams
+		// share one, with the settings of the first of them
+		key := route.upstreamsKey()
+		if route.breaker = breakers[key]; route.breaker == nil {
+			if route.breaker = rt.breakers[key]; route.breaker == nil {
+				route.breaker = &breaker{}
+			}
+			route.breaker.mu.Lock()
+			route.breaker.config = route.CircuitBreaker
+			route.breaker.mu.Unlock()
+			breakers[key] = route.breaker
+		}
+
+		if route.Balance == balanceHash {
+			for _, t := range route.targets {
+				for n := 0; n < ringReplicas; n++ {
+					route.ring = append(route.ring, ringPoint{hash32(t.url.String() + "#" + strconv.Itoa(n)), t})
+				}
+			}
+			sort.Slice(route.ring, func(i, j int) bool { return route.ring[i].hash < route.ring[j].hash })
+		}
+	}
+	rt.targets, rt.breakers = targets, breakers
+}
+
+// upstreamsKey identifies the upstreams of the route, whatever their order
+func (route *upstreamRoute) upstreamsKey() string {
+	urls := make([]string, 0, len(route.urls))
+	for _, u := range route.urls {
+		urls = append(urls, u.String())
+	}
+	sort.Strings(urls)
+	return strings.Join(urls, " ")
+}
+
+// pick returns the target to send the request to, skipping the ones that are
+// unhealthy or ejected, or nil when none is available. Targets already tried
+// are only picked again when there is no other.
+func (route *upstreamRoute) pick(r *http.Request, c *context, tried map[*target]bool) *target {
+	if t := route.pickFrom(r, c, tried); t != nil || len(tried) == 0 {
+		return t
+	}
+	return route.pickFrom(r, c, nil)
+}
+
+func (route *upstreamRoute) pickFrom(r *http.Request, c *context, tried map[*target]bool) *target {
+	if route.Balance == balanceHash {
+		// users stick to a target, and move only when it is unavailable
+		key := c.id()
+		if key == "" {
+			key, _, _ = net.SplitHostPort(r.RemoteAddr)
+		}
+		h := hash32(key)
+		start := sort.Search(len(route.ring), func(i int) bool { return route.ring[i].hash >= h })
+		for n := 0; n < len(route.ring); n++ {
+			if t := route.ring[(start+n)%len(route.ring)].target; !tried[t] && t.available() {
+				return t
+			}
+		}
+		return nil
+	}
+
+	// the targets are walked from the next one in turn, so that ties
+	// between the least loaded are spread too
+	start := atomic.AddUint32(&route.next, 1)
+	var best *target
+	for n := 0; n < len(route.targets); n++ {
+		t := route.targets[(start+uint32(n))%uint32(len(route.targets))]
+		if tried[t] || !t.available() {
+			continue
+		}
+		if route.Balance == balanceRoundRobin {
+			return t
+		}
+		if best == nil || atomic.LoadInt64(&t.active) < atomic.LoadInt64(&best.active) {
+			best = t
+		}
+	}
+	return best
+}
+
+// checkUpstreams runs the health checks of the upstreams every interval
+func checkUpstreams(e *Env, interval time.Duration) {
+	for range time.Tick(interval) {
+		e.routes.checkHealth()
+	}
+}
+
+// checkHealth probes the targets with a health check, and waits for them
+func (rt *routes) checkHealth() {
+	rt.RLock()
+	var wg sync.WaitGroup
+	for _, t := range rt.targets {
+		wg.Add(1)
+		go func(t *target) {
+			defer wg.Done()
+			t.probe()
+		}(t)
+	}
+	rt.RUnlock()
+	wg.Wait()
+}
+
+// gauges are the state of the circuit breakers and targets of the routes,
+// for the metrics
+func (rt *routes) gauges() map[string]float64 {
+	gauges := map[string]float64{}
+	var all []*upstreamRoute
+	if table := rt.get(); table != nil {
+		for i := range table.Routes {
+			all = append(all, &table.Routes[i])
+		}
+	}
+	rt.RLock()
+	if rt.fallback != nil {
+		all = append(all, rt.fallback)
+	}
+	rt.RUnlock()
+
+	for _, route := range all {
+		gauges[series("gateway_circuit_breaker_state", "route", route.Name)] = float64(route.breaker.current())
+		for _, t := range route.targets {
+			healthy := 0.0
+			if t.available() {
+				healthy = 1
+			}
+			gauges[series("gateway_upstream_target_healthy", "route", route.Name, "target", t.url.String())] = healthy
+			gauges[series("gateway_upstream_target_active", "route", route.Name, "target", t.url.String())] = float64(atomic.LoadInt64(&t.active))
+		}
+	}
+	return gauges
+}
+
+// upstreams shows the health of the targets of each route with GET
+// /admin/upstreams
+func upstreams(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStatus {
+	if r.Method != http.MethodGet {
+		return httpStatus{http.StatusNotFound, nil, http.StatusText(http.StatusNotFound), nil}
+	}
+
+	type routeStatus struct {
+		Name    string         `json:"name"`
+		Balance string         `json:"balance"`
+		Targets []targetStatus `json:"targets"`
+	}
+
+	statuses := []routeStatus{}
+	if table := e.routes.get(); table != nil {
+		for i := range table.Routes {
+			route := &table.Routes[i]
+			s := routeStatus{route.Name, route.Balance, []targetStatus{}}
+			for _, t := range route.targets {
+				s.Targets = append(s.Targets, t.status())
+			}
+			statuses = append(statuses, s)
+		}
+	}
+
+	res, err := json.Marshal(results{"success", statuses})
+
+	if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "Error marshalling results", err}
+	}
+
+	return httpStatus{http.StatusOK, res, "", nil}
+}
@@ -0,0 +1,187 @@
+package app
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/stretchr/testify/assert"
+)
+
+// poolTarget is an upstream of a pool that answers with its name, and fails
+// its health check or requests when told to
+type poolTarget struct {
+	*httptest.Server
+	name      string
+	unhealthy int32
+	failing   int32
+}
+
+func newPoolTarget(name string) *poolTarget {
+	p := &poolTarget{name: name}
+	p.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" && atomic.LoadInt32(&p.unhealthy) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if atomic.LoadInt32(&p.failing) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(name))
+	}))
+	return p
+}
+
+// spread counts which targets n requests of the user went to
+func spread(cookie *http.Cookie, n int) map[string]int {
+	counts := map[string]int{}
+	for i := 0; i < n; i++ {
+		req, _ := http.NewRequest("GET", "/pool", nil)
+		req.AddCookie(cookie)
+		response := executeRequest(req)
+		if response.Code == http.StatusOK {
+			counts[response.Body.String()]++
+		} else {
+			counts[http.StatusText(response.Code)]++
+		}
+	}
+	return counts
+}
+
+func TestUpstreamPoolHealthChecks(t *testing.T) {
+	_, cookie := signupUser()
+
+	a, b := newPoolTarget("a"), newPoolTarget("b")
+	defer a.Close()
+	defer b.Close()
+
+	table := `{"routes": [{"name": "pool", "path_prefix": "/pool", "upstreams": ["` + a.URL + `", "` + b.URL + `"],
+		"health_check": {"path": "/health", "healthy_threshold": 1, "unhealthy_threshold": 2}}]}`
+	defer useRoutes(t, table)()
+
+	assert.Equal(t, map[string]int{"a": 2, "b": 2}, spread(cookie, 4), "Requests should be spread in turn")
+
+	atomic.StoreInt32(&b.unhealthy, 1)
+	testEnv.routes.checkHealth()
+	assert.Equal(t, map[string]int{"a": 2, "b": 2}, spread(cookie, 4), "A single failed check should not be enough")
+
+	testEnv.routes.checkHealth()
+	assert.Equal(t, map[string]int{"a": 4}, spread(cookie, 4), "Unhealthy targets should get no traffic")
+
+	assert.NoError(t, testEnv.routes.load([]byte(table)))
+	assert.Equal(t, map[string]int{"a": 4}, spread(cookie, 4), "Health should be kept across reloads")
+
+	os.Setenv("ADMIN_EMAILS", "admin-"+uniuri.New()+"@me.com")
+	defer os.Unsetenv("ADMIN_EMAILS")
+	signup, _ := http.NewRequest("POST", "/signup", bytes.NewBufferString(`{"email":"`+os.Getenv("ADMIN_EMAILS")+`","password":"secret"}`))
+	admin := executeRequest(signup).Result().Cookies()[0]
+
+	req, _ := http.NewRequest("GET", "/admin/upstreams", nil)
+	req.AddCookie(cookie)
+	assert.Equal(t, http.StatusForbidden, executeRequest(req).Code, "Users can't see the upstreams")
+
+	req, _ = http.NewRequest("GET", "/admin/upstreams", nil)
+	req.AddCookie(admin)
+	response := executeRequest(req)
+	assert.Equal(t, http.StatusOK, response.Code, "Response should be 200")
+	assert.Contains(t, response.Body.String(), `{"url":"`+b.URL+`","healthy":false,"ejected":false,"active_requests":0,"last_error":"Health check answered 500"}`)
+
+	atomic.StoreInt32(&a.unhealthy, 1)
+	testEnv.routes.checkHealth()
+	testEnv.routes.checkHealth()
+	assert.Equal(t, map[string]int{"Service Unavailable": 2}, spread(cookie, 2), "There should be no upstream left")
+
+	atomic.StoreInt32(&b.unhealthy, 0)
+	testEnv.routes.checkHealth()
+	assert.Equal(t, map[string]int{"b": 2}, spread(cookie, 2), "Targets should recover")
+}
+
+func TestUpstreamOutlierEjection(t *testing.T) {
+	_, cookie := signupUser()
+
+	a, b := newPoolTarget("a"), newPoolTarget("b")
+	defer a.Close()
+	defer b.Close()
+
+	defer useRoutes(t, `{"routes": [{"path_prefix": "/pool", "upstreams": ["`+a.URL+`", "`+b.URL+`"],
+		"outlier_detection": {"consecutive_errors": 2, "ejection": "100ms"}, "retries": {"attempts": 1}}]}`)()
+
+	atomic.StoreInt32(&b.failing, 1)
+	assert.Equal(t, map[string]int{"a": 2, "Bad Gateway": 2}, spread(cookie, 4))
+	assert.Equal(t, map[string]int{"a": 4}, spread(cookie, 4), "Failing targets should be ejected")
+
+	atomic.StoreInt32(&b.failing, 0)
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, map[string]int{"a": 2, "b": 2}, spread(cookie, 4), "Ejected targets should come back")
+}
+
+func TestUpstreamBalancing(t *testing.T) {
+	_, cookie := signupUser()
+	_, other := signupUser()
+
+	a, b := newPoolTarget("a"), newPoolTarget("b")
+	defer a.Close()
+	defer b.Close()
+
+	defer useRoutes(t, `{"routes": [{"path_prefix": "/pool", "upstreams": ["`+a.URL+`", "`+b.URL+`"], "balance": "hash",
+		"health_check": {"path": "/health", "healthy_threshold": 1, "unhealthy_threshold": 1}}]}`)()
+
+	counts := spread(cookie, 4)
+	assert.Len(t, counts, 1, "Users should stick to a target")
+	assert.Len(t, spread(other, 4), 1, "Users should stick to a target")
+
+	for name := range counts {
+		target := a
+		if name == "b" {
+			target = b
+		}
+		atomic.StoreInt32(&target.unhealthy, 1)
+	}
+	testEnv.routes.checkHealth()
+	moved := spread(cookie, 4)
+	assert.Len(t, moved, 1)
+	assert.NotEqual(t, counts, moved, "Users should move when their target is unhealthy")
+}
+
+func TestUpstreamLeastConnections(t *testing.T) {
+	_, cookie := signupUser()
+
+	release := make(chan struct{})
+	busy := make(chan string, 1)
+	slow := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/pool/slow" {
+				busy <- name
+				<-release
+			}
+			w.Write([]byte(name))
+		}))
+	}
+	a, b := slow("a"), slow("b")
+	defer a.Close()
+	defer b.Close()
+
+	defer useRoutes(t, `{"routes": [{"path_prefix": "/pool", "upstreams": ["`+a.URL+`", "`+b.URL+`"], "balance": "least_conn"}]}`)()
+
+	done := make(chan struct{})
+	go func() {
+		req, _ := http.NewRequest("GET", "/pool/slow", nil)
+		req.AddCookie(cookie)
+		executeRequest(req)
+		close(done)
+	}()
+	name := <-busy
+
+	counts := spread(cookie, 4)
+	close(release)
+	<-done
+
+	assert.Equal(t, 0, counts[name], "Requests should go to the target with the fewest in flight")
+	assert.Equal(t, 4, counts["a"]+counts["b"])
+}
@@ -0,0 +1,234 @@
+package app
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"secure/database"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	dayPeriod   = "2006-01-02"
+	monthPeriod = "2006-01"
+)
+
+// quota limits the requests, and the bytes of their bodies both ways, each
+// principal can send through a route a day and a month. Zero is no limit.
+type quota struct {
+	DailyRequests   int64 `json:"daily_requests"`
+	MonthlyRequests int64 `json:"monthly_requests"`
+	DailyBytes      int64 `json:"daily_bytes"`
+	MonthlyBytes    int64 `json:"monthly_bytes"`
+}
+
+// quotaFromEnv is the quota of the route to FORWARD_URL, from
+// QUOTA_DAILY_REQUESTS, QUOTA_MONTHLY_REQUESTS, QUOTA_DAILY_BYTES and
+// QUOTA_MONTHLY_BYTES
+func quotaFromEnv() *quota {
+	q := quota{
+		DailyRequests:   int64(envInt("QUOTA_DAILY_REQUESTS", 0)),
+		MonthlyRequests: int64(envInt("QUOTA_MONTHLY_REQUESTS", 0)),
+		DailyBytes:      int64(envInt("QUOTA_DAILY_BYTES", 0)),
+		MonthlyBytes:    int64(envInt("QUOTA_MONTHLY_BYTES", 0)),
+	}
+	if q == (quota{}) {
+		return nil
+	}
+	return &q
+}
+
+// exceeded checks the usage of the day and the month, and returns when the
+// first exceeded one resets
+func (q *quota) exceeded(day, month *database.Usage, now time.Time) (bool, time.Time) {
+	exceeds := func(u *database.Usage, requests, bytes int64) bool {
+		return (requests > 0 && u.Requests >= requests) || (bytes > 0 && u.BytesIn+u.BytesOut >= bytes)
+	}
+
+	y, m, d := now.Date()
+	if exceeds(day, q.DailyRequests, q.DailyBytes) {
+		return true, time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC)
+	}
+	if exceeds(month, q.MonthlyRequests, q.MonthlyBytes) {
+		return true, time.Date(y, m+1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	return false, time.Time{}
+}
+
+// usageSubjects are who a request is metered for: the principal, and the
+// API key and organization it was made with
+func (c *context) usageSubjects() []string {
+	subjects := []string{c.id()}
+	if c.APIKeyID != "" {
+		subjects = append(subjects, "apikey:"+c.APIKeyID)
+	}
+	if c.Org != "" {
+		subjects = append(subjects, "org:"+c.Org)
+	}
+	return subjects
+}
+
+// meter refuses requests of principals over the quota of the route with a
+// 429, and counts the others, and the bytes of their bodies, per subject and
+// route for the day and the month. Anonymous requests are not metered. The
+// bytes sent over upgraded connections are not counted.
+func meter(e *Env, w http.ResponseWriter, r *http.Request, c *context, route *upstreamRoute) httpStatus {
+	if c.Principal == "" {
+		return idempotent(e, w, r, c, route)
+	}
+
+	now := time.Now().UTC()
+	day, month := now.Format(dayPeriod), now.Format(monthPeriod)
+
+	if route.Quota != nil {
+		daily, err := e.db.GetUsage(c.id(), route.Name, day)
+		if err != nil {
+			return httpStatus{http.StatusInternalServerError, nil, "", err}
+		}
+		monthly, err := e.db.GetUsage(c.id(), route.Name, month)
+		if err != nil {
+			return httpStatus{http.StatusInternalServerError, nil, "", err}
+		}
+
+		if exceeded, reset := route.Quota.exceeded(daily, monthly, now); exceeded {
+			e.metrics.inc("gateway_quota_exceeded_total", "route", route.Name)
+			w.Header().Set("Retry-After", strconv.Itoa(int(reset.Sub(now).Seconds())))
+			return httpStatus{http.StatusTooManyRequests, nil, "Quota exceeded", nil}
+		}
+	}
+
+	in := &countingBody{ReadCloser: r.Body}
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = in
+	}
+	mw := &meteredWriter{ResponseWriter: w}
+	status := idempotent(e, mw, r, c, route)
+
+	var usage []*database.Usage
+	for _, subject := range c.usageSubjects() {
+		for _, period := range []string{day, month} {
+			usage = append(usage, &database.Usage{
+				Subject:  subject,
+				Route:    route.Name,
+				Period:   period,
+				Requests: 1,
+				BytesIn:  in.n,
+				BytesOut: mw.n,
+			})
+		}
+	}
+	if err := e.db.AddUsage(usage...); err != nil {
+		e.l.LogError(err, c.id())
+	}
+	return status
+}
+
+// countingBody counts the bytes read from a request body
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// meteredWriter counts the bytes of a response body, and lets streams be
+// flushed and connections be upgraded
+type meteredWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *meteredWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *meteredWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *meteredWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	return hj.Hijack()
+}
+
+// usagePeriod is the period of the usage asked for, the current month by
+// default
+func usagePeriod(r *http.Request) (string, bool) {
+	period := r.URL.Query().Get("period")
+	if period == "" {
+		return time.Now().UTC().Format(monthPeriod), true
+	}
+	if _, err := time.Parse(dayPeriod, period); err == nil {
+		return period, true
+	}
+	_, err := time.Parse(monthPeriod, period)
+	return period, err == nil
+}
+
+// writeUsage answers with the usage of the subject over the period asked for
+func writeUsage(e *Env, r *http.Request, subject string) httpStatus {
+	if r.Method != http.MethodGet {
+		return httpStatus{http.StatusNotFound, nil, http.StatusText(http.StatusNotFound), nil}
+	}
+
+	period, ok := usagePeriod(r)
+	if !ok {
+		return httpStatus{http.StatusBadRequest, nil, "The period must be a day, as 2006-01-02, or a month, as 2006-01", nil}
+	}
+
+	usage, err := e.db.Usage(subject, period)
+
+	if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "", err}
+	}
+
+	res, err := json.Marshal(results{"success", usage})
+
+	if err != nil {
+		return httpStatus{http.StatusInternalServerError, nil, "Error marshalling results", err}
+	}
+
+	return httpStatus{http.StatusOK, res, "", nil}
+}
+
+// myUsage shows the usage of the principal with GET /me/usage, for the
+// current month or the ?period given
+func myUsage(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStatus {
+	return writeUsage(e, r, c.id())
+}
+
+// adminUsage shows the usage of a ?subject, a user or one of apikey:<id>,
+// client:<id> or org:<id>, or of every subject, with GET /admin/usage
+func adminUsage(e *Env, w http.ResponseWriter, r *http.Request, c *context) httpStatus {
+	return writeUsage(e, r, strings.TrimSpace(r.URL.Query().Get("subject")))
+}
+
+// orgUsage shows the usage of the organization to its owners and admins
+func orgUsage(e *Env, w http.ResponseWriter, r *http.Request, c *context, orgID string) httpStatus {
+	switch orgRole(e, c, orgID) {
+	case database.OrgOwner, database.OrgAdmin:
+		return writeUsage(e, r, "org:"+orgID)
+	case "":
+		return notOrgMember(w, c)
+	}
+	return forbidden(w, forbiddenReason{
+		Code:      "org_role_required",
+		Principal: c.Principal,
+		Message:   "Only owners and admins can see the usage of the organization",
+	})
+}
@@ -0,0 +1,86 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/dchest/uniuri"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUsageQuotas(t *testing.T) {
+	email, cookie := signupUser()
+	_, other := signupUser()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("done"))
+	}))
+	defer upstream.Close()
+	defer useRoutes(t, `{"routes": [{"name": "reports", "path_prefix": "/reports", "upstream": "`+upstream.URL+`",
+		"quota": {"daily_requests": 2}}]}`)()
+
+	send := func(cookie *http.Cookie) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/reports", strings.NewReader("report"))
+		req.AddCookie(cookie)
+		return executeRequest(req)
+	}
+
+	assert.Equal(t, http.StatusOK, send(cookie).Code, "Response should be 200")
+	assert.Equal(t, http.StatusOK, send(cookie).Code, "Response should be 200")
+	response := send(cookie)
+	assert.Equal(t, http.StatusTooManyRequests, response.Code, "Requests over the quota should be refused")
+	assert.Equal(t, `{"status":"failure","result":"Quota exceeded"}`+"\n", response.Body.String())
+	assert.NotEmpty(t, response.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusOK, send(other).Code, "Quotas should be per principal")
+
+	req, _ := http.NewRequest("GET", "/me/usage", nil)
+	req.AddCookie(cookie)
+	response = executeRequest(req)
+	assert.Equal(t, http.StatusOK, response.Code, "Response should be 200")
+
+	var usage struct {
+		Result []struct {
+			Subject  string `json:"subject"`
+			Route    string `json:"route"`
+			Requests int64  `json:"requests"`
+			BytesIn  int64  `json:"bytes_in"`
+			BytesOut int64  `json:"bytes_out"`
+		} `json:"results"`
+	}
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &usage))
+	if assert.Len(t, usage.Result, 1, "The usage of the month should be reported") {
+		assert.Equal(t, email, usage.Result[0].Subject)
+		assert.Equal(t, "reports", usage.Result[0].Route)
+		assert.Equal(t, int64(2), usage.Result[0].Requests, "Refused requests should not be counted")
+		assert.Equal(t, int64(12), usage.Result[0].BytesIn)
+		assert.Equal(t, int64(8), usage.Result[0].BytesOut)
+	}
+
+	req, _ = http.NewRequest("GET", "/me/usage?period=2019", nil)
+	req.AddCookie(cookie)
+	assert.Equal(t, http.StatusBadRequest, executeRequest(req).Code, "Periods should be days or months")
+
+	req, _ = http.NewRequest("GET", "/admin/usage?subject="+email, nil)
+	req.AddCookie(other)
+	assert.Equal(t, http.StatusForbidden, executeRequest(req).Code, "Users can't see the usage of others")
+
+	os.Setenv("ADMIN_EMAILS", "admin-"+uniuri.New()+"@me.com")
+	defer os.Unsetenv("ADMIN_EMAILS")
+	signup, _ := http.NewRequest("POST", "/signup", bytes.NewBufferString(`{"email":"`+os.Getenv("ADMIN_EMAILS")+`","password":"secret"}`))
+	admin := executeRequest(signup).Result().Cookies()[0]
+
+	req, _ = http.NewRequest("GET", "/admin/usage?subject="+email, nil)
+	req.AddCookie(admin)
+	response = executeRequest(req)
+	assert.Equal(t, http.StatusOK, response.Code, "Response should be 200")
+	assert.Contains(t, response.Body.String(), `"requests":2`)
+
+	req, _ = http.NewRequest("GET", "/orgs/"+uniuri.New()+"/usage", nil)
+	req.AddCookie(cookie)
+	assert.Equal(t, http.StatusForbidden, executeRequest(req).Code, "Only members can see the usage of an organization")
+}
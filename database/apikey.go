@@ -0,0 +1,149 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/dgraph-io/badger"
+)
+
+// APIKey is a long lived credential for scripts and CI. Only a hash of the
+// secret is stored; the key itself is shown once when it is created.
+type APIKey struct {
+	model
+	ID         string    `json:"id"`
+	Email      string    `json:"email"`
+	Name       string    `json:"name,omitempty"`
+	SecretHash []byte    `json:"secret_hash,omitempty"`
+	Scopes     []string  `json:"scopes"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	RevokedAt  time.Time `json:"revoked_at"`
+}
+
+// NewAPIKey returns a new API key for the user. A zero expiresAt never
+// expires.
+func NewAPIKey(id, email, name string, secretHash []byte, scopes []string, expiresAt time.Time) *APIKey {
+	createdAt := time.Now()
+	return &APIKey{
+		ID:         id,
+		Email:      email,
+		Name:       name,
+		SecretHash: secretHash,
+		Scopes:     scopes,
+		ExpiresAt:  expiresAt,
+		model:      model{CreatedAt: createdAt, UpdatedAt: createdAt},
+	}
+}
+
+// Active checks that the key is neither revoked nor expired
+func (k *APIKey) Active() bool {
+	now := time.Now()
+	return k.RevokedAt.IsZero() && (k.ExpiresAt.IsZero() || now.Before(k.ExpiresAt))
+}
+
+func (d *datastore) AddAPIKey(k *APIKey) error {
+	_, err := d.Add("apikey", k.ID, k)
+	return err
+}
+
+func (d *datastore) GetAPIKey(id string) (*APIKey, error) {
+	bytes, err := d.Fetch("apikey", id)
+
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	var k APIKey
+	if err := json.Unmarshal(bytes, &k); err != nil {
+		return nil, err
+	}
+
+	return &k, nil
+}
+
+// APIKeys returns the keys owned by the user, without their secret hashes
+func (d *datastore) APIKeys(email string) ([]*APIKey, error) {
+	vals, err := d.List("apikey")
+
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []*APIKey{}
+	for _, v := range vals {
+		var k APIKey
+		if err := json.Unmarshal(v, &k); err != nil {
+			return nil, err
+		}
+		if k.Email == email {
+			k.SecretHash = nil
+			keys = append(keys, &k)
+		}
+	}
+
+	return keys, nil
+}
+
+func (d *datastore) UpdateAPIKey(k *APIKey) error {
+	k.UpdatedAt = time.Now()
+	return d.Update("apikey", k.ID, k)
+}
+
+// TouchAPIKey sets when the key was last used, in a single transaction so
+// that it can't undo a revocation. Revoked and deleted keys are left as they
+// are.
+func (d *datastore) TouchAPIKey(id string, at time.Time) error {
+	k := []byte("apikey:" + id)
+	go d.l.LogDBRequest("UPDATE apikey", id)
+
+	return d.db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get(k)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		var valCopy []byte
+		if err := item.Value(func(val []byte) error {
+			valCopy = append([]byte{}, val...)
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		v, err := d.decrypt(bytes.NewReader(valCopy))
+		if err != nil {
+			return err
+		}
+
+		var key APIKey
+		if err := json.Unmarshal(v, &key); err != nil {
+			return err
+		}
+		if !key.RevokedAt.IsZero() {
+			return nil
+		}
+		key.LastUsedAt = at
+
+		r, err := key.encode()
+		if err != nil {
+			return err
+		}
+
+		encrypted, err := d.encrypt(r)
+		if err != nil {
+			return err
+		}
+
+		return txn.Set(k, encrypted)
+	})
+}
+
+func (k *APIKey) encode() (io.Reader, error) {
+	v, err := json.Marshal(k)
+	return bytes.NewReader(v), err
+}
@@ -0,0 +1,79 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/dgraph-io/badger"
+)
+
+// ErrReplayed is returned when a SAML assertion has already been used
+var ErrReplayed = errors.New("Assertion already used")
+
+// Assertion records a SAML assertion that was used to log in, until it
+// expires, so that it can't be replayed
+type Assertion struct {
+	model
+	ID        string    `json:"id"`
+	Provider  string    `json:"provider"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// UseAssertion records the assertion, unless it has already been used, in a
+// single transaction
+func (d *datastore) UseAssertion(a *Assertion) error {
+	k := []byte("assertion:" + a.Provider + ":" + a.ID)
+	go d.l.LogDBRequest("INSERT INTO assertion", string(k))
+
+	return d.db.Update(func(txn *badger.Txn) error {
+		if _, err := txn.Get(k); err == nil {
+			return ErrReplayed
+		} else if err != badger.ErrKeyNotFound {
+			return err
+		}
+
+		v, err := a.encode()
+		if err != nil {
+			return err
+		}
+
+		encrypted, err := d.encrypt(v)
+		if err != nil {
+			return err
+		}
+
+		return txn.Set(k, encrypted)
+	})
+}
+
+// DeleteExpiredAssertions forgets the assertions that can no longer be
+// replayed as they have expired
+func (d *datastore) DeleteExpiredAssertions() error {
+	vals, err := d.List("assertion")
+
+	if err != nil {
+		return err
+	}
+
+	for _, v := range vals {
+		var a Assertion
+		if err := json.Unmarshal(v, &a); err != nil {
+			return err
+		}
+		if time.Now().After(a.ExpiresAt) {
+			if err := d.Delete("assertion", a.Provider+":"+a.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (a *Assertion) encode() (io.Reader, error) {
+	v, err := json.Marshal(a)
+	return bytes.NewReader(v), err
+}
@@ -0,0 +1,70 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sort"
+	"time"
+)
+
+// AuditEvent records an administrative action taken on a user
+type AuditEvent struct {
+	model
+	ID      string            `json:"id"`
+	Actor   string            `json:"actor"`
+	Action  string            `json:"action"`
+	Target  string            `json:"target"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// NewAuditEvent returns a new audit event
+func NewAuditEvent(id, actor, action, target string, details map[string]string) *AuditEvent {
+	createdAt := time.Now()
+	return &AuditEvent{
+		ID:      id,
+		Actor:   actor,
+		Action:  action,
+		Target:  target,
+		Details: details,
+		model:   model{CreatedAt: createdAt, UpdatedAt: createdAt},
+	}
+}
+
+func (d *datastore) AddAuditEvent(a *AuditEvent) error {
+	_, err := d.Add("audit", a.ID, a)
+	return err
+}
+
+// AuditEvents returns the audit events, newest first, of the target or of
+// every target when it is empty
+func (d *datastore) AuditEvents(target string) ([]*AuditEvent, error) {
+	vals, err := d.List("audit")
+
+	if err != nil {
+		return nil, err
+	}
+
+	events := []*AuditEvent{}
+	for _, v := range vals {
+		var a AuditEvent
+		if err := json.Unmarshal(v, &a); err != nil {
+			return nil, err
+		}
+		if target == "" || a.Target == target {
+			events = append(events, &a)
+		}
+	}
+
+	// ids sort in the order they were created in
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].ID > events[j].ID
+	})
+
+	return events, nil
+}
+
+func (a *AuditEvent) encode() (io.Reader, error) {
+	v, err := json.Marshal(a)
+	return bytes.NewReader(v), err
+}
@@ -0,0 +1,162 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Client is an application registered with the OpenID Connect provider
+type Client struct {
+	model
+	ID           string   `json:"client_id"`
+	Name         string   `json:"client_name,omitempty"`
+	SecretHash   []byte   `json:"secret_hash,omitempty"`
+	RedirectURIs []string `json:"redirect_uris"`
+	GrantTypes   []string `json:"grant_types,omitempty"`
+	// Scopes a machine client may request with the client_credentials grant
+	Scopes []string `json:"scopes,omitempty"`
+	// Public clients, such as single page apps, can't keep a secret
+	Public bool `json:"public,omitempty"`
+}
+
+// NewClient returns a new client, hashing its secret. Public clients are
+// created without a secret.
+func NewClient(id, name, secret string, redirectURIs, grantTypes, scopes []string) (*Client, error) {
+	createdAt := time.Now()
+	c := Client{
+		ID:           id,
+		Name:         name,
+		RedirectURIs: redirectURIs,
+		GrantTypes:   grantTypes,
+		Scopes:       scopes,
+		Public:       secret == "",
+		model:        model{CreatedAt: createdAt, UpdatedAt: createdAt},
+	}
+
+	if !c.Public {
+		hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+		c.SecretHash = hash
+	}
+
+	return &c, nil
+}
+
+// ValidSecret checks the secret a client authenticated with
+func (c *Client) ValidSecret(secret string) bool {
+	if c.Public {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(c.SecretHash, []byte(secret)) == nil
+}
+
+// ValidRedirectURI checks that uri exactly matches a registered redirect URI
+func (c *Client) ValidRedirectURI(uri string) bool {
+	for _, u := range c.RedirectURIs {
+		if u == uri {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsGrant checks that the client was registered for the grant type.
+// Clients registered without grant types use the authorization code grant.
+func (c *Client) AllowsGrant(grant string) bool {
+	if len(c.GrantTypes) == 0 {
+		return grant == "authorization_code"
+	}
+	for _, g := range c.GrantTypes {
+		if g == grant {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsScope checks that a machine client may request the scope
+func (c *Client) AllowsScope(scope string) bool {
+	for _, s := range c.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *datastore) AddClient(c *Client) error {
+	_, err := d.Add("client", c.ID, c)
+	return err
+}
+
+func (d *datastore) GetClient(id string) (*Client, error) {
+	bytes, err := d.Fetch("client", id)
+
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	var c Client
+	if err := json.Unmarshal(bytes, &c); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+func (c *Client) encode() (io.Reader, error) {
+	v, err := json.Marshal(c)
+	return bytes.NewReader(v), err
+}
+
+// AuthCode is a single use OAuth2 authorization code. Codes are stored under
+// a hash of the code so that a copy of the datastore can't be used to redeem
+// them.
+type AuthCode struct {
+	model
+	ID            string    `json:"id"`
+	ClientID      string    `json:"client_id"`
+	Email         string    `json:"email"`
+	RedirectURI   string    `json:"redirect_uri"`
+	Scope         string    `json:"scope"`
+	Nonce         string    `json:"nonce,omitempty"`
+	CodeChallenge string    `json:"code_challenge"`
+	ExpiresAt     time.Time `json:"expires_at"`
+}
+
+func (d *datastore) AddAuthCode(c *AuthCode) error {
+	_, err := d.Add("code", c.ID, c)
+	return err
+}
+
+// RedeemAuthCode returns the code and deletes it, so that it can't be used
+// twice. Expired codes are not returned.
+func (d *datastore) RedeemAuthCode(id string) (*AuthCode, error) {
+	bytes, err := d.Take("code", id)
+
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	var c AuthCode
+	if err := json.Unmarshal(bytes, &c); err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(c.ExpiresAt) {
+		return nil, ErrNotFound
+	}
+
+	return &c, nil
+}
+
+func (c *AuthCode) encode() (io.Reader, error) {
+	v, err := json.Marshal(c)
+	return bytes.NewReader(v), err
+}
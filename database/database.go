@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"secure/logger"
+	"time"
 
 	"github.com/dgraph-io/badger"
 	"github.com/minio/sio"
@@ -17,9 +18,78 @@ type Datastore interface {
 	Close() error
 	AddUser(*User) (*User, error)
 	FindUser(email, password string) (*User, error)
+	GetUser(email string) (*User, error)
+	UpdateUser(email string, update func(*User) error) (*User, error)
+	ListUsers(query string, offset, limit int) ([]*User, int, error)
+	DeleteUser(email string) error
+
+	AddAuditEvent(*AuditEvent) error
+	AuditEvents(target string) ([]*AuditEvent, error)
+	AddLoginEvent(*LoginEvent) error
+	LoginEvents(email string) ([]*LoginEvent, error)
+
+	AddIdentity(*Identity) error
+	GetIdentity(provider, subject string) (*Identity, error)
+	Identities(email string) ([]*Identity, error)
+	AddLoginState(*LoginState) error
+	TakeLoginState(id string) (*LoginState, error)
+	UseAssertion(*Assertion) error
+	AddEmailLogin(*EmailLogin) error
+	GetEmailLogin(id string) (*EmailLogin, error)
+	AttemptEmailLogin(id string, max int) (*EmailLogin, error)
+	TakeEmailLogin(id string) error
+	AddPasswordReset(*PasswordReset) error
+	GetPasswordReset(email string) (*PasswordReset, error)
+	TakePasswordReset(email string) error
+	DeleteExpiredAssertions() error
+	StartIdempotentRequest(*IdempotentRequest) (*IdempotentRequest, error)
+	UpdateIdempotentRequest(*IdempotentRequest) error
+	DeleteIdempotentRequest(id string) error
+	DeleteExpiredIdempotentRequests() error
+
+	AddUsage(...*Usage) error
+	GetUsage(subject, route, period string) (*Usage, error)
+	Usage(subject, period string) ([]*Usage, error)
+
+	UpdateRateLimit(key string, update func(*RateLimit) error) (*RateLimit, error)
+	DeleteExpiredRateLimits() error
+
+	AddExport(*Export) error
+	GetExport(id string) (*Export, error)
+	UpdateExport(*Export) error
+	Exports(email string) ([]*Export, error)
+	DeleteExport(id string) error
+
+	AddSigningKey(*SigningKey) error
+	SigningKeys() ([]*SigningKey, error)
+	DeleteSigningKey(id string) error
+
+	AddClient(*Client) error
+	GetClient(id string) (*Client, error)
+
+	AddAuthCode(*AuthCode) error
+	RedeemAuthCode(id string) (*AuthCode, error)
+
+	AddAPIKey(*APIKey) error
+	GetAPIKey(id string) (*APIKey, error)
+	APIKeys(email string) ([]*APIKey, error)
+	UpdateAPIKey(*APIKey) error
+	TouchAPIKey(id string, at time.Time) error
+
+	AddOrganization(*Organization) error
+	GetOrganization(id string) (*Organization, error)
+	AddMembership(*Membership) error
+	GetMembership(orgID, email string) (*Membership, error)
+	Memberships(email string) ([]*Membership, error)
+	OrgMembers(orgID string) ([]*Membership, error)
+	AddInvitation(*Invitation) error
+	RedeemInvitation(id string) (*Invitation, error)
 }
 
 func (d *datastore) Close() error {
+	if err := d.keys.Close(); err != nil {
+		return err
+	}
 	return d.db.Close()
 }
 
@@ -80,8 +150,41 @@ func (d *datastore) Fetch(bucket, id string) ([]byte, error) {
 	return decryptedValue, nil
 }
 
-func (d *datastore) Update(bucket, aID, id string, obj Modeler) error {
-	k := bucket + ":" + aID + ":" + id
+// Take fetches and deletes a value in a single transaction, so that it can
+// only ever be read once
+func (d *datastore) Take(bucket, id string) ([]byte, error) {
+	k := bucket + ":" + id
+	go d.l.LogDBRequest("DELETE FROM "+bucket+" RETURNING", k)
+	var valCopy []byte
+
+	err := d.db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(k))
+
+		if err != nil {
+			return err
+		}
+
+		err = item.Value(func(val []byte) error {
+			valCopy = append([]byte{}, val...)
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		return txn.Delete([]byte(k))
+	})
+
+	if err != nil {
+		return []byte{}, err
+	}
+
+	return d.decrypt(bytes.NewReader(valCopy))
+}
+
+func (d *datastore) Update(bucket, id string, obj Modeler) error {
+	k := bucket + ":" + id
 	go d.l.LogDBRequest("UPDATE "+bucket, k)
 	err := d.db.Update(func(txn *badger.Txn) error {
 		v, err := obj.encode()
@@ -102,13 +205,61 @@ func (d *datastore) Update(bucket, aID, id string, obj Modeler) error {
 	return err
 }
 
+func (d *datastore) List(bucket string) ([][]byte, error) {
+	prefix := []byte(bucket + ":")
+	go d.l.LogDBRequest("SELECT FROM "+bucket, "")
+	var vals [][]byte
+
+	err := d.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			err := it.Item().Value(func(val []byte) error {
+				vals = append(vals, append([]byte{}, val...))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i, v := range vals {
+		decryptedValue, err := d.decrypt(bytes.NewReader(v))
+		if err != nil {
+			return nil, err
+		}
+		vals[i] = decryptedValue
+	}
+
+	return vals, nil
+}
+
+func (d *datastore) Delete(bucket, id string) error {
+	k := bucket + ":" + id
+	go d.l.LogDBRequest("DELETE FROM "+bucket, k)
+	return d.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(k))
+	})
+}
+
 type datastore struct {
 	db    *badger.DB
 	l     logger.Logger
 	idKey []byte
+	// keys is the keystore of the users' data encryption keys
+	keys *badger.DB
 }
 
-// New sets up the db connection
+// New sets up the db connection. The users' data encryption keys are kept
+// in KEYSTORE_PATH, by default next to the db, so that it can be backed up
+// separately.
 func New(path string, l logger.Logger) (Datastore, error) {
 	opts := badger.DefaultOptions
 	opts.Dir = path
@@ -119,16 +270,36 @@ func New(path string, l logger.Logger) (Datastore, error) {
 		log.Fatal(err)
 	}
 
+	keystore := os.Getenv("KEYSTORE_PATH")
+	if keystore == "" {
+		keystore = path + "-keys"
+	}
+	opts.Dir = keystore
+	opts.ValueDir = keystore
+	keys, err := badger.Open(opts)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	pw := os.Getenv("DARE_PASSWORD")
 	salt := os.Getenv("DARE_SALT")
 	if pw == "" || salt == "" {
 		log.Fatal("DARE_PASSWORD & DARE_SALT env vars not set")
 	}
-	return &datastore{db, l, argon2.IDKey([]byte(pw), []byte(salt), 1, 64*1024, 4, 32)}, nil
+	return &datastore{db, l, argon2.IDKey([]byte(pw), []byte(salt), 1, 64*1024, 4, 32), keys}, nil
 }
 
 func (d *datastore) encrypt(v io.Reader) ([]byte, error) {
-	encrypted, err := sio.EncryptReader(v, sio.Config{Key: d.idKey})
+	return encryptWith(d.idKey, v)
+}
+
+func (d *datastore) decrypt(v io.Reader) ([]byte, error) {
+	return decryptWith(d.idKey, v)
+}
+
+func encryptWith(key []byte, v io.Reader) ([]byte, error) {
+	encrypted, err := sio.EncryptReader(v, sio.Config{Key: key})
 	if err != nil {
 		return []byte(""), err
 	}
@@ -137,8 +308,8 @@ func (d *datastore) encrypt(v io.Reader) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-func (d *datastore) decrypt(v io.Reader) ([]byte, error) {
-	encrypted, err := sio.DecryptReader(v, sio.Config{Key: d.idKey})
+func decryptWith(key []byte, v io.Reader) ([]byte, error) {
+	encrypted, err := sio.DecryptReader(v, sio.Config{Key: key})
 	if err != nil {
 		return []byte(""), err
 	}
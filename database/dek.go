@@ -0,0 +1,154 @@
+package database
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"strings"
+
+	"github.com/dgraph-io/badger"
+)
+
+// Each user's records are sealed with a data encryption key of their own,
+// kept in a separate keystore from the rest of the data. Deleting the key
+// when the user is purged makes any copy of their records, such as in a
+// backup, impossible to decrypt. Keys and emails used in record ids are not
+// encrypted.
+
+// sealed is a record encrypted with the key of the user that owns it
+type sealed struct {
+	Owner string `json:"owner"`
+	Data  []byte `json:"data"`
+}
+
+func (s *sealed) encode() (io.Reader, error) {
+	v, err := json.Marshal(s)
+	return bytes.NewReader(v), err
+}
+
+// userKey returns the data encryption key of the user
+func (d *datastore) userKey(email string) ([]byte, error) {
+	var stored []byte
+
+	err := d.keys.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte("dek:" + NormalizeEmail(email)))
+		if err != nil {
+			return err
+		}
+
+		return item.Value(func(val []byte) error {
+			stored = append([]byte{}, val...)
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return d.decrypt(bytes.NewReader(stored))
+}
+
+// createUserKey returns the data encryption key of the user, generating it
+// if they have none
+func (d *datastore) createUserKey(email string) ([]byte, error) {
+	k := []byte("dek:" + NormalizeEmail(email))
+	var stored []byte
+
+	err := d.keys.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get(k)
+
+		if err == nil {
+			return item.Value(func(val []byte) error {
+				stored = append([]byte{}, val...)
+				return nil
+			})
+		}
+
+		if err != badger.ErrKeyNotFound {
+			return err
+		}
+
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+
+		stored, err = d.encrypt(bytes.NewReader(key))
+		if err != nil {
+			return err
+		}
+
+		return txn.Set(k, stored)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return d.decrypt(bytes.NewReader(stored))
+}
+
+// owned checks the owner of records is a user, or an OAuth client, that
+// exists
+func (d *datastore) owned(owner string) bool {
+	if strings.HasPrefix(owner, "client:") {
+		_, err := d.Fetch("client", strings.TrimPrefix(owner, "client:"))
+		return err == nil
+	}
+	_, err := d.Fetch("user", owner)
+	return err == nil
+}
+
+// deleteUserKey crypto-shreds every record sealed for the user
+func (d *datastore) deleteUserKey(email string) error {
+	go d.l.LogDBRequest("DELETE FROM dek", email)
+	return d.keys.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte("dek:" + NormalizeEmail(email)))
+	})
+}
+
+// seal encrypts the record with the key of its owner. Keys are only
+// generated for owners that exist, so that requests for unknown ones can't
+// grow the keystore.
+func (d *datastore) seal(owner string, obj Modeler) (*sealed, error) {
+	key, err := d.userKey(owner)
+	if err == badger.ErrKeyNotFound {
+		if !d.owned(owner) {
+			return nil, ErrNotFound
+		}
+		key, err = d.createUserKey(owner)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := obj.encode()
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted, err := encryptWith(key, v)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sealed{Owner: owner, Data: encrypted}, nil
+}
+
+// unseal decrypts a sealed record. Records stored before they were sealed
+// are returned as they are.
+func (d *datastore) unseal(v []byte) ([]byte, error) {
+	var s sealed
+	if err := json.Unmarshal(v, &s); err != nil || s.Owner == "" {
+		return v, nil
+	}
+
+	key, err := d.userKey(s.Owner)
+	if err != nil {
+		return nil, err
+	}
+
+	return decryptWith(key, bytes.NewReader(s.Data))
+}
@@ -0,0 +1,148 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/dgraph-io/badger"
+)
+
+// EmailLogin is a passwordless login with a link or a code sent to the
+// user's email. It is stored under a hash of a secret kept in a cookie of
+// the browser that started it, and sealed with the key of the user.
+type EmailLogin struct {
+	model
+	ID        string    `json:"id"`
+	Email     string    `json:"email"`
+	TokenHash string    `json:"token_hash"`
+	CodeHash  string    `json:"code_hash"`
+	Attempts  int       `json:"attempts"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (d *datastore) AddEmailLogin(l *EmailLogin) error {
+	s, err := d.seal(l.Email, l)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.Add("emaillogin", l.ID, s)
+	return err
+}
+
+// GetEmailLogin returns the email login, unless it has expired
+func (d *datastore) GetEmailLogin(id string) (*EmailLogin, error) {
+	bytes, err := d.Fetch("emaillogin", id)
+
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	bytes, err = d.unseal(bytes)
+
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	var l EmailLogin
+	if err := json.Unmarshal(bytes, &l); err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(l.ExpiresAt) {
+		return nil, ErrNotFound
+	}
+
+	return &l, nil
+}
+
+// AttemptEmailLogin counts an attempt to use the email login, unless it has
+// expired, and returns it. The count is checked and incremented in a single
+// transaction, and the login is deleted once max attempts have been made, so
+// that the limit holds however many are made in parallel.
+func (d *datastore) AttemptEmailLogin(id string, max int) (*EmailLogin, error) {
+	k := []byte("emaillogin:" + id)
+	go d.l.LogDBRequest("UPDATE emaillogin", id)
+	var l EmailLogin
+	var gone bool
+
+	err := badger.ErrConflict
+	// every attempt is counted, so those that conflict with others are
+	// retried, and once the login is deleted they fail
+	for err == badger.ErrConflict {
+		err = d.db.Update(func(txn *badger.Txn) error {
+			item, err := txn.Get(k)
+			if err != nil {
+				return err
+			}
+
+			var valCopy []byte
+			if err := item.Value(func(val []byte) error {
+				valCopy = append([]byte{}, val...)
+				return nil
+			}); err != nil {
+				return err
+			}
+
+			v, err := d.decrypt(bytes.NewReader(valCopy))
+			if err != nil {
+				return err
+			}
+
+			if v, err = d.unseal(v); err != nil {
+				return err
+			}
+
+			if err := json.Unmarshal(v, &l); err != nil {
+				return err
+			}
+
+			if time.Now().After(l.ExpiresAt) || l.Attempts >= max {
+				gone = true
+				return txn.Delete(k)
+			}
+
+			l.Attempts++
+			l.UpdatedAt = time.Now()
+			s, err := d.seal(l.Email, &l)
+			if err != nil {
+				return err
+			}
+
+			r, err := s.encode()
+			if err != nil {
+				return err
+			}
+
+			encrypted, err := d.encrypt(r)
+			if err != nil {
+				return err
+			}
+
+			return txn.Set(k, encrypted)
+		})
+	}
+
+	if err != nil || gone {
+		return nil, ErrNotFound
+	}
+
+	return &l, nil
+}
+
+// TakeEmailLogin deletes the email login, so that it can only be used once.
+// It fails if the login has already been used.
+func (d *datastore) TakeEmailLogin(id string) error {
+	_, err := d.Take("emaillogin", id)
+	if err != nil {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (l *EmailLogin) encode() (io.Reader, error) {
+	v, err := json.Marshal(l)
+	return bytes.NewReader(v), err
+}
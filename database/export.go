@@ -0,0 +1,117 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// Export statuses
+const (
+	ExportPending = "pending"
+	ExportReady   = "ready"
+	ExportFailed  = "failed"
+)
+
+// Export is an archive of everything held about a user, built in the
+// background. It is sealed with the key of the user.
+type Export struct {
+	model
+	ID        string          `json:"id"`
+	Email     string          `json:"email"`
+	Status    string          `json:"status"`
+	Archive   json.RawMessage `json:"archive,omitempty"`
+	ExpiresAt time.Time       `json:"expires_at"`
+}
+
+// NewExport returns a new pending export
+func NewExport(id, email string, expiresAt time.Time) *Export {
+	createdAt := time.Now()
+	return &Export{
+		ID:        id,
+		Email:     email,
+		Status:    ExportPending,
+		ExpiresAt: expiresAt,
+		model:     model{CreatedAt: createdAt, UpdatedAt: createdAt},
+	}
+}
+
+func (d *datastore) AddExport(x *Export) error {
+	s, err := d.seal(x.Email, x)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.Add("export", x.ID, s)
+	return err
+}
+
+func (d *datastore) GetExport(id string) (*Export, error) {
+	bytes, err := d.Fetch("export", id)
+
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	bytes, err = d.unseal(bytes)
+
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	var x Export
+	if err := json.Unmarshal(bytes, &x); err != nil {
+		return nil, err
+	}
+
+	return &x, nil
+}
+
+func (d *datastore) UpdateExport(x *Export) error {
+	x.UpdatedAt = time.Now()
+	s, err := d.seal(x.Email, x)
+	if err != nil {
+		return err
+	}
+
+	return d.Update("export", x.ID, s)
+}
+
+// Exports returns the exports of the user, without their archives, or of
+// every user when email is empty. Exports of purged users are skipped.
+func (d *datastore) Exports(email string) ([]*Export, error) {
+	vals, err := d.List("export")
+
+	if err != nil {
+		return nil, err
+	}
+
+	exports := []*Export{}
+	for _, v := range vals {
+		v, err := d.unseal(v)
+		if err != nil {
+			continue
+		}
+
+		var x Export
+		if err := json.Unmarshal(v, &x); err != nil {
+			return nil, err
+		}
+		if email == "" || x.Email == email {
+			x.Archive = nil
+			exports = append(exports, &x)
+		}
+	}
+
+	return exports, nil
+}
+
+func (d *datastore) DeleteExport(id string) error {
+	return d.Delete("export", id)
+}
+
+func (x *Export) encode() (io.Reader, error) {
+	v, err := json.Marshal(x)
+	return bytes.NewReader(v), err
+}
@@ -0,0 +1,170 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/dgraph-io/badger"
+)
+
+// IdempotentRequest is a proxied request sent with an Idempotency-Key, and
+// the response of the upstream once it is done, so that it can be replayed
+// to retries. It is stored under a hash of its owner and key, and sealed
+// with the key of the owner. In flight requests expire after the timeout of
+// the proxy, so that a gateway crash doesn't lock the key until it expires.
+type IdempotentRequest struct {
+	model
+	ID          string      `json:"id"`
+	Owner       string      `json:"owner"`
+	Fingerprint string      `json:"fingerprint"`
+	Done        bool        `json:"done"`
+	Status      int         `json:"status,omitempty"`
+	Header      http.Header `json:"header,omitempty"`
+	Body        []byte      `json:"body,omitempty"`
+	ExpiresAt   time.Time   `json:"expires_at"`
+}
+
+// StartIdempotentRequest stores the in flight request, unless one with the
+// same id hasn't expired yet, in which case that one is returned, in a
+// single transaction
+func (d *datastore) StartIdempotentRequest(i *IdempotentRequest) (*IdempotentRequest, error) {
+	k := []byte("idempotency:" + i.ID)
+	go d.l.LogDBRequest("INSERT INTO idempotency", string(k))
+
+	var existing *IdempotentRequest
+	err := d.db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get(k)
+		if err == nil {
+			var valCopy []byte
+			if err := item.Value(func(val []byte) error {
+				valCopy = append([]byte{}, val...)
+				return nil
+			}); err != nil {
+				return err
+			}
+
+			v, err := d.decrypt(bytes.NewReader(valCopy))
+			if err != nil {
+				return err
+			}
+			if existing, err = d.decodeIdempotentRequest(v); err != nil {
+				return err
+			}
+			if time.Now().Before(existing.ExpiresAt) {
+				return nil
+			}
+			existing = nil
+		} else if err != badger.ErrKeyNotFound {
+			return err
+		}
+
+		s, err := d.seal(i.Owner, i)
+		if err != nil {
+			return err
+		}
+
+		v, err := s.encode()
+		if err != nil {
+			return err
+		}
+
+		encrypted, err := d.encrypt(v)
+		if err != nil {
+			return err
+		}
+
+		return txn.Set(k, encrypted)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return existing, nil
+}
+
+// UpdateIdempotentRequest stores the response of the request
+func (d *datastore) UpdateIdempotentRequest(i *IdempotentRequest) error {
+	i.UpdatedAt = time.Now()
+	s, err := d.seal(i.Owner, i)
+	if err != nil {
+		return err
+	}
+
+	return d.Update("idempotency", i.ID, s)
+}
+
+// DeleteIdempotentRequest forgets the request, so that it can be retried
+func (d *datastore) DeleteIdempotentRequest(id string) error {
+	return d.Delete("idempotency", id)
+}
+
+// deleteIdempotentRequests forgets the requests of the owner
+func (d *datastore) deleteIdempotentRequests(owner string) error {
+	vals, err := d.List("idempotency")
+
+	if err != nil {
+		return err
+	}
+
+	for _, v := range vals {
+		i, err := d.decodeIdempotentRequest(v)
+		if err != nil {
+			continue
+		}
+		if i.Owner == owner {
+			if err := d.Delete("idempotency", i.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// DeleteExpiredIdempotentRequests forgets the responses that can no longer
+// be replayed as they have expired
+func (d *datastore) DeleteExpiredIdempotentRequests() error {
+	vals, err := d.List("idempotency")
+
+	if err != nil {
+		return err
+	}
+
+	for _, v := range vals {
+		// the ones that can't be unsealed belong to purged owners
+		i, err := d.decodeIdempotentRequest(v)
+		if err != nil {
+			continue
+		}
+		if time.Now().After(i.ExpiresAt) {
+			if err := d.Delete("idempotency", i.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// decodeIdempotentRequest unseals a stored request
+func (d *datastore) decodeIdempotentRequest(v []byte) (*IdempotentRequest, error) {
+	v, err := d.unseal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var i IdempotentRequest
+	if err := json.Unmarshal(v, &i); err != nil {
+		return nil, err
+	}
+
+	return &i, nil
+}
+
+func (i *IdempotentRequest) encode() (io.Reader, error) {
+	v, err := json.Marshal(i)
+	return bytes.NewReader(v), err
+}
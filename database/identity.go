@@ -0,0 +1,130 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// Identity links a user to their account at an upstream identity provider.
+// It is sealed with the key of the user.
+type Identity struct {
+	model
+	Provider string `json:"provider"`
+	Subject  string `json:"subject"`
+	Email    string `json:"email"`
+}
+
+// LoginState is the state of a login through an upstream identity provider,
+// stored under a hash of the state parameter until the provider redirects
+// back
+type LoginState struct {
+	model
+	ID        string    `json:"id"`
+	Provider  string    `json:"provider"`
+	Verifier  string    `json:"verifier"`
+	Nonce     string    `json:"nonce"`
+	ReturnTo  string    `json:"return_to"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// NewIdentity returns a new identity
+func NewIdentity(provider, subject, email string) *Identity {
+	createdAt := time.Now()
+	return &Identity{Provider: provider, Subject: subject, Email: email, model: model{CreatedAt: createdAt, UpdatedAt: createdAt}}
+}
+
+func (d *datastore) AddIdentity(i *Identity) error {
+	s, err := d.seal(i.Email, i)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.Add("identity", i.Provider+":"+i.Subject, s)
+	return err
+}
+
+func (d *datastore) GetIdentity(provider, subject string) (*Identity, error) {
+	bytes, err := d.Fetch("identity", provider+":"+subject)
+
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	bytes, err = d.unseal(bytes)
+
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	var i Identity
+	if err := json.Unmarshal(bytes, &i); err != nil {
+		return nil, err
+	}
+
+	return &i, nil
+}
+
+// Identities returns the identities linked to the user
+func (d *datastore) Identities(email string) ([]*Identity, error) {
+	vals, err := d.List("identity")
+
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []*Identity{}
+	for _, v := range vals {
+		v, err := d.unseal(v)
+		if err != nil {
+			continue
+		}
+
+		var i Identity
+		if err := json.Unmarshal(v, &i); err != nil {
+			return nil, err
+		}
+		if i.Email == email {
+			ids = append(ids, &i)
+		}
+	}
+
+	return ids, nil
+}
+
+func (d *datastore) AddLoginState(s *LoginState) error {
+	_, err := d.Add("loginstate", s.ID, s)
+	return err
+}
+
+// TakeLoginState returns the login state and deletes it, so that a callback
+// can only be used once. Expired states are not returned.
+func (d *datastore) TakeLoginState(id string) (*LoginState, error) {
+	bytes, err := d.Take("loginstate", id)
+
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	var s LoginState
+	if err := json.Unmarshal(bytes, &s); err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(s.ExpiresAt) {
+		return nil, ErrNotFound
+	}
+
+	return &s, nil
+}
+
+func (i *Identity) encode() (io.Reader, error) {
+	v, err := json.Marshal(i)
+	return bytes.NewReader(v), err
+}
+
+func (s *LoginState) encode() (io.Reader, error) {
+	v, err := json.Marshal(s)
+	return bytes.NewReader(v), err
+}
@@ -0,0 +1,75 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// SigningKey is an asymmetric key used to sign tokens. The private key is
+// stored DER encoded and, like every value in the Datastore, encrypted at rest.
+type SigningKey struct {
+	model
+	ID         string    `json:"id"`
+	Algorithm  string    `json:"alg"`
+	PrivateKey []byte    `json:"private_key"`
+	ActiveAt   time.Time `json:"active_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// NewSigningKey returns a new signing key that is used for signing from
+// activeAt until expiresAt
+func NewSigningKey(id, alg string, privateKey []byte, activeAt, expiresAt time.Time) *SigningKey {
+	createdAt := time.Now()
+	return &SigningKey{
+		ID:         id,
+		Algorithm:  alg,
+		PrivateKey: privateKey,
+		ActiveAt:   activeAt,
+		ExpiresAt:  expiresAt,
+		model:      model{CreatedAt: createdAt, UpdatedAt: createdAt},
+	}
+}
+
+// Active is when the key starts signing, when it was created for keys
+// stored before they had one
+func (k *SigningKey) Active() time.Time {
+	if k.ActiveAt.IsZero() {
+		return k.CreatedAt
+	}
+	return k.ActiveAt
+}
+
+func (d *datastore) AddSigningKey(k *SigningKey) error {
+	_, err := d.Add("key", k.ID, k)
+	return err
+}
+
+func (d *datastore) SigningKeys() ([]*SigningKey, error) {
+	vals, err := d.List("key")
+
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]*SigningKey, 0, len(vals))
+	for _, v := range vals {
+		var k SigningKey
+		if err := json.Unmarshal(v, &k); err != nil {
+			return nil, err
+		}
+		keys = append(keys, &k)
+	}
+
+	return keys, nil
+}
+
+func (d *datastore) DeleteSigningKey(id string) error {
+	return d.Delete("key", id)
+}
+
+func (k *SigningKey) encode() (io.Reader, error) {
+	v, err := json.Marshal(k)
+	return bytes.NewReader(v), err
+}
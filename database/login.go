@@ -0,0 +1,87 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// LoginEvent records a login attempt of a user. It is sealed with the key of
+// the user, as it holds where they logged in from.
+type LoginEvent struct {
+	model
+	ID        string `json:"id"`
+	Email     string `json:"email"`
+	IP        string `json:"ip"`
+	UserAgent string `json:"user_agent"`
+	Success   bool   `json:"success"`
+	// Session is the session version a successful login was issued
+	Session int `json:"session"`
+}
+
+// NewLoginEvent returns a new login event
+func NewLoginEvent(id, email, ip, userAgent string, success bool, session int) *LoginEvent {
+	createdAt := time.Now()
+	return &LoginEvent{
+		ID:        id,
+		Email:     email,
+		IP:        ip,
+		UserAgent: userAgent,
+		Success:   success,
+		Session:   session,
+		model:     model{CreatedAt: createdAt, UpdatedAt: createdAt},
+	}
+}
+
+// loginBucket is the bucket of the login events of the user. Colons are
+// escaped so that the bucket of an email is never the prefix of another's.
+func loginBucket(email string) string {
+	return "login:" + strings.NewReplacer("%", "%25", ":", "%3A").Replace(NormalizeEmail(email))
+}
+
+func (d *datastore) AddLoginEvent(l *LoginEvent) error {
+	s, err := d.seal(l.Email, l)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.Add(loginBucket(l.Email), l.ID, s)
+	return err
+}
+
+// LoginEvents returns the login history of the user, newest first
+func (d *datastore) LoginEvents(email string) ([]*LoginEvent, error) {
+	vals, err := d.List(loginBucket(email))
+
+	if err != nil {
+		return nil, err
+	}
+
+	events := []*LoginEvent{}
+	for _, v := range vals {
+		v, err := d.unseal(v)
+		if err != nil {
+			return nil, err
+		}
+
+		var l LoginEvent
+		if err := json.Unmarshal(v, &l); err != nil {
+			return nil, err
+		}
+		events = append(events, &l)
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].ID > events[j].ID
+	})
+
+	return events, nil
+}
+
+func (l *LoginEvent) encode() (io.Reader, error) {
+	v, err := json.Marshal(l)
+	return bytes.NewReader(v), err
+}
@@ -0,0 +1,188 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sort"
+	"time"
+)
+
+// Organization roles, from most to least privileged
+const (
+	OrgOwner  = "owner"
+	OrgAdmin  = "admin"
+	OrgMember = "member"
+)
+
+// Organization is a customer org that users are members of
+type Organization struct {
+	model
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// Membership is a user's membership of an organization, with their role in
+// it
+type Membership struct {
+	model
+	OrgID string `json:"org_id"`
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
+
+// Invitation invites an email to join an organization. It is stored under a
+// hash of the token sent in the email.
+type Invitation struct {
+	model
+	ID        string    `json:"id"`
+	OrgID     string    `json:"org_id"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	InvitedBy string    `json:"invited_by"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// NewOrganization returns a new organization
+func NewOrganization(id, name string) *Organization {
+	createdAt := time.Now()
+	return &Organization{ID: id, Name: name, model: model{CreatedAt: createdAt, UpdatedAt: createdAt}}
+}
+
+// NewMembership returns a new membership
+func NewMembership(orgID, email, role string) *Membership {
+	createdAt := time.Now()
+	return &Membership{OrgID: orgID, Email: email, Role: role, model: model{CreatedAt: createdAt, UpdatedAt: createdAt}}
+}
+
+// ValidOrgRole checks the role is one of the organization roles
+func ValidOrgRole(role string) bool {
+	return role == OrgOwner || role == OrgAdmin || role == OrgMember
+}
+
+func (d *datastore) AddOrganization(o *Organization) error {
+	_, err := d.Add("org", o.ID, o)
+	return err
+}
+
+func (d *datastore) GetOrganization(id string) (*Organization, error) {
+	bytes, err := d.Fetch("org", id)
+
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	var o Organization
+	if err := json.Unmarshal(bytes, &o); err != nil {
+		return nil, err
+	}
+
+	return &o, nil
+}
+
+func (d *datastore) AddMembership(m *Membership) error {
+	m.Email = NormalizeEmail(m.Email)
+	_, err := d.Add("member", m.OrgID+":"+m.Email, m)
+	return err
+}
+
+func (d *datastore) GetMembership(orgID, email string) (*Membership, error) {
+	bytes, err := d.Fetch("member", orgID+":"+NormalizeEmail(email))
+
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	var m Membership
+	if err := json.Unmarshal(bytes, &m); err != nil {
+		return nil, err
+	}
+
+	return &m, nil
+}
+
+// Memberships returns the memberships of a user, oldest first
+func (d *datastore) Memberships(email string) ([]*Membership, error) {
+	members, err := d.listMemberships("member")
+	if err != nil {
+		return nil, err
+	}
+
+	ms := []*Membership{}
+	for _, m := range members {
+		if NormalizeEmail(m.Email) == NormalizeEmail(email) {
+			ms = append(ms, m)
+		}
+	}
+
+	sort.Slice(ms, func(i, j int) bool {
+		return ms[i].CreatedAt.Before(ms[j].CreatedAt)
+	})
+
+	return ms, nil
+}
+
+// OrgMembers returns the members of an organization
+func (d *datastore) OrgMembers(orgID string) ([]*Membership, error) {
+	return d.listMemberships("member:" + orgID)
+}
+
+func (d *datastore) listMemberships(bucket string) ([]*Membership, error) {
+	vals, err := d.List(bucket)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ms := make([]*Membership, 0, len(vals))
+	for _, v := range vals {
+		var m Membership
+		if err := json.Unmarshal(v, &m); err != nil {
+			return nil, err
+		}
+		ms = append(ms, &m)
+	}
+
+	return ms, nil
+}
+
+func (d *datastore) AddInvitation(i *Invitation) error {
+	_, err := d.Add("invitation", i.ID, i)
+	return err
+}
+
+// RedeemInvitation returns the invitation and deletes it, so that it can't be
+// accepted twice. Expired invitations are not returned.
+func (d *datastore) RedeemInvitation(id string) (*Invitation, error) {
+	bytes, err := d.Take("invitation", id)
+
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	var i Invitation
+	if err := json.Unmarshal(bytes, &i); err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(i.ExpiresAt) {
+		return nil, ErrNotFound
+	}
+
+	return &i, nil
+}
+
+func (o *Organization) encode() (io.Reader, error) {
+	v, err := json.Marshal(o)
+	return bytes.NewReader(v), err
+}
+
+func (m *Membership) encode() (io.Reader, error) {
+	v, err := json.Marshal(m)
+	return bytes.NewReader(v), err
+}
+
+func (i *Invitation) encode() (io.Reader, error) {
+	v, err := json.Marshal(i)
+	return bytes.NewReader(v), err
+}
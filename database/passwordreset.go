@@ -0,0 +1,71 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// PasswordReset is the token emailed to a user an admin required to reset
+// their password, which they change it with instead of their current one. It
+// is stored under the user's email, and sealed with the key of the user.
+type PasswordReset struct {
+	model
+	Email     string    `json:"email"`
+	TokenHash string    `json:"token_hash"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// AddPasswordReset replaces the password reset of the user
+func (d *datastore) AddPasswordReset(p *PasswordReset) error {
+	s, err := d.seal(p.Email, p)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.Add("passwordreset", p.Email, s)
+	return err
+}
+
+// GetPasswordReset returns the password reset of the user, unless it has
+// expired
+func (d *datastore) GetPasswordReset(email string) (*PasswordReset, error) {
+	bytes, err := d.Fetch("passwordreset", email)
+
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	bytes, err = d.unseal(bytes)
+
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	var p PasswordReset
+	if err := json.Unmarshal(bytes, &p); err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(p.ExpiresAt) {
+		return nil, ErrNotFound
+	}
+
+	return &p, nil
+}
+
+// TakePasswordReset deletes the password reset of the user, so that it can
+// only be used once. It fails if it has already been used.
+func (d *datastore) TakePasswordReset(email string) error {
+	_, err := d.Take("passwordreset", email)
+	if err != nil {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (p *PasswordReset) encode() (io.Reader, error) {
+	v, err := json.Marshal(p)
+	return bytes.NewReader(v), err
+}
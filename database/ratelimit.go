@@ -0,0 +1,110 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/dgraph-io/badger"
+)
+
+// RateLimit is the token bucket of a rate limit key, stored when limits are
+// meant to survive restarts. It expires once it is full again, as it is then
+// the same as a new one.
+type RateLimit struct {
+	Key       string    `json:"key"`
+	Tokens    float64   `json:"tokens"`
+	UpdatedAt time.Time `json:"updated_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// UpdateRateLimit updates the bucket of the key in a single transaction.
+// Buckets that don't exist, or have expired, are passed to update with only
+// their key set.
+func (d *datastore) UpdateRateLimit(key string, update func(*RateLimit) error) (*RateLimit, error) {
+	k := []byte("ratelimit:" + key)
+	go d.l.LogDBRequest("UPDATE ratelimit", key)
+
+	var l *RateLimit
+	err := badger.ErrConflict
+	// concurrent requests with the same key update the same bucket
+	for attempt := 0; attempt < 5 && err == badger.ErrConflict; attempt++ {
+		err = d.db.Update(func(txn *badger.Txn) error {
+			l = &RateLimit{Key: key}
+
+			item, err := txn.Get(k)
+			if err == nil {
+				var valCopy []byte
+				if err := item.Value(func(val []byte) error {
+					valCopy = append([]byte{}, val...)
+					return nil
+				}); err != nil {
+					return err
+				}
+
+				v, err := d.decrypt(bytes.NewReader(valCopy))
+				if err != nil {
+					return err
+				}
+				if err := json.Unmarshal(v, l); err != nil {
+					return err
+				}
+				if time.Now().After(l.ExpiresAt) {
+					l = &RateLimit{Key: key}
+				}
+			} else if err != badger.ErrKeyNotFound {
+				return err
+			}
+
+			if err := update(l); err != nil {
+				return err
+			}
+
+			v, err := l.encode()
+			if err != nil {
+				return err
+			}
+
+			encrypted, err := d.encrypt(v)
+			if err != nil {
+				return err
+			}
+
+			return txn.Set(k, encrypted)
+		})
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// DeleteExpiredRateLimits forgets the buckets that are full again
+func (d *datastore) DeleteExpiredRateLimits() error {
+	vals, err := d.List("ratelimit")
+
+	if err != nil {
+		return err
+	}
+
+	for _, v := range vals {
+		var l RateLimit
+		if err := json.Unmarshal(v, &l); err != nil {
+			return err
+		}
+		if time.Now().After(l.ExpiresAt) {
+			if err := d.Delete("ratelimit", l.Key); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (l *RateLimit) encode() (io.Reader, error) {
+	v, err := json.Marshal(l)
+	return bytes.NewReader(v), err
+}
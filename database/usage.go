@@ -0,0 +1,161 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger"
+)
+
+// Usage counts the requests, and the bytes of their bodies, a subject sent
+// through a route of the gateway over a day, as 2006-01-02, or a month, as
+// 2006-01. Subjects are users, by email, and API keys, machine clients and
+// organizations as apikey:<id>, client:<id> and org:<id>.
+type Usage struct {
+	model
+	Subject  string `json:"subject"`
+	Route    string `json:"route"`
+	Period   string `json:"period"`
+	Requests int64  `json:"requests"`
+	BytesIn  int64  `json:"bytes_in"`
+	BytesOut int64  `json:"bytes_out"`
+}
+
+func (u *Usage) id() string {
+	return strings.ToLower(u.Subject) + ":" + u.Period + ":" + u.Route
+}
+
+// AddUsage adds the counts of each usage to the stored ones, in a single
+// transaction
+func (d *datastore) AddUsage(usage ...*Usage) error {
+	go d.l.LogDBRequest("UPDATE usage", "")
+
+	err := badger.ErrConflict
+	// concurrent requests of a subject update the same counters
+	for attempt := 0; attempt < 5 && err == badger.ErrConflict; attempt++ {
+		err = d.db.Update(func(txn *badger.Txn) error {
+			for _, u := range usage {
+				k := []byte("usage:" + u.id())
+				stored := *u
+				stored.model = model{CreatedAt: time.Now()}
+
+				item, err := txn.Get(k)
+				if err == nil {
+					var valCopy []byte
+					if err := item.Value(func(val []byte) error {
+						valCopy = append([]byte{}, val...)
+						return nil
+					}); err != nil {
+						return err
+					}
+
+					v, err := d.decrypt(bytes.NewReader(valCopy))
+					if err != nil {
+						return err
+					}
+					if err := json.Unmarshal(v, &stored); err != nil {
+						return err
+					}
+					stored.Requests += u.Requests
+					stored.BytesIn += u.BytesIn
+					stored.BytesOut += u.BytesOut
+				} else if err != badger.ErrKeyNotFound {
+					return err
+				}
+				stored.UpdatedAt = time.Now()
+
+				v, err := stored.encode()
+				if err != nil {
+					return err
+				}
+
+				encrypted, err := d.encrypt(v)
+				if err != nil {
+					return err
+				}
+
+				if err := txn.Set(k, encrypted); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+
+	return err
+}
+
+// GetUsage returns the usage of the subject on the route over the period,
+// which is zero when there is none
+func (d *datastore) GetUsage(subject, route, period string) (*Usage, error) {
+	u := &Usage{Subject: subject, Route: route, Period: period}
+	bytes, err := d.Fetch("usage", u.id())
+
+	if err == badger.ErrKeyNotFound {
+		return u, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(bytes, u); err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+// Usage returns the usage of the subject on every route over the period, or
+// of every subject when it is empty
+func (d *datastore) Usage(subject, period string) ([]*Usage, error) {
+	bucket := "usage"
+	if subject != "" {
+		bucket += ":" + strings.ToLower(subject)
+	}
+	vals, err := d.List(bucket)
+
+	if err != nil {
+		return nil, err
+	}
+
+	usage := []*Usage{}
+	for _, v := range vals {
+		var u Usage
+		if err := json.Unmarshal(v, &u); err != nil {
+			return nil, err
+		}
+		// subjects may contain colons, so others can share the prefix
+		if subject != "" && !strings.EqualFold(u.Subject, subject) {
+			continue
+		}
+		if period == "" || u.Period == period {
+			usage = append(usage, &u)
+		}
+	}
+
+	return usage, nil
+}
+
+// deleteUsage forgets the usage of the subject
+func (d *datastore) deleteUsage(subject string) error {
+	usage, err := d.Usage(subject, "")
+
+	if err != nil {
+		return err
+	}
+
+	for _, u := range usage {
+		if err := d.Delete("usage", u.id()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (u *Usage) encode() (io.Reader, error) {
+	v, err := json.Marshal(u)
+	return bytes.NewReader(v), err
+}
@@ -5,14 +5,19 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/dgraph-io/badger"
 	"golang.org/x/crypto/bcrypt"
 )
 
 var (
 	// ErrInvalidUsernameAndPassword when can't login
 	ErrInvalidUsernameAndPassword = errors.New("Incorrect username and/or password")
+	// ErrNotFound when a record doesn't exist
+	ErrNotFound = errors.New("Not found")
 )
 
 // User is the user struct, storing each user
@@ -22,6 +27,27 @@ type User struct {
 	FirstName    string `json:"first_name,omitempty"`
 	LastName     string `json:"last_name,omitempty"`
 	PasswordSalt []byte `json:",omitempty"`
+	// Roles and Permissions are carried in the user's tokens
+	Roles       []string `json:"roles,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+	// Disabled users can neither log in nor use their tokens or API keys
+	Disabled bool `json:"disabled,omitempty"`
+	// PasswordResetRequired users must change their password before they can
+	// do anything else
+	PasswordResetRequired bool      `json:"password_reset_required,omitempty"`
+	FailedLogins          int       `json:"failed_logins,omitempty"`
+	LockedUntil           time.Time `json:"locked_until"`
+	// SessionVersion is carried in tokens; bumping it revokes every session
+	SessionVersion int `json:"session_version,omitempty"`
+	// DeletedAt is when the user was deleted. They are purged for good at the
+	// end of a grace period, during which they can be restored.
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// NormalizeEmail returns the form of emails that users are stored under, so
+// that the same address can't be signed up for twice in different cases
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
 }
 
 // NewActivity returns a new activity
@@ -34,8 +60,9 @@ func NewUser(email, password string) (*User, error) {
 	}
 
 	u := User{
-		Email:        email,
+		Email:        NormalizeEmail(email),
 		PasswordSalt: hash,
+		Roles:        []string{"user"},
 		model:        model{CreatedAt: createdAt, UpdatedAt: createdAt},
 	}
 
@@ -43,11 +70,22 @@ func NewUser(email, password string) (*User, error) {
 }
 
 func (d *datastore) AddUser(u *User) (*User, error) {
+	u.Email = NormalizeEmail(u.Email)
 	_, err := d.Fetch("user", u.Email)
 
 	if err != nil {
+		// the user's key is made as they are added, as seal only makes keys
+		// for users that exist
+		if _, err := d.createUserKey(u.Email); err != nil {
+			return nil, err
+		}
 
-		_, err := d.Add("user", u.Email, u)
+		s, err := d.seal(u.Email, u)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = d.Add("user", u.Email, s)
 
 		// remove the password salt
 		u.PasswordSalt = []byte{}
@@ -58,15 +96,32 @@ func (d *datastore) AddUser(u *User) (*User, error) {
 	return nil, errors.New("Email already exists")
 }
 
-func (d *datastore) FindUser(email, password string) (*User, error) {
-	bytes, err := d.Fetch("user", email)
+// fetchUser fetches and unseals the user, with their password
+func (d *datastore) fetchUser(email string) (*User, error) {
+	bytes, err := d.Fetch("user", NormalizeEmail(email))
 
 	if err != nil {
-		return nil, ErrInvalidUsernameAndPassword
+		return nil, ErrNotFound
+	}
+
+	bytes, err = d.unseal(bytes)
+
+	if err != nil {
+		return nil, err
 	}
 
 	var u User
-	if json.Unmarshal(bytes, &u) != nil {
+	if err := json.Unmarshal(bytes, &u); err != nil {
+		return nil, err
+	}
+
+	return &u, nil
+}
+
+func (d *datastore) FindUser(email, password string) (*User, error) {
+	u, err := d.fetchUser(email)
+
+	if err != nil {
 		return nil, ErrInvalidUsernameAndPassword
 	}
 
@@ -77,9 +132,238 @@ func (d *datastore) FindUser(email, password string) (*User, error) {
 	// remove the password salt
 	u.PasswordSalt = []byte{}
 
+	return u, nil
+}
+
+func (d *datastore) GetUser(email string) (*User, error) {
+	u, err := d.fetchUser(email)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// remove the password salt
+	u.PasswordSalt = []byte{}
+
+	return u, nil
+}
+
+// UpdateUser applies update to the stored user, keeping its password. The
+// user is read and written in a single transaction, which is retried with
+// update applied again when it conflicts with another, and fails with
+// ErrNotFound once the user is gone.
+func (d *datastore) UpdateUser(email string, update func(*User) error) (*User, error) {
+	k := []byte("user:" + NormalizeEmail(email))
+	go d.l.LogDBRequest("UPDATE user", email)
+	var u User
+
+	err := badger.ErrConflict
+	for err == badger.ErrConflict {
+		err = d.db.Update(func(txn *badger.Txn) error {
+			item, err := txn.Get(k)
+			if err == badger.ErrKeyNotFound {
+				return ErrNotFound
+			} else if err != nil {
+				return err
+			}
+
+			var valCopy []byte
+			if err := item.Value(func(val []byte) error {
+				valCopy = append([]byte{}, val...)
+				return nil
+			}); err != nil {
+				return err
+			}
+
+			v, err := d.decrypt(bytes.NewReader(valCopy))
+			if err != nil {
+				return err
+			}
+
+			if v, err = d.unseal(v); err != nil {
+				return err
+			}
+
+			u = User{}
+			if err := json.Unmarshal(v, &u); err != nil {
+				return err
+			}
+
+			if err := update(&u); err != nil {
+				return err
+			}
+
+			u.UpdatedAt = time.Now()
+			s, err := d.seal(u.Email, &u)
+			if err != nil {
+				return err
+			}
+
+			r, err := s.encode()
+			if err != nil {
+				return err
+			}
+
+			encrypted, err := d.encrypt(r)
+			if err != nil {
+				return err
+			}
+
+			return txn.Set(k, encrypted)
+		})
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// remove the password salt
+	u.PasswordSalt = []byte{}
+
 	return &u, nil
 }
 
+// SetPassword replaces the password of the user
+func (u *User) SetPassword(password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+
+	if err != nil {
+		return err
+	}
+
+	u.PasswordSalt = hash
+	return nil
+}
+
+// Locked checks if the user is locked out after too many failed logins
+func (u *User) Locked() bool {
+	return u.LockedUntil.After(time.Now())
+}
+
+// Deleted checks if the user has been deleted and is waiting to be purged
+func (u *User) Deleted() bool {
+	return !u.DeletedAt.IsZero()
+}
+
+// ListUsers returns the users whose email or name contains the query, sorted
+// by email, from offset up to limit of them, along with the number matching
+func (d *datastore) ListUsers(query string, offset, limit int) ([]*User, int, error) {
+	vals, err := d.List("user")
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	query = strings.ToLower(query)
+	users := []*User{}
+	for _, v := range vals {
+		// records whose key has been shredded can't be read
+		v, err := d.unseal(v)
+		if err != nil {
+			continue
+		}
+
+		var u User
+		if err := json.Unmarshal(v, &u); err != nil {
+			return nil, 0, err
+		}
+		if query == "" || strings.Contains(strings.ToLower(u.Email+" "+u.FirstName+" "+u.LastName), query) {
+			u.PasswordSalt = []byte{}
+			users = append(users, &u)
+		}
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Email < users[j].Email
+	})
+
+	total := len(users)
+	if offset > total {
+		offset = total
+	}
+	if limit > 0 && offset+limit < total {
+		return users[offset : offset+limit], total, nil
+	}
+	return users[offset:], total, nil
+}
+
+// DeleteUser purges the user along with their API keys, memberships, linked
+// identities, login history and exports, and shreds their data encryption key
+func (d *datastore) DeleteUser(email string) error {
+	email = NormalizeEmail(email)
+	if _, err := d.Fetch("user", email); err != nil {
+		return ErrNotFound
+	}
+
+	keys, err := d.APIKeys(email)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := d.Delete("apikey", k.ID); err != nil {
+			return err
+		}
+	}
+
+	memberships, err := d.Memberships(email)
+	if err != nil {
+		return err
+	}
+	for _, m := range memberships {
+		if err := d.Delete("member", m.OrgID+":"+NormalizeEmail(m.Email)); err != nil {
+			return err
+		}
+	}
+
+	identities, err := d.Identities(email)
+	if err != nil {
+		return err
+	}
+	for _, i := range identities {
+		if err := d.Delete("identity", i.Provider+":"+i.Subject); err != nil {
+			return err
+		}
+	}
+
+	logins, err := d.LoginEvents(email)
+	if err != nil {
+		return err
+	}
+	for _, l := range logins {
+		if err := d.Delete(loginBucket(email), l.ID); err != nil {
+			return err
+		}
+	}
+
+	exports, err := d.Exports(email)
+	if err != nil {
+		return err
+	}
+	for _, x := range exports {
+		if err := d.DeleteExport(x.ID); err != nil {
+			return err
+		}
+	}
+
+	if err := d.Delete("passwordreset", email); err != nil {
+		return err
+	}
+
+	if err := d.deleteIdempotentRequests(email); err != nil {
+		return err
+	}
+
+	if err := d.deleteUsage(email); err != nil {
+		return err
+	}
+
+	if err := d.Delete("user", email); err != nil {
+		return err
+	}
+
+	return d.deleteUserKey(email)
+}
+
 func (u *User) encode() (io.Reader, error) {
 	v, err := json.Marshal(u)
 	return bytes.NewReader(v), err
@@ -0,0 +1,222 @@
+// Package identity verifies the identity assertions the secure gateway sends
+// to upstream services, so that they can trust who a request is from without
+// trusting everything that can reach them. Assertions are short lived JWTs
+// scoped to the audience of the upstream, signed with the keys of the gateway
+// or a secret shared with the upstream.
+//
+//	v := &identity.Verifier{Audience: "billing", JWKSURL: "https://auth.example.com/.well-known/jwks.json"}
+//	http.ListenAndServe(":8080", v.Middleware(mux))
+//
+// Handlers then get the identity with identity.FromContext(r.Context()).
+package identity
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"secure/jwk"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Header is the request header the gateway sends assertions in
+const Header = "X-Identity-Assertion"
+
+// Type is the typ header of assertions, which sets them apart from the
+// other tokens of the gateway
+const Type = "identity+jwt"
+
+// refetchInterval is how often the key set is fetched again at most, when an
+// assertion is signed with a key that isn't in it
+const refetchInterval = time.Minute
+
+// client fetches the key sets of verifiers without a client of their own
+var client = &http.Client{Timeout: 10 * time.Second}
+
+var (
+	// ErrMissing is returned when a request has no assertion
+	ErrMissing = errors.New("identity: missing assertion")
+	// ErrInvalid is returned for assertions that are not valid for the
+	// verifier
+	ErrInvalid = errors.New("identity: invalid assertion")
+)
+
+// Identity is the principal a request is from. Subject is the email of users
+// and client:<id> for OAuth clients.
+type Identity struct {
+	Principal string   `json:"principal"`
+	Email     string   `json:"email,omitempty"`
+	FirstName string   `json:"first_name,omitempty"`
+	LastName  string   `json:"last_name,omitempty"`
+	Roles     []string `json:"roles,omitempty"`
+	Session   int      `json:"sid,omitempty"`
+	ClientID  string   `json:"client_id,omitempty"`
+	APIKeyID  string   `json:"api_key_id,omitempty"`
+	Scopes    []string `json:"scopes,omitempty"`
+	Org       string   `json:"org,omitempty"`
+	OrgRole   string   `json:"org_role,omitempty"`
+	jwt.StandardClaims
+}
+
+// Verifier verifies assertions for an audience. They are HS256 ones when
+// Secret is set, and otherwise signed with a key of the set at JWKSURL.
+type Verifier struct {
+	Audience string
+	// Issuer, when set, must be the issuer of the assertions
+	Issuer  string
+	Secret  []byte
+	JWKSURL string
+	// Client fetches the key set, a client with a 10 second timeout when nil
+	Client *http.Client
+
+	mu      sync.Mutex
+	keys    jwk.Set
+	fetched time.Time
+	// fetching is closed when the fetch in flight is done, with fetchErr
+	fetching chan struct{}
+	fetchErr error
+}
+
+// Verify returns the identity of a valid assertion
+func (v *Verifier) Verify(assertion string) (*Identity, error) {
+	if assertion == "" {
+		return nil, ErrMissing
+	}
+
+	var id Identity
+	token, err := jwt.ParseWithClaims(assertion, &id, v.key)
+	if err != nil || !token.Valid {
+		return nil, ErrInvalid
+	}
+
+	if typ, _ := token.Header["typ"].(string); typ != Type {
+		return nil, ErrInvalid
+	}
+	if v.Audience == "" || !id.VerifyAudience(v.Audience, true) {
+		return nil, ErrInvalid
+	}
+	if v.Issuer != "" && !id.VerifyIssuer(v.Issuer, true) {
+		return nil, ErrInvalid
+	}
+	if id.ExpiresAt == 0 || id.Subject == "" {
+		return nil, ErrInvalid
+	}
+
+	return &id, nil
+}
+
+// key is the jwt.Keyfunc of the verifier
+func (v *Verifier) key(token *jwt.Token) (interface{}, error) {
+	if v.Secret != nil {
+		if token.Method != jwt.SigningMethodHS256 {
+			return nil, ErrInvalid
+		}
+		return v.Secret, nil
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	k, err := v.jwk(kid)
+	if err != nil {
+		return nil, err
+	}
+
+	if k.Alg != "" && k.Alg != token.Method.Alg() {
+		return nil, ErrInvalid
+	}
+	return k.PublicKey()
+}
+
+// jwk returns the key with the kid, fetching the key set again when it is
+// not in it, as after the gateway rotated its keys. Concurrent verifications
+// wait for the same fetch, and the set is fetched once a refetchInterval at
+// most.
+func (v *Verifier) jwk(kid string) (jwk.Key, error) {
+	v.mu.Lock()
+	if k, ok := v.keys.Key(kid); ok {
+		v.mu.Unlock()
+		return k, nil
+	}
+
+	done := v.fetching
+	if done == nil {
+		if !v.fetched.IsZero() && time.Since(v.fetched) < refetchInterval {
+			v.mu.Unlock()
+			return jwk.Key{}, ErrInvalid
+		}
+
+		v.fetched = time.Now()
+		done = make(chan struct{})
+		v.fetching = done
+		v.mu.Unlock()
+
+		keys, err := v.fetch()
+
+		v.mu.Lock()
+		if err == nil {
+			v.keys = keys
+		}
+		v.fetchErr = err
+		v.fetching = nil
+		close(done)
+	} else {
+		v.mu.Unlock()
+		<-done
+		v.mu.Lock()
+	}
+	defer v.mu.Unlock()
+
+	if k, ok := v.keys.Key(kid); ok {
+		return k, nil
+	}
+	if v.fetchErr != nil {
+		return jwk.Key{}, v.fetchErr
+	}
+	return jwk.Key{}, ErrInvalid
+}
+
+// fetch fetches the key set
+func (v *Verifier) fetch() (jwk.Set, error) {
+	c := v.Client
+	if c == nil {
+		c = client
+	}
+
+	res, err := c.Get(v.JWKSURL)
+	if err != nil {
+		return jwk.Set{}, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return jwk.Set{}, fmt.Errorf("identity: fetching keys answered %d", res.StatusCode)
+	}
+
+	var keys jwk.Set
+	err = json.NewDecoder(res.Body).Decode(&keys)
+	return keys, err
+}
+
+type contextKey struct{}
+
+// Middleware only lets requests with a valid assertion through to next, with
+// their identity in their context
+func (v *Verifier) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := v.Verify(r.Header.Get(Header))
+		if err != nil {
+			http.Error(w, `{"status":"failure","result":"`+http.StatusText(http.StatusUnauthorized)+`"}`, http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, id)))
+	})
+}
+
+// FromContext returns the identity the middleware verified
+func FromContext(ctx context.Context) (*Identity, bool) {
+	id, ok := ctx.Value(contextKey{}).(*Identity)
+	return id, ok
+}
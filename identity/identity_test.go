@@ -0,0 +1,115 @@
+package identity
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"secure/jwk"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// assertion signs an assertion for the audience with the key
+func assertion(t *testing.T, method jwt.SigningMethod, kid, audience string, key interface{}) string {
+	token := jwt.NewWithClaims(method, &Identity{
+		Principal: "user",
+		Email:     "user@me.com",
+		StandardClaims: jwt.StandardClaims{
+			Subject:   "user@me.com",
+			Audience:  audience,
+			ExpiresAt: time.Now().Add(time.Minute).Unix(),
+		},
+	})
+	token.Header["typ"] = Type
+	token.Header["kid"] = kid
+	ss, err := token.SignedString(key)
+	assert.NoError(t, err)
+	return ss
+}
+
+// keySet serves the key set, counting the fetches, once release is closed
+func keySet(t *testing.T, kid string, key *ecdsa.PrivateKey, fetches *int32, release chan struct{}) *httptest.Server {
+	k, err := jwk.New(kid, "ES256", &key.PublicKey)
+	assert.NoError(t, err)
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(fetches, 1)
+		<-release
+		json.NewEncoder(w).Encode(jwk.Set{Keys: []jwk.Key{k}})
+	}))
+}
+
+func TestVerifySecret(t *testing.T) {
+	v := &Verifier{Audience: "billing", Secret: []byte("secret")}
+
+	id, err := v.Verify(assertion(t, jwt.SigningMethodHS256, "", "billing", []byte("secret")))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "user@me.com", id.Email)
+	}
+
+	_, err = v.Verify(assertion(t, jwt.SigningMethodHS256, "", "search", []byte("secret")))
+	assert.Equal(t, ErrInvalid, err, "Assertions for other audiences should be refused")
+
+	_, err = v.Verify(assertion(t, jwt.SigningMethodHS256, "", "billing", []byte("other")))
+	assert.Equal(t, ErrInvalid, err, "Assertions signed with other secrets should be refused")
+
+	_, err = v.Verify("")
+	assert.Equal(t, ErrMissing, err)
+}
+
+func TestVerifyKeySet(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	var fetches int32
+	release := make(chan struct{})
+	keys := keySet(t, "k1", key, &fetches, release)
+	defer keys.Close()
+
+	v := &Verifier{Audience: "billing", JWKSURL: keys.URL}
+	ss := assertion(t, jwt.SigningMethodES256, "k1", "billing", key)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := v.Verify(ss)
+			assert.NoError(t, err)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetches), "Concurrent verifications should wait for the same fetch")
+
+	_, err := v.Verify(assertion(t, jwt.SigningMethodES256, "k2", "billing", key))
+	assert.Equal(t, ErrInvalid, err, "Assertions signed with unknown keys should be refused")
+	_, err = v.Verify(assertion(t, jwt.SigningMethodES256, "k3", "billing", key))
+	assert.Equal(t, ErrInvalid, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetches), "Unknown keys should not fetch the key set more than once a minute")
+
+	_, err = v.Verify(ss)
+	assert.NoError(t, err, "Known keys should still be verified")
+}
+
+func TestVerifyKeySetTimeout(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	var fetches int32
+	release := make(chan struct{})
+	keys := keySet(t, "k1", key, &fetches, release)
+	defer keys.Close()
+	defer close(release)
+
+	v := &Verifier{Audience: "billing", JWKSURL: keys.URL, Client: &http.Client{Timeout: 50 * time.Millisecond}}
+	_, err := v.Verify(assertion(t, jwt.SigningMethodES256, "k1", "billing", key))
+	assert.Error(t, err, "Key sets taking too long should fail the verification")
+
+	assert.Equal(t, 10*time.Second, client.Timeout, "Key sets should be fetched with a timeout by default")
+}
@@ -0,0 +1,148 @@
+// Package jwk encodes public keys as JSON Web Keys (RFC 7517) so that tokens
+// signed by the secure service can be verified by anyone holding the key set,
+// and decodes the key sets of other providers.
+package jwk
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"math/big"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+var (
+	// ErrUnsupportedKey is returned for key types that can't be represented
+	ErrUnsupportedKey = errors.New("jwk: unsupported key type")
+	// ErrInvalidKey is returned for keys whose parameters don't decode
+	ErrInvalidKey = errors.New("jwk: invalid key")
+)
+
+// Key is a single public JSON Web Key
+type Key struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// Set is a JSON Web Key Set as served from /.well-known/jwks.json
+type Set struct {
+	Keys []Key `json:"keys"`
+}
+
+// New returns the JSON Web Key for an RSA, ECDSA or Ed25519 public key
+func New(kid, alg string, pub interface{}) (Key, error) {
+	k := Key{Kid: kid, Alg: alg, Use: "sig"}
+
+	switch p := pub.(type) {
+	case *rsa.PublicKey:
+		k.Kty = "RSA"
+		k.N = encode(p.N.Bytes())
+		k.E = encode(big.NewInt(int64(p.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (p.Curve.Params().BitSize + 7) / 8
+		k.Kty = "EC"
+		k.Crv = p.Curve.Params().Name
+		k.X = encode(pad(p.X.Bytes(), size))
+		k.Y = encode(pad(p.Y.Bytes(), size))
+	case ed25519.PublicKey:
+		k.Kty = "OKP"
+		k.Crv = "Ed25519"
+		k.X = encode(p)
+	default:
+		return Key{}, ErrUnsupportedKey
+	}
+
+	return k, nil
+}
+
+// Key returns the key of the set with the kid
+func (s Set) Key(kid string) (Key, bool) {
+	for _, k := range s.Keys {
+		if k.Kid == kid {
+			return k, true
+		}
+	}
+	return Key{}, false
+}
+
+// PublicKey decodes the key to an *rsa.PublicKey, *ecdsa.PublicKey or
+// ed25519.PublicKey
+func (k Key) PublicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil || len(e) > 4 {
+			return nil, ErrInvalidKey
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, ErrUnsupportedKey
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, ErrInvalidKey
+		}
+		return pub, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, ErrUnsupportedKey
+		}
+		x, err := decode(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, ErrInvalidKey
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, ErrUnsupportedKey
+}
+
+func decode(s string) ([]byte, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, ErrInvalidKey
+	}
+	return b, nil
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// pad left pads EC coordinates to the full size of the curve
+func pad(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	return append(make([]byte, size-len(b)), b...)
+}
@@ -13,6 +13,7 @@ import (
 type Logger interface {
 	LogRequest(*http.Request, string, string, int, string)
 	LogDBRequest(string, string, ...interface{})
+	LogPolicyDecision(*http.Request, string, string, bool, bool)
 
 	LogError(error, string)
 	LogStart(string)
@@ -72,6 +73,24 @@ func (l *logger) LogRequest(r *http.Request, duration, errString string, code in
 	}).Info(errString)
 }
 
+// LogPolicyDecision logs the decision of the proxy authorization policy for a
+// request, and whether it was enforced
+func (l *logger) LogPolicyDecision(r *http.Request, id, rule string, allowed, enforced bool) {
+	l.out.WithFields(log.Fields{
+		"type":     "policy",
+		"host":     r.Host,
+		"uri":      r.URL.RequestURI(),
+		"method":   r.Method,
+		"user_id":  id,
+		"rule":     rule,
+		"allowed":  allowed,
+		"enforced": enforced,
+		"server":   l.server,
+		"env":      l.env,
+		"version":  l.version,
+	}).Info("policy decision")
+}
+
 // LogDBRequest logs the sql command
 func (l *logger) LogDBRequest(cmd string, id string, args ...interface{}) {
 	fields := log.Fields{
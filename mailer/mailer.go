@@ -0,0 +1,60 @@
+// Package mailer sends the emails of the secure service, such as invitations
+package mailer
+
+import (
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+)
+
+// Mailer sends plain text emails
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+type smtpMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func (m *smtpMailer) Send(to, subject, body string) error {
+	if strings.ContainsAny(to+subject, "\r\n") {
+		return fmt.Errorf("mailer: invalid header value")
+	}
+
+	msg := "From: " + m.from + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" + body
+
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, []byte(msg))
+}
+
+// stdoutMailer prints emails, for development without an SMTP server
+type stdoutMailer struct{}
+
+func (m *stdoutMailer) Send(to, subject, body string) error {
+	_, err := fmt.Printf("To: %s\nSubject: %s\n\n%s\n", to, subject, body)
+	return err
+}
+
+// New returns a mailer for the SMTP server at SMTP_ADDR, authenticating with
+// SMTP_USERNAME and SMTP_PASSWORD when set. Without SMTP_ADDR emails are
+// printed to stdout.
+func New() Mailer {
+	addr := os.Getenv("SMTP_ADDR")
+	if addr == "" {
+		return &stdoutMailer{}
+	}
+
+	m := &smtpMailer{addr: addr, from: os.Getenv("SMTP_FROM")}
+	if user := os.Getenv("SMTP_USERNAME"); user != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		m.auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	return m
+}
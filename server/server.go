@@ -47,12 +47,13 @@ func New(l logger.Logger, mux *http.ServeMux) {
 			},
 		}
 
+		// there is no write timeout as proxied uploads, downloads and
+		// streams can take long, the routes have their own timeouts
 		srv := &http.Server{
-			ReadTimeout:  5 * time.Second,
-			WriteTimeout: 10 * time.Second,
-			IdleTimeout:  120 * time.Second,
-			Handler:      mux,
-			TLSConfig:    &cnf,
+			ReadHeaderTimeout: 5 * time.Second,
+			IdleTimeout:       120 * time.Second,
+			Handler:           mux,
+			TLSConfig:         &cnf,
 		}
 		go l.LogStart(":443")
 		log.Fatal(srv.ListenAndServeTLS("", ""))